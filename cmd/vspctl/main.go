@@ -0,0 +1,138 @@
+// Command vspctl is an operator tool for the video stream processor's Redis and object storage state.
+// It reads the same .env / environment configuration as the processor.
+//
+// Usage:
+//
+//	vspctl check [-repair] [-ttl 168h]   report (and optionally repair) inconsistent stream checkpoints
+//	vspctl rename-keys [-from ns] [-to ns] [-dry-run]   move the processor's Redis keys to another namespace
+//	vspctl reset-stream <stream-id>...   move cancelled streams back to detected so they are processed again
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/logger"
+	"video-stream-processor/internal/redisstore"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cfg := config.Load()
+	ctx := context.Background()
+	switch os.Args[1] {
+	case "check":
+		os.Exit(check(ctx, cfg, os.Args[2:]))
+	case "rename-keys":
+		os.Exit(renameKeys(ctx, cfg, os.Args[2:]))
+	case "reset-stream":
+		os.Exit(resetStreams(ctx, cfg, os.Args[2:]))
+	default:
+		usage()
+		os.Exit(2)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: vspctl check [-repair] [-ttl 168h]")
+	fmt.Fprintln(os.Stderr, "       vspctl rename-keys [-from ns] [-to ns] [-dry-run]")
+	fmt.Fprintln(os.Stderr, "       vspctl reset-stream <stream-id>...")
+}
+
+// check prints every checkpoint inconsistency and returns 1 if any is left unrepaired.
+func check(ctx context.Context, cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "repair the inconsistencies found")
+	ttl := fs.Duration("ttl", 7*24*time.Hour, "TTL given to completed streams that have none")
+	fs.Parse(args)
+
+	checker, err := redisstore.NewChecker(cfg, *ttl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "check failed:", err)
+		return 1
+	}
+	issues, err := checker.Check(ctx, *repair)
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "check failed:", err)
+		return 1
+	}
+	unrepaired := 0
+	for _, issue := range issues {
+		if !issue.Repaired {
+			unrepaired++
+		}
+	}
+	fmt.Printf("%d issue(s), %d unrepaired\n", len(issues), unrepaired)
+	if unrepaired > 0 {
+		return 1
+	}
+	return 0
+}
+
+// renameKeys moves the processor's keys between namespaces, by default from the unprefixed keys
+// into REDIS_KEY_PREFIX. It returns 1 if any key could not be moved.
+func renameKeys(ctx context.Context, cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("rename-keys", flag.ExitOnError)
+	from := fs.String("from", "", "namespace to move keys from")
+	to := fs.String("to", cfg.RedisKeyPrefix, "namespace to move keys to")
+	dryRun := fs.Bool("dry-run", false, "only list the keys that would be moved")
+	fs.Parse(args)
+
+	renamer, err := redisstore.NewRenamer(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rename failed:", err)
+		return 1
+	}
+	res, err := renamer.Rename(ctx, *from, *to, *dryRun)
+	for _, key := range res.Renamed {
+		fmt.Printf("%s -> %s\n", key, *to+strings.TrimPrefix(key, *from))
+	}
+	for _, key := range res.Conflicts {
+		fmt.Printf("%s: %s already exists, skipped\n", key, *to+strings.TrimPrefix(key, *from))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "rename failed:", err)
+		return 1
+	}
+	verb := "renamed"
+	if *dryRun {
+		verb = "would be renamed"
+	}
+	fmt.Printf("%d key(s) %s, %d conflict(s)\n", len(res.Renamed), verb, len(res.Conflicts))
+	if len(res.Conflicts) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// resetStreams moves cancelled streams back to detected. It returns 1 if any of them could not be reset.
+func resetStreams(ctx context.Context, cfg *config.Config, streamIDs []string) int {
+	if len(streamIDs) == 0 {
+		usage()
+		return 2
+	}
+	store := redisstore.New(cfg, logger.New(cfg.LogLevel))
+	failed := 0
+	for _, id := range streamIDs {
+		if err := store.ResetStream(ctx, id); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", id, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: reset to detected\n", id)
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -7,6 +7,7 @@
 //   - Redis-based checkpointing and resumability
 //   - S3/Minio chunk and metadata uploads
 //   - Prometheus metrics and structured logging
+//   - Circuit breakers that pause intake while Redis or object storage is down
 //   - Graceful shutdown and horizontal scalability
 //
 // Example usage:
@@ -24,12 +25,18 @@ package app
 
 import (
 	"context"
+	"net/http"
 	"sync"
 	"time"
+	"video-stream-processor/internal/boltstore"
+	"video-stream-processor/internal/breaker"
 	"video-stream-processor/internal/config"
 	"video-stream-processor/internal/metrics"
+	"video-stream-processor/internal/queue"
+	"video-stream-processor/internal/ratelimit"
 	"video-stream-processor/internal/redisstore"
 	"video-stream-processor/internal/s3uploader"
+	"video-stream-processor/internal/streamid"
 	"video-stream-processor/internal/watcher"
 
 	"go.uber.org/zap"
@@ -44,15 +51,199 @@ func Run(ctx context.Context, cfg *config.Config, log *zap.Logger) {
 	metrics.Init(cfg.PrometheusPort)
 	log.Info("Starting video stream processor", zap.String("watch_dir", cfg.WatchDir))
 
-	redisClient := redisstore.New(cfg, log)
-	s3Client := s3uploader.New(cfg, log)
+	// Circuit breakers pause file intake while Redis or object storage is failing
+	var breakers []*breaker.Breaker
+	var redisClient redisstore.Store
+	switch cfg.CheckpointStore {
+	case "", "redis":
+		if cfg.BreakerThreshold > 0 {
+			store, redisBreaker := redisstore.NewWithBreaker(cfg, log)
+			redisClient = store
+			breakers = append(breakers, redisBreaker)
+		} else {
+			redisClient = redisstore.New(cfg, log)
+		}
+	case "bolt":
+		// Embedded checkpoint database for single-binary deployments without Redis
+		store, err := boltstore.Open(cfg, log)
+		if err != nil {
+			log.Fatal("Failed to open checkpoint database", zap.String("path", cfg.BoltPath), zap.Error(err))
+		}
+		defer store.Close()
+		if cfg.BoltSweepInterval > 0 {
+			go store.Run(ctx, time.Duration(cfg.BoltSweepInterval)*time.Second)
+		}
+		redisClient = store
+	default:
+		log.Fatal("Unknown CHECKPOINT_STORE", zap.String("store", cfg.CheckpointStore))
+	}
+	// Statuses first: migrated chunk bitmaps take their TTL from the status hash
+	if n, err := redisClient.MigrateStatusKeys(ctx); err != nil {
+		log.Error("Failed to migrate stream statuses to state hashes", zap.Error(err))
+	} else if n > 0 {
+		log.Info("Migrated stream statuses to state hashes", zap.Int("keys", n))
+	}
+	if n, err := redisClient.MigrateChunkKeys(ctx); err != nil {
+		log.Error("Failed to migrate chunk checkpoints to bitmaps", zap.Error(err))
+	} else if n > 0 {
+		log.Info("Migrated chunk checkpoints to bitmaps", zap.Int("keys", n))
+	}
+	// Watch profiles, each with its own directory and upload settings
+	profiles, err := config.LoadProfiles(cfg)
+	if err != nil {
+		log.Fatal("Failed to load watch profiles", zap.String("file", cfg.ProfilesFile), zap.Error(err))
+	}
+	if err := s3uploader.Bootstrap(ctx, cfg, log); err != nil {
+		log.Fatal("Bucket bootstrap failed", zap.String("bucket", cfg.MinioBucket), zap.Error(err))
+	}
+	var limiter *ratelimit.Limiter
+	if cfg.UploadRateLimit > 0 || cfg.UploadRateSchedule != "" {
+		schedule, err := ratelimit.ParseSchedule(cfg.UploadRateSchedule)
+		if err != nil {
+			log.Fatal("Invalid upload rate schedule", zap.Error(err))
+		}
+		limiter = ratelimit.New(cfg.UploadRateLimit, schedule)
+		go limiter.Run(ctx)
+	}
+	// limit charges an uploader's chunks to the shared upload rate limit. The replicator charges it
+	// itself, once per destination.
+	limit := func(up s3uploader.Uploader) s3uploader.Uploader {
+		if limiter != nil {
+			up = s3uploader.NewRateLimited(up, limiter)
+		}
+		return up
+	}
+	// guard applies a circuit breaker named after name to an uploader
+	guard := func(up s3uploader.Uploader, name string, pcfg *config.Config) s3uploader.Uploader {
+		if cfg.BreakerThreshold > 0 {
+			guarded, s3Breaker := s3uploader.NewWithBreaker(up, name, pcfg, log)
+			up = guarded
+			breakers = append(breakers, s3Breaker)
+		}
+		return up
+	}
+	var s3Client s3uploader.Uploader
+	if len(cfg.Replicas) > 0 {
+		replicator := s3uploader.NewReplicator(cfg, redisClient, limiter, log)
+		if cfg.BackfillInterval > 0 {
+			go replicator.RunBackfill(ctx, time.Duration(cfg.BackfillInterval)*time.Second)
+		}
+		s3Client = replicator
+	} else {
+		s3Client = limit(s3uploader.New(cfg, log))
+	}
+	s3Client = guard(s3Client, "object_storage", cfg)
+
+	// Presigned playback URLs, written as an object and/or served over HTTP
+	var presigner s3uploader.Presigner
+	switch cfg.PresignMode {
+	case "", s3uploader.PresignOff:
+	case s3uploader.PresignObject, s3uploader.PresignHTTP, s3uploader.PresignBoth:
+		presigner = s3uploader.NewPresigner(cfg, log)
+	default:
+		log.Fatal("Unknown PRESIGN_MODE", zap.String("mode", cfg.PresignMode))
+	}
+	publishManifests := presigner != nil && cfg.PresignMode != s3uploader.PresignHTTP
+
+	// Garbage collection of chunk objects a finalized stream no longer references
+	var gc *garbageCollector
+	switch cfg.GCMode {
+	case "", s3uploader.GCOff:
+	case s3uploader.GCDryRun, s3uploader.GCDelete:
+		gc = &garbageCollector{objects: s3uploader.NewCollector(cfg, log), keys: redisstore.NewKeys(cfg), dryRun: cfg.GCMode == s3uploader.GCDryRun, log: log}
+	default:
+		log.Fatal("Unknown GC_MODE", zap.String("mode", cfg.GCMode))
+	}
+
+	// Profiles writing to their own bucket or prefix get their own uploader, presigner and collector
+	runtimes := make(map[string]*profileRuntime, len(profiles))
+	for _, p := range profiles {
+		pcfg := cfg.ForProfile(p)
+		rt := &profileRuntime{cfg: pcfg, uploader: s3Client, presigner: presigner, gc: gc, ids: streamid.New(pcfg, redisClient)}
+		if pcfg.MinioBucket != cfg.MinioBucket || p.Prefix != "" {
+			// Backfill entries are copied with the primary layout, which would miss the profile's objects
+			if len(cfg.Replicas) > 0 {
+				log.Fatal("Watch profiles cannot set a bucket or prefix when replicating", zap.String("profile", p.Name))
+			}
+			if pcfg.MinioBucket != cfg.MinioBucket {
+				if err := s3uploader.Bootstrap(ctx, pcfg, log); err != nil {
+					log.Fatal("Bucket bootstrap failed", zap.String("profile", p.Name), zap.String("bucket", pcfg.MinioBucket), zap.Error(err))
+				}
+			}
+			rt.uploader = guard(limit(s3uploader.New(pcfg, log)), "object_storage:"+p.Name, pcfg)
+			if presigner != nil {
+				rt.presigner = s3uploader.NewPresigner(pcfg, log)
+			}
+			if gc != nil {
+				rt.gc = &garbageCollector{objects: s3uploader.NewCollector(pcfg, log), keys: gc.keys, dryRun: gc.dryRun, log: log}
+			}
+		}
+		runtimes[p.Name] = rt
+		log.Info("Watch profile loaded", zap.String("profile", p.Name), zap.String("watch_dir", pcfg.WatchDir),
+			zap.String("bucket", pcfg.MinioBucket), zap.Int("chunk_size", pcfg.ChunkSize), zap.Int("priority", p.Priority))
+	}
+	if presigner != nil && cfg.PresignMode != s3uploader.PresignObject {
+		// Presigned URLs grant read access to the bucket, so the endpoint has its own listener and a token
+		if cfg.ManifestToken == "" {
+			log.Fatal("PRESIGN_MODE serves manifests over HTTP but MANIFEST_TOKEN is not set", zap.String("mode", cfg.PresignMode))
+		}
+		// Manifests are signed for the bucket of the profile the stream's source file belongs to
+		presignerFor := func(file string) s3uploader.Presigner {
+			if rt := profileRuntimeFor(runtimes, profiles, queue.Job{File: file}); rt != nil {
+				return rt.presigner
+			}
+			return nil
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/streams/", newManifestHandler(redisClient, redisstore.NewKeys(cfg), cfg.ManifestToken, presignerFor, log))
+		server := &http.Server{Addr: cfg.ManifestAddr, Handler: mux}
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal("Manifest endpoint failed", zap.String("addr", cfg.ManifestAddr), zap.Error(err))
+			}
+		}()
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		log.Info("Serving signed manifests", zap.String("addr", cfg.ManifestAddr))
+	}
+	for _, b := range breakers {
+		go b.Run(ctx)
+	}
+
+	switch cfg.StreamIDStrategy {
+	case "", streamid.StrategyBasename, streamid.StrategyPath, streamid.StrategyHash, streamid.StrategyUUID:
+	default:
+		log.Fatal("Unknown STREAM_ID_STRATEGY", zap.String("strategy", cfg.StreamIDStrategy))
+	}
+	switch cfg.ContainerCheck {
+	case "", watcher.ContainerCheckOff, watcher.ContainerCheckRoute, watcher.ContainerCheckReject:
+	default:
+		log.Fatal("Unknown CONTAINER_CHECK", zap.String("mode", cfg.ContainerCheck))
+	}
+	for _, p := range profiles {
+		switch readiness := cfg.ForProfile(p).WatchReadiness; readiness {
+		case "", watcher.ReadinessStable, watcher.ReadinessMarker, watcher.ReadinessRename:
+		default:
+			log.Fatal("Unknown WATCH_READINESS", zap.String("profile", p.Name), zap.String("readiness", readiness))
+		}
+	}
+
+	// Work queue between the watcher and the workers, in memory or shared through Redis
+	fileQueue, err := queue.New(cfg, log)
+	if err != nil {
+		log.Fatal("Failed to set up work queue", zap.String("backend", cfg.QueueBackend), zap.Error(err))
+	}
 
 	var wg sync.WaitGroup
-	fileCh := make(chan string, 100)
 
-	// Pass redisClient to watcher.New
-	var w watcher.WatcherInterface = watcher.New(cfg, log, fileCh, redisClient)
-	go w.Start(ctx)
+	// Stream leases keep instances sharing a watch directory from processing the same stream
+	var leases *streamLeases
+	if cfg.LeaseTTL > 0 {
+		leases = newStreamLeases(redisClient, cfg.InstanceID, time.Duration(cfg.LeaseTTL)*time.Second, fileQueue, log)
+		log.Info("Stream leases enabled", zap.String("instance_id", cfg.InstanceID), zap.Int("lease_ttl", cfg.LeaseTTL))
+	}
 
 	workerCount := cfg.WorkerCount
 	if workerCount <= 0 {
@@ -65,24 +256,108 @@ func Run(ctx context.Context, cfg *config.Config, log *zap.Logger) {
 			defer wg.Done()
 			log.Info("Worker started", zap.Int("worker_id", workerID))
 			for {
-				select {
-				case <-ctx.Done():
+				// Do not take new work while a dependency is down
+				if err := breaker.WaitAll(ctx, breakers...); err != nil {
 					log.Info("Worker shutting down", zap.Int("worker_id", workerID))
 					return
-				case file := <-fileCh:
-					log.Info("Worker picked up file", zap.Int("worker_id", workerID), zap.String("file", file))
-					metrics.FilesInProgress.Inc()
-					start := time.Now()
-					processFile(ctx, file, cfg, log, redisClient, s3Client)
-					metrics.FilesInProgress.Dec()
-					metrics.FileProcessingDuration.Observe(time.Since(start).Seconds())
+				}
+				job, err := fileQueue.Dequeue(ctx)
+				if ctx.Err() != nil {
+					log.Info("Worker shutting down", zap.Int("worker_id", workerID))
+					return
+				}
+				if err != nil {
+					log.Error("Failed to take file from queue", zap.Int("worker_id", workerID), zap.Error(err))
+					if cfg.QueueBackend == queue.BackendRedis {
+						metrics.RedisErrors.Inc()
+					}
+					select {
+					case <-ctx.Done():
+					case <-time.After(time.Second):
+					}
+					continue
+				}
+				file := job.File
+				log.Info("Worker picked up file", zap.Int("worker_id", workerID), zap.String("file", file), zap.String("profile", job.Profile))
+				stopKeepAlive := func() {}
+				if interval := queue.KeepAliveInterval(cfg); interval > 0 {
+					// Keep the job from being claimed by another consumer while it is processed
+					stopKeepAlive = queue.KeepAlive(ctx, fileQueue, job, interval, log)
+				}
+				deferred := false // Left unacknowledged until a lease retry has requeued it
+				rt := profileRuntimeFor(runtimes, profiles, job)
+				if rt == nil {
+					log.Error("File matches no watch profile, skipping", zap.String("file", file), zap.String("profile", job.Profile))
+				} else {
+					manifests := rt.presigner
+					if !publishManifests {
+						manifests = nil
+					}
+					process := func(ctx context.Context) {
+						metrics.FilesInProgress.Inc()
+						start := time.Now()
+						processFile(ctx, file, rt.cfg, log, redisClient, rt.uploader, manifests, rt.gc)
+						metrics.FilesInProgress.Dec()
+						metrics.FileProcessingDuration.Observe(time.Since(start).Seconds())
+					}
+					if leases != nil {
+						deferred = leases.process(ctx, job, rt.ids, process)
+					} else {
+						process(ctx)
+					}
+				}
+				stopKeepAlive()
+				// A job interrupted by shutdown stays unacknowledged, so a shared queue redelivers it
+				if ctx.Err() == nil && !deferred {
+					if err := fileQueue.Ack(ctx, job); err != nil {
+						log.Error("Failed to acknowledge queued file", zap.String("file", file), zap.Error(err))
+						metrics.RedisErrors.Inc()
+					}
 				}
 			}
 		}(i)
 	}
 
+	// Streams interrupted by a previous run are queued before the watcher reports new files
+	if n, err := resumeIncompleteStreams(ctx, redisClient, redisstore.NewKeys(cfg), fileQueue, profiles, log); err != nil {
+		log.Error("Failed to resume incomplete streams", zap.Error(err))
+	} else if n > 0 {
+		log.Info("Queued incomplete streams for resumption", zap.Int("streams", n))
+	}
+
+	// One watcher per profile, all feeding the same queue
+	for _, p := range profiles {
+		var w watcher.WatcherInterface = watcher.New(cfg, p, log, fileQueue, redisClient)
+		go w.Start(ctx)
+	}
+
 	<-ctx.Done()
 	log.Info("Waiting for workers to finish...")
 	wg.Wait()
 	log.Info("All workers finished. Shutdown complete.")
 }
+
+// profileRuntime holds what workers use to process the files of one watch profile.
+type profileRuntime struct {
+	cfg       *config.Config // Configuration with the profile's settings applied
+	uploader  s3uploader.Uploader
+	presigner s3uploader.Presigner // Presigns objects in the profile's bucket, nil if PRESIGN_MODE is off
+	gc        *garbageCollector
+	ids       *streamid.Resolver
+}
+
+// profileRuntimeFor returns the runtime of the job's profile. Jobs without a known profile, such as
+// resumed streams or jobs queued before profiles were configured, are matched by the file's path;
+// with a single profile every file belongs to it.
+func profileRuntimeFor(runtimes map[string]*profileRuntime, profiles []config.Profile, job queue.Job) *profileRuntime {
+	if rt, ok := runtimes[job.Profile]; ok {
+		return rt
+	}
+	if len(profiles) == 1 {
+		return runtimes[profiles[0].Name]
+	}
+	if p, ok := config.MatchProfile(profiles, job.File); ok {
+		return runtimes[p.Name]
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"video-stream-processor/internal/metrics"
+	"video-stream-processor/internal/objectkey"
+	"video-stream-processor/internal/redisstore"
+	"video-stream-processor/internal/s3uploader"
+
+	"go.uber.org/zap"
+)
+
+// garbageCollector removes chunk objects and checkpoint keys a stream no longer references,
+// e.g. trailing chunks left behind when a file is replaced by a shorter version, or chunks
+// written under an old key when the key template depends on the file's modification time.
+type garbageCollector struct {
+	objects s3uploader.Collector
+	keys    redisstore.Keys
+	dryRun  bool // only log what would be deleted
+	log     *zap.Logger
+}
+
+// previousChunks returns the chunk keys listed in the stream's last uploaded metadata, so they
+// can still be collected after a change moves the stream to a different prefix.
+func (gc *garbageCollector) previousChunks(ctx context.Context, store redisstore.Store, streamID string) []string {
+	metadataKey, _ := store.GetValue(ctx, gc.keys.Stream(manifestKeyPrefix, streamID))
+	if metadataKey == "" {
+		return nil
+	}
+	data, err := gc.objects.ReadObject(ctx, metadataKey)
+	if err != nil {
+		gc.log.Warn("Failed to read previous metadata", zap.String("stream_id", streamID), zap.String("key", metadataKey), zap.Error(err))
+		return nil
+	}
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		gc.log.Warn("Failed to parse previous metadata", zap.String("stream_id", streamID), zap.String("key", metadataKey), zap.Error(err))
+		return nil
+	}
+	var keys []string
+	for _, c := range meta.Chunks {
+		if c.Key != "" {
+			keys = append(keys, c.Key)
+		}
+	}
+	return keys
+}
+
+// collect deletes every chunk object under the stream's prefix, and every key in candidates,
+// that is not one of the stream's current chunkCount chunks, and clears the checkpoints of
+// chunk indexes past the end of the stream.
+func (gc *garbageCollector) collect(ctx context.Context, store redisstore.Store, stream objectkey.Stream, keys *objectkey.Layout, chunkCount int, candidates []string) {
+	referenced := make(map[string]bool, chunkCount)
+	for i := 0; i < chunkCount; i++ {
+		referenced[keys.ChunkKey(stream, i)] = true
+	}
+	listed, err := gc.objects.ListChunks(ctx, stream)
+	if err != nil {
+		// Still collect the keys we know about from the previous metadata
+		gc.log.Error("Failed to list stream objects", zap.String("stream_id", stream.ID), zap.Error(err))
+	}
+	seen := map[string]bool{}
+	for _, key := range append(candidates, listed...) {
+		if referenced[key] || seen[key] {
+			continue
+		}
+		seen[key] = true
+		if gc.dryRun {
+			gc.log.Info("GC dry run: would delete object", zap.String("stream_id", stream.ID), zap.String("key", key))
+			continue
+		}
+		if err := gc.objects.RemoveObject(ctx, key); err != nil {
+			gc.log.Error("Failed to delete unreferenced object", zap.String("stream_id", stream.ID), zap.String("key", key), zap.Error(err))
+			continue
+		}
+		gc.log.Info("Deleted unreferenced object", zap.String("stream_id", stream.ID), zap.String("key", key))
+		metrics.GarbageCollected.WithLabelValues("object").Inc()
+	}
+
+	uploaded, err := store.UploadedChunks(ctx, stream.ID)
+	if err != nil {
+		gc.log.Error("Failed to read chunk checkpoints", zap.String("stream_id", stream.ID), zap.Error(err))
+		metrics.RedisErrors.Inc()
+		return
+	}
+	stale := 0
+	for _, idx := range uploaded {
+		if idx >= chunkCount {
+			stale++
+		}
+	}
+	if stale == 0 {
+		return
+	}
+	if gc.dryRun {
+		gc.log.Info("GC dry run: would clear checkpoints", zap.String("stream_id", stream.ID), zap.Int("from_chunk", chunkCount), zap.Int("count", stale))
+		return
+	}
+	if err := store.ClearChunks(ctx, stream.ID, chunkCount); err != nil {
+		gc.log.Error("Failed to clear stale checkpoints", zap.String("stream_id", stream.ID), zap.Error(err))
+		metrics.RedisErrors.Inc()
+		return
+	}
+	metrics.GarbageCollected.WithLabelValues("checkpoint").Add(float64(stale))
+}
+
+// resetChunks clears all chunk checkpoints of a stream, so every chunk of a changed file is uploaded again.
+func resetChunks(ctx context.Context, store redisstore.Store, streamID string, log *zap.Logger) {
+	if err := store.ClearChunks(ctx, streamID, 0); err != nil {
+		log.Error("Failed to clear chunk checkpoints", zap.String("stream_id", streamID), zap.Error(err))
+		metrics.RedisErrors.Inc()
+	}
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/objectkey"
+
+	"go.uber.org/zap"
+)
+
+type mockCollector struct {
+	objects map[string][]byte
+	listed  []string
+	removed []string
+}
+
+func (m *mockCollector) ListChunks(ctx context.Context, stream objectkey.Stream) ([]string, error) {
+	return m.listed, nil
+}
+func (m *mockCollector) RemoveObject(ctx context.Context, objectName string) error {
+	m.removed = append(m.removed, objectName)
+	return nil
+}
+func (m *mockCollector) ReadObject(ctx context.Context, objectName string) ([]byte, error) {
+	data, ok := m.objects[objectName]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+
+func TestProcessFile_CollectsShorterVersion(t *testing.T) {
+	dir := t.TempDir()
+	f := dir + "/test.mp4"
+	os.WriteFile(f, []byte("somedata"), 0644)
+	cfg := &config.Config{ChunkSize: 4}
+	// The previous version had four chunks, one of them under an old prefix
+	oldMeta, _ := json.Marshal(Metadata{Chunks: []ChunkMeta{{Index: 0, Key: "old/test.mp4/chunk-00000"}}})
+	redis := &mockRedis{
+		chunkUploaded: map[int]bool{0: true, 1: true, 2: true, 3: true},
+		calls:         map[string]int{},
+		hash:          "oldhash",
+		values:        map[string]string{manifestKeyPrefix + "test.mp4": "old/test.mp4/metadata.json"},
+	}
+	s3 := &mockS3{calls: map[string]int{}}
+	objects := &mockCollector{
+		objects: map[string][]byte{"old/test.mp4/metadata.json": oldMeta},
+		listed:  []string{"test.mp4/chunk-00000", "test.mp4/chunk-00001", "test.mp4/chunk-00002", "test.mp4/chunk-00003"},
+	}
+	gc := &garbageCollector{objects: objects, log: zap.NewNop()}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, gc)
+
+	slices.Sort(objects.removed)
+	want := []string{"old/test.mp4/chunk-00000", "test.mp4/chunk-00002", "test.mp4/chunk-00003"}
+	if !slices.Equal(objects.removed, want) {
+		t.Errorf("expected %v to be removed, got %v", want, objects.removed)
+	}
+	if len(redis.chunkUploaded) != 2 {
+		t.Errorf("expected only the two current checkpoints to remain, got %v", redis.chunkUploaded)
+	}
+}
+
+func TestGarbageCollector_DryRun(t *testing.T) {
+	redis := &mockRedis{chunkUploaded: map[int]bool{0: true, 5: true}, calls: map[string]int{}}
+	objects := &mockCollector{listed: []string{"s1/chunk-00000", "s1/chunk-00005"}}
+	gc := &garbageCollector{objects: objects, dryRun: true, log: zap.NewNop()}
+	gc.collect(context.Background(), redis, objectkey.Stream{ID: "s1"}, objectkey.Default(), 1, nil)
+	if len(objects.removed) != 0 || redis.calls["ClearChunks"] != 0 {
+		t.Errorf("dry run should not delete anything, removed %v", objects.removed)
+	}
+}
+
+func TestGarbageCollector_StaleCheckpoints(t *testing.T) {
+	redis := &mockRedis{chunkUploaded: map[int]bool{0: true, 1: true, 2: true}, calls: map[string]int{}}
+	gc := &garbageCollector{objects: &mockCollector{}, log: zap.NewNop()}
+	gc.collect(context.Background(), redis, objectkey.Stream{ID: "s1"}, objectkey.Default(), 2, nil)
+	if len(redis.chunkUploaded) != 2 || !redis.chunkUploaded[1] {
+		t.Errorf("expected only the checkpoint past the end to be cleared, got %v", redis.chunkUploaded)
+	}
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"video-stream-processor/internal/metrics"
+	"video-stream-processor/internal/queue"
+	"video-stream-processor/internal/redisstore"
+	"video-stream-processor/internal/streamid"
+
+	"go.uber.org/zap"
+)
+
+// streamLeases makes sure only one instance processes a stream at a time when several
+// instances watch the same directory. A worker takes the stream's lease before processing,
+// renews it every third of its TTL and releases it when done. If the lease is held by
+// another instance the file is requeued after one TTL: by then the owner has either finished,
+// in which case processing is skipped, or died without renewing, in which case this instance
+// takes the stream over and resumes it from the Redis checkpoints.
+type streamLeases struct {
+	store   redisstore.Store
+	owner   string
+	ttl     time.Duration
+	requeue queue.Queue
+	log     *zap.Logger
+
+	mu      sync.Mutex
+	pending map[string]bool // files waiting to be requeued
+}
+
+func newStreamLeases(store redisstore.Store, owner string, ttl time.Duration, requeue queue.Queue, log *zap.Logger) *streamLeases {
+	return &streamLeases{store: store, owner: owner, ttl: ttl, requeue: requeue, log: log, pending: map[string]bool{}}
+}
+
+// process runs fn for the job's file while holding the stream's lease, resolving the stream ID with
+// the resolver of the file's profile. The context passed to fn carries the lease's fencing token
+// and is cancelled if the lease is lost. It reports whether the job was left for a retry, in which
+// case the retry acknowledges it and the caller must not.
+func (l *streamLeases) process(ctx context.Context, job queue.Job, ids *streamid.Resolver, fn func(ctx context.Context)) (deferred bool) {
+	streamID, err := ids.Resolve(ctx, job.File)
+	if err != nil {
+		l.log.Error("Failed to resolve stream ID, skipping", zap.String("file", job.File), zap.Error(err))
+		return false
+	}
+	token, err := l.store.AcquireLease(ctx, streamID, l.owner, l.ttl)
+	if errors.Is(err, redisstore.ErrLeaseHeld) {
+		l.log.Info("Stream is being processed by another instance, retrying later", zap.String("stream_id", streamID), zap.Duration("retry_in", l.ttl))
+		metrics.StreamLeaseEvents.WithLabelValues("held").Inc()
+		return l.retryLater(ctx, job)
+	}
+	if err != nil {
+		l.log.Error("Failed to acquire stream lease", zap.String("stream_id", streamID), zap.Error(err))
+		metrics.RedisErrors.Inc()
+		return l.retryLater(ctx, job)
+	}
+
+	leaseCtx, cancel := context.WithCancel(redisstore.WithFenceToken(ctx, token))
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		l.renew(leaseCtx, cancel, streamID, token)
+	}()
+	fn(leaseCtx)
+	cancel()
+	<-renewed
+
+	// Release even during shutdown, so another instance does not have to wait for the TTL
+	releaseCtx, done := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer done()
+	if err := l.store.ReleaseLease(releaseCtx, streamID, token); err != nil {
+		l.log.Warn("Failed to release stream lease", zap.String("stream_id", streamID), zap.Error(err))
+	}
+	return false
+}
+
+// renew extends the lease until ctx is done, and cancels processing if the lease is lost.
+// Transient errors are retried at the next tick; the lease only lapses after a full TTL without renewal.
+func (l *streamLeases) renew(ctx context.Context, cancel context.CancelFunc, streamID string, token int64) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := l.store.RenewLease(ctx, streamID, token, l.ttl)
+			if errors.Is(err, redisstore.ErrLeaseLost) {
+				l.log.Warn("Stream lease lost, stopping processing", zap.String("stream_id", streamID), zap.Int64("token", token))
+				metrics.StreamLeaseEvents.WithLabelValues("lost").Inc()
+				cancel()
+				return
+			}
+			if err != nil && ctx.Err() == nil {
+				l.log.Error("Failed to renew stream lease", zap.String("stream_id", streamID), zap.Error(err))
+				metrics.RedisErrors.Inc()
+			}
+		}
+	}
+}
+
+// retryLater requeues the job's file after one lease TTL and only then acknowledges the job, so a
+// shared queue redelivers it if this instance exits first. It reports whether a retry was scheduled;
+// if one is already pending for the file the job is a duplicate and the caller acknowledges it.
+func (l *streamLeases) retryLater(ctx context.Context, job queue.Job) bool {
+	file := job.File
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending[file] {
+		return false
+	}
+	l.pending[file] = true
+	time.AfterFunc(l.ttl, func() {
+		l.mu.Lock()
+		delete(l.pending, file)
+		l.mu.Unlock()
+		if err := l.requeue.Enqueue(ctx, queue.Job{File: file, Profile: job.Profile, Priority: job.Priority}); err != nil {
+			if ctx.Err() == nil {
+				l.log.Error("Failed to requeue file", zap.String("file", file), zap.Error(err))
+			}
+			return
+		}
+		if err := l.requeue.Ack(ctx, job); err != nil {
+			l.log.Error("Failed to acknowledge requeued file", zap.String("file", file), zap.Error(err))
+			metrics.RedisErrors.Inc()
+		}
+	})
+	return true
+}
@@ -0,0 +1,138 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/queue"
+	"video-stream-processor/internal/redisstore"
+	"video-stream-processor/internal/streamid"
+
+	"go.uber.org/zap"
+)
+
+// mockLeaseStore implements the lease methods of redisstore.Store
+type mockLeaseStore struct {
+	redisstore.Store
+	mu       sync.Mutex
+	held     bool
+	lost     bool
+	renewed  int
+	released []int64
+}
+
+func (m *mockLeaseStore) AcquireLease(ctx context.Context, streamID, owner string, ttl time.Duration) (int64, error) {
+	if m.held {
+		return 0, redisstore.ErrLeaseHeld
+	}
+	return 7, nil
+}
+
+func (m *mockLeaseStore) RenewLease(ctx context.Context, streamID string, token int64, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.renewed++
+	if m.lost {
+		return redisstore.ErrLeaseLost
+	}
+	return nil
+}
+
+func (m *mockLeaseStore) ReleaseLease(ctx context.Context, streamID string, token int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.released = append(m.released, token)
+	return nil
+}
+
+// ackRecordingQueue records the jobs acknowledged on a channel queue
+type ackRecordingQueue struct {
+	queue.Queue
+	mu    sync.Mutex
+	acked []string
+}
+
+func (q *ackRecordingQueue) Ack(ctx context.Context, job queue.Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.acked = append(q.acked, job.ID)
+	return nil
+}
+
+func (q *ackRecordingQueue) ackedIDs() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.acked...)
+}
+
+func TestStreamLeases_Held(t *testing.T) {
+	store := &mockLeaseStore{held: true}
+	requeue := &ackRecordingQueue{Queue: queue.NewChannel(2)}
+	l := newStreamLeases(store, "a", 50*time.Millisecond, requeue, zap.NewNop())
+	ids := streamid.New(&config.Config{}, store)
+	job := queue.Job{ID: "1-0", File: "/videos/test.mp4", Profile: "cameras", Priority: 3}
+	ran := false
+	if !l.process(context.Background(), job, ids, func(ctx context.Context) { ran = true }) {
+		t.Error("A job whose lease is held should be left for the retry to acknowledge")
+	}
+	if l.process(context.Background(), queue.Job{ID: "2-0", File: job.File}, ids, func(ctx context.Context) { ran = true }) {
+		t.Error("A duplicate of a pending retry should be acknowledged by the caller")
+	}
+	if ran {
+		t.Fatal("Processing should not run while another instance holds the lease")
+	}
+	if acked := requeue.ackedIDs(); len(acked) != 0 {
+		t.Fatalf("The job should stay unacknowledged until it is requeued, got %v", acked)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	requeued, err := requeue.Dequeue(ctx)
+	if err != nil {
+		t.Fatal("File was not requeued after the lease TTL")
+	}
+	for deadline := time.Now().Add(time.Second); len(requeue.ackedIDs()) == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if acked := requeue.ackedIDs(); len(acked) != 1 || acked[0] != "1-0" {
+		t.Errorf("The original job should be acknowledged once requeued, got %v", acked)
+	}
+	if requeued != (queue.Job{File: "/videos/test.mp4", Profile: "cameras", Priority: 3}) {
+		t.Errorf("Requeued job should keep its file and profile, got %+v", requeued)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := requeue.Dequeue(ctx); err == nil {
+		t.Error("A pending retry should not be queued twice")
+	}
+}
+
+func TestStreamLeases_RenewAndRelease(t *testing.T) {
+	store := &mockLeaseStore{}
+	l := newStreamLeases(store, "a", 30*time.Millisecond, nil, zap.NewNop())
+	l.process(context.Background(), queue.Job{File: "/videos/test.mp4"}, streamid.New(&config.Config{}, store), func(ctx context.Context) {
+		time.Sleep(50 * time.Millisecond)
+		if ctx.Err() != nil {
+			t.Error("Processing should not be cancelled while the lease is renewed")
+		}
+	})
+	if store.renewed == 0 {
+		t.Error("Lease was not renewed during processing")
+	}
+	if len(store.released) != 1 || store.released[0] != 7 {
+		t.Errorf("Expected lease 7 to be released, got %v", store.released)
+	}
+}
+
+func TestStreamLeases_Lost(t *testing.T) {
+	store := &mockLeaseStore{lost: true}
+	l := newStreamLeases(store, "a", 30*time.Millisecond, nil, zap.NewNop())
+	l.process(context.Background(), queue.Job{File: "/videos/test.mp4"}, streamid.New(&config.Config{}, store), func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Error("Processing was not cancelled after the lease was lost")
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+	"video-stream-processor/internal/objectkey"
+	"video-stream-processor/internal/redisstore"
+	"video-stream-processor/internal/s3uploader"
+
+	"go.uber.org/zap"
+)
+
+// SignedManifest lists presigned GET URLs for a stream's metadata.json and chunks.
+// Consumers can fetch every object with it until ExpiresAt without bucket credentials.
+type SignedManifest struct {
+	StreamID    string        `json:"stream_id"`
+	ExpiresAt   time.Time     `json:"expires_at"`
+	MetadataURL string        `json:"metadata_url"`
+	Chunks      []SignedChunk `json:"chunks"`
+}
+
+// SignedChunk is a presigned URL for a single chunk.
+type SignedChunk struct {
+	Index    int    `json:"index"`
+	Checksum string `json:"checksum"`
+	URL      string `json:"url"`
+}
+
+// manifestKeyPrefix maps a stream ID to the object key of its metadata.json in Redis.
+const manifestKeyPrefix = "stream_manifest:"
+
+// signManifest presigns the metadata document and every chunk listed in meta.
+func signManifest(ctx context.Context, p s3uploader.Presigner, streamID, metadataKey string, meta Metadata) (*SignedManifest, error) {
+	expiresAt := time.Now().Add(p.Expiry()).UTC()
+	metaURL, err := p.PresignGet(ctx, metadataKey)
+	if err != nil {
+		return nil, err
+	}
+	m := &SignedManifest{StreamID: streamID, ExpiresAt: expiresAt, MetadataURL: metaURL}
+	for _, c := range meta.Chunks {
+		u, err := p.PresignGet(ctx, c.Key)
+		if err != nil {
+			return nil, err
+		}
+		m.Chunks = append(m.Chunks, SignedChunk{Index: c.Index, Checksum: c.Checksum, URL: u})
+	}
+	return m, nil
+}
+
+// publishSignedManifest writes a freshly signed manifest object for the stream.
+func publishSignedManifest(ctx context.Context, p s3uploader.Presigner, stream objectkey.Stream, metadataKey string, meta Metadata) error {
+	m, err := signManifest(ctx, p, stream.ID, metadataKey, meta)
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(m)
+	return p.PutManifest(ctx, stream, s3uploader.SignedManifestKey(metadataKey), data)
+}
+
+// manifestHandler serves GET /streams/<stream ID> with a manifest re-signed on every request.
+// Requests must carry "Authorization: Bearer <token>": the presigned URLs grant read access to the bucket.
+type manifestHandler struct {
+	store redisstore.Store
+	keys  redisstore.Keys
+	token string
+	// presignerFor returns the presigner for the bucket a stream's source file was uploaded to,
+	// or nil if the file belongs to no watch profile
+	presignerFor func(file string) s3uploader.Presigner
+	log          *zap.Logger
+}
+
+func newManifestHandler(store redisstore.Store, keys redisstore.Keys, token string, presignerFor func(file string) s3uploader.Presigner, log *zap.Logger) http.Handler {
+	return &manifestHandler{store: store, keys: keys, token: token, presignerFor: presignerFor, log: log}
+}
+
+func (h *manifestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	streamID := strings.TrimPrefix(r.URL.Path, "/streams/")
+	if streamID == "" {
+		http.Error(w, "missing stream ID", http.StatusBadRequest)
+		return
+	}
+	metadataKey, err := h.store.GetValue(r.Context(), h.keys.Stream(manifestKeyPrefix, streamID))
+	if err != nil || metadataKey == "" {
+		http.Error(w, "stream not found", http.StatusNotFound)
+		return
+	}
+	file, _ := h.store.GetValue(r.Context(), h.keys.Stream(streamSourceKeyPrefix, streamID))
+	presigner := h.presignerFor(file)
+	if presigner == nil {
+		h.log.Warn("Stream matches no watch profile, cannot sign its manifest", zap.String("stream_id", streamID), zap.String("file", file))
+		http.Error(w, "stream matches no watch profile", http.StatusNotFound)
+		return
+	}
+	data, err := presigner.ReadObject(r.Context(), metadataKey)
+	if err != nil {
+		h.log.Error("Failed to read metadata", zap.String("stream_id", streamID), zap.String("key", metadataKey), zap.Error(err))
+		http.Error(w, "failed to read metadata", http.StatusBadGateway)
+		return
+	}
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		http.Error(w, "invalid metadata", http.StatusBadGateway)
+		return
+	}
+	m, err := signManifest(r.Context(), presigner, streamID, metadataKey, meta)
+	if err != nil {
+		h.log.Error("Failed to sign manifest", zap.String("stream_id", streamID), zap.Error(err))
+		http.Error(w, "failed to sign manifest", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
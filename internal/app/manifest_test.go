@@ -0,0 +1,116 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/objectkey"
+	"video-stream-processor/internal/redisstore"
+	"video-stream-processor/internal/s3uploader"
+
+	"go.uber.org/zap"
+)
+
+type mockPresigner struct {
+	objects   map[string][]byte
+	manifests map[string][]byte
+}
+
+func (m *mockPresigner) PresignGet(ctx context.Context, objectName string) (string, error) {
+	return "https://minio.local/" + objectName + "?sig=1", nil
+}
+func (m *mockPresigner) Expiry() time.Duration { return time.Hour }
+func (m *mockPresigner) ReadObject(ctx context.Context, objectName string) ([]byte, error) {
+	data, ok := m.objects[objectName]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+func (m *mockPresigner) PutManifest(ctx context.Context, stream objectkey.Stream, objectName string, manifest []byte) error {
+	m.manifests[objectName] = manifest
+	return nil
+}
+
+func TestProcessFile_PublishesSignedManifest(t *testing.T) {
+	dir := t.TempDir()
+	f := dir + "/test.mp4"
+	os.WriteFile(f, []byte("somedata"), 0644)
+	cfg := &config.Config{ChunkSize: 4}
+	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
+	s3 := &mockS3{calls: map[string]int{}}
+	p := &mockPresigner{manifests: map[string][]byte{}}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, p, nil)
+	if redis.values[manifestKeyPrefix+"test.mp4"] != "test.mp4/metadata.json" {
+		t.Errorf("metadata key not recorded: %v", redis.values)
+	}
+	var m SignedManifest
+	if err := json.Unmarshal(p.manifests["test.mp4/signed-manifest.json"], &m); err != nil {
+		t.Fatalf("signed manifest not written: %v", err)
+	}
+	if m.StreamID != "test.mp4" || len(m.Chunks) != 2 || m.Chunks[1].URL != "https://minio.local/test.mp4/chunk-00001?sig=1" {
+		t.Errorf("unexpected signed manifest: %+v", m)
+	}
+}
+
+func TestManifestHandler(t *testing.T) {
+	meta, _ := json.Marshal(Metadata{Chunks: []ChunkMeta{{Index: 0, Key: "cam1/out.mp4/chunk-00000", Checksum: "abc"}}})
+	p := &mockPresigner{objects: map[string][]byte{"cam1/out.mp4/metadata.json": meta}}
+	redis := &mockRedis{calls: map[string]int{}, values: map[string]string{
+		manifestKeyPrefix + "cam1/out.mp4":     "cam1/out.mp4/metadata.json",
+		streamSourceKeyPrefix + "cam1/out.mp4": "/data/cam1/out.mp4",
+		manifestKeyPrefix + "other.mp4":        "other.mp4/metadata.json",
+		streamSourceKeyPrefix + "other.mp4":    "/elsewhere/other.mp4",
+	}}
+	presignerFor := func(file string) s3uploader.Presigner {
+		if strings.HasPrefix(file, "/data/") {
+			return p
+		}
+		return nil
+	}
+	h := newManifestHandler(redis, redisstore.Keys{}, "secret", presignerFor, zap.NewNop())
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if rec := request(http.MethodGet, "/streams/cam1/out.mp4", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 for token %q, got %d", token, rec.Code)
+		}
+	}
+	rec := request(http.MethodGet, "/streams/cam1/out.mp4", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var m SignedManifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.MetadataURL != "https://minio.local/cam1/out.mp4/metadata.json?sig=1" || len(m.Chunks) != 1 || m.Chunks[0].Checksum != "abc" {
+		t.Errorf("unexpected manifest: %+v", m)
+	}
+
+	if rec := request(http.MethodGet, "/streams/unknown.mp4", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown stream, got %d", rec.Code)
+	}
+	if rec := request(http.MethodGet, "/streams/other.mp4", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a stream outside every profile, got %d", rec.Code)
+	}
+	if rec = request(http.MethodPost, "/streams/cam1/out.mp4", "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for POST, got %d", rec.Code)
+	}
+}
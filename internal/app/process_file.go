@@ -3,15 +3,21 @@ package app
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"strconv"
 	"time"
 	"video-stream-processor/internal/chunker"
 	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/container"
 	"video-stream-processor/internal/metrics"
+	"video-stream-processor/internal/objectkey"
 	"video-stream-processor/internal/redisstore"
 	"video-stream-processor/internal/s3uploader"
+	"video-stream-processor/internal/streamid"
+	"video-stream-processor/internal/watcher"
 
 	"crypto/sha256"
 	"encoding/hex"
@@ -19,26 +25,45 @@ import (
 	"go.uber.org/zap"
 )
 
+// streamVersionKeyPrefix prefixes the Redis key holding the version a stream is uploaded under.
+const streamVersionKeyPrefix = "stream_version:"
+
+// streamSourceKeyPrefix prefixes the Redis key holding the source file path of a stream.
+const streamSourceKeyPrefix = "stream_source:"
+
 // Metadata describes the result of a processed video stream.
 type Metadata struct {
-	TotalSize int64       `json:"total_size"`                  // Total size of the video file in bytes
-	Chunks    []ChunkMeta `json:"chunks"`                      // List of all uploaded chunks with checksums and timestamps
-	Duration  float64     `json:"duration_estimate,omitempty"` // Optional: estimated duration in seconds
+	TotalSize  int64           `json:"total_size"`                  // Total size of the video file in bytes
+	Chunks     []ChunkMeta     `json:"chunks"`                      // List of all uploaded chunks with checksums and timestamps
+	Duration   float64         `json:"duration_estimate,omitempty"` // Optional: estimated duration in seconds
+	Encryption *EncryptionMeta `json:"encryption,omitempty"`        // Server-side encryption applied to the objects, if any
+	Version    int             `json:"version,omitempty"`           // Upload version for versioned streams
+	Container  string          `json:"container,omitempty"`         // Container format detected from the file's content, e.g. "mp4" or "mpegts"
+}
+
+// EncryptionMeta records the server-side encryption used for a stream's objects.
+// The SSE-C customer key itself is never written.
+type EncryptionMeta struct {
+	Mode     string `json:"mode"`                 // sse-s3, sse-kms or sse-c
+	KMSKeyID string `json:"kms_key_id,omitempty"` // KMS key ID for sse-kms
 }
 
 // ChunkMeta describes a single uploaded chunk.
 type ChunkMeta struct {
 	Index     int       `json:"index"`     // Chunk index (sequential)
+	Key       string    `json:"key"`       // Object key the chunk was uploaded to
 	Checksum  string    `json:"checksum"`  // SHA256 checksum of the chunk
-	Timestamp time.Time `json:"timestamp"` // Upload timestamp
+	Size      int       `json:"size"`      // Chunk length in bytes
+	Timestamp time.Time `json:"timestamp"` // Upload timestamp, or when the chunk was checked for chunks uploaded by an earlier run
 }
 
 // processFile handles the full lifecycle of a video file upload:
+// - Records the source path and moves the stream to uploading
 // - Chunks the file sequentially
-// - Checks Redis for already uploaded chunks (idempotency)
+// - Fetches the set of already uploaded chunks from Redis (idempotency)
 // - Uploads each chunk to S3/Minio
-// - Updates Redis checkpoint after each chunk
-// - On completion, uploads metadata and marks stream as complete
+// - Atomically updates the Redis checkpoint and progress after each chunk
+// - On completion, moves the stream to finalizing, uploads metadata and marks stream as complete
 // - Sets TTL for resumability and cleanup
 // - All operations are logged and Prometheus metrics are updated
 //
@@ -47,12 +72,20 @@ type ChunkMeta struct {
 //
 // If a chunk upload or Redis operation fails, the error is logged and metrics are incremented, but processing continues for other chunks.
 // This ensures partial uploads can be resumed and the system is robust to transient failures.
+// A stream with failed chunks is not finalized: no metadata is uploaded and it is left partial.
+// A stream whose chunking, checkpoints or metadata upload fail is left failed. Both are resumed by a later run.
 //
 // On completion, metadata is uploaded and the stream is marked as complete in Redis with a TTL for cleanup.
+// If presigner is not nil, a signed manifest with presigned chunk URLs is written next to metadata.json.
+// If gc is not nil, chunk objects and checkpoints the finalized stream no longer references are collected.
 //
 // All operations are designed to be testable and mockable via interfaces.
-func processFile(ctx context.Context, file string, cfg *config.Config, log *zap.Logger, redisClient redisstore.Store, s3Client s3uploader.Uploader) {
-	streamID := filepath.Base(file)
+func processFile(ctx context.Context, file string, cfg *config.Config, log *zap.Logger, redisClient redisstore.Store, s3Client s3uploader.Uploader, presigner s3uploader.Presigner, gc *garbageCollector) {
+	streamID, err := streamid.New(cfg, redisClient).Resolve(ctx, file)
+	if err != nil {
+		log.Error("Failed to resolve stream ID, skipping", zap.String("file", file), zap.Error(err))
+		return
+	}
 	log.Info("Processing file", zap.String("file", file), zap.String("stream_id", streamID))
 
 	// Compute file hash (first 10MB, as in watcher)
@@ -62,9 +95,9 @@ func processFile(ctx context.Context, file string, cfg *config.Config, log *zap.
 		return
 	}
 
-	// Redis keys for hash and status
-	hashKey := "file_hash:" + streamID
-	statusKey := "stream_status:" + streamID
+	// Redis keys for hash and source
+	redisKeys := redisstore.NewKeys(cfg)
+	hashKey := redisKeys.Stream("file_hash:", streamID)
 
 	// Check if file hash in Redis matches current hash and status is completed
 	prevHash, _ := redisClient.GetValue(ctx, hashKey)
@@ -73,67 +106,213 @@ func processFile(ctx context.Context, file string, cfg *config.Config, log *zap.
 		log.Info("File already processed and hash unchanged, skipping", zap.String("file", file), zap.String("stream_id", streamID))
 		return
 	}
+	if status == string(redisstore.StateCancelled) {
+		log.Info("Stream is cancelled, skipping", zap.String("file", file), zap.String("stream_id", streamID))
+		return
+	}
 
 	// If hash changed, reset progress and chunk status
+	var staleChunks []string
 	if prevHash != "" && prevHash != hash {
 		log.Info("File hash changed, resetting progress", zap.String("file", file))
-		redisClient.DeleteKey(ctx, statusKey)
-		redisClient.SetStreamProgress(ctx, streamID, 0)
-		// Optionally, delete all chunk keys (not shown for brevity)
+		if gc != nil && cfg.StreamVersions == 0 {
+			// The old chunks may live under a different prefix, so remember them before the metadata is replaced.
+			// Old versions of versioned streams are kept for rollback and pruned by the uploader instead.
+			staleChunks = gc.previousChunks(ctx, redisClient, streamID)
+		}
+		redisClient.DeleteKey(ctx, redisKeys.Stream("stream_progress:", streamID))
+		resetChunks(ctx, redisClient, streamID, log)
 	}
 
 	// Store new hash with TTL
 	redisClient.SetValue(ctx, hashKey, hash, 7*24*time.Hour)
+	// Record the source file and start a new attempt, so an interrupted run is resumed at startup
+	redisClient.SetValue(ctx, redisKeys.Stream(streamSourceKeyPrefix, streamID), file, 7*24*time.Hour)
+	setStreamState(ctx, redisClient, streamID, redisstore.StateUploading, "", log)
+
+	// Object keys are rendered from the stream ID, source path and modification time
+	stream := objectkey.Stream{ID: streamID, Path: file}
+	if fi, err := os.Stat(file); err == nil {
+		stream.ModTime = fi.ModTime()
+	}
+	if cfg.StreamVersions > 0 {
+		// A changed file starts a new version; an interrupted run resumes the version it was writing
+		stream.Version = streamVersion(ctx, redisClient, redisKeys, streamID, prevHash != hash, log)
+	}
+	keys := s3Client.Layout()
 
-	chunker := chunker.New()
-	chunks, err := chunker.ChunkFile(ctx, file, cfg.ChunkSize)
+	// The chunker follows the file's content, which may not match its extension. With the container
+	// check off the extension is trusted and every file is chunked as plain bytes, as are files whose
+	// content is not recognized.
+	format := container.Unknown
+	if cfg.ContainerCheck != "" && cfg.ContainerCheck != watcher.ContainerCheckOff {
+		if format, err = container.DetectFile(file); err != nil {
+			log.Warn("Failed to detect container format", zap.String("file", file), zap.Error(err))
+		} else if format != container.Unknown && !container.MatchesExt(format, file) {
+			log.Warn("File content does not match its extension", zap.String("file", file), zap.String("container", string(format)))
+		}
+	}
+	uploadedIdx, err := redisClient.UploadedChunks(ctx, streamID)
+	if err != nil {
+		// Without the checkpoints we cannot tell which chunks are missing; a later run resumes the stream
+		log.Error("Redis error", zap.Error(err))
+		metrics.RedisErrors.Inc()
+		setStreamState(ctx, redisClient, streamID, redisstore.StateFailed, "reading checkpoints: "+err.Error(), log)
+		return
+	}
+	// Checkpoints only match chunks of the size they were written with, which changes with the
+	// configured or profile chunk size and with packet alignment. Checkpoints written before the size
+	// was recorded used the configured size as is.
+	chunkSize := chunker.ChunkSize(format, cfg.ChunkSize)
+	info, infoErr := redisClient.GetStreamInfo(ctx, streamID)
+	if infoErr == nil && len(uploadedIdx) > 0 {
+		prevSize := info.ChunkSize
+		if prevSize == 0 {
+			prevSize = cfg.ChunkSize
+		}
+		if prevSize != chunkSize {
+			log.Info("Chunk size changed, resetting progress", zap.String("file", file), zap.Int("old_chunk_size", prevSize), zap.Int("chunk_size", chunkSize))
+			redisClient.DeleteKey(ctx, redisKeys.Stream("stream_progress:", streamID))
+			resetChunks(ctx, redisClient, streamID, log)
+			uploadedIdx = nil
+		}
+	}
+	if err := redisClient.SetStreamChunkSize(ctx, streamID, chunkSize); err != nil {
+		log.Error("Failed to record chunk size", zap.String("stream_id", streamID), zap.Error(err))
+		metrics.RedisErrors.Inc()
+	}
+	// Keys of chunks uploaded by an earlier run were rendered from the modification time the stream
+	// started with; a file touched or copied since must not move them to another date prefix
+	if infoErr == nil && len(uploadedIdx) > 0 && !info.KeyTime.IsZero() {
+		stream.ModTime = info.KeyTime
+	} else if err := redisClient.SetStreamKeyTime(ctx, streamID, stream.ModTime); err != nil {
+		log.Error("Failed to record key time", zap.String("stream_id", streamID), zap.Error(err))
+		metrics.RedisErrors.Inc()
+	}
+	uploaded := make(map[int]bool, len(uploadedIdx))
+	for _, idx := range uploadedIdx {
+		uploaded[idx] = true
+	}
+	chunks, err := chunker.ForContainer(format).ChunkFile(ctx, file, cfg.ChunkSize)
 	if err != nil {
 		log.Error("Chunking failed", zap.Error(err))
 		metrics.UploadFailures.Inc()
+		setStreamState(ctx, redisClient, streamID, redisstore.StateFailed, "chunking: "+err.Error(), log)
 		return
 	}
 	var chunkMetas []ChunkMeta
 	var totalSize int64
+	failed := 0
+	chunkCount := 0
 	for chunk := range chunks {
-		uploaded, err := redisClient.IsChunkUploaded(ctx, streamID, chunk.Index)
-		if err != nil {
-			log.Error("Redis error", zap.Error(err))
-			metrics.RedisErrors.Inc()
-			continue
-		}
-		if uploaded {
+		chunkCount = chunk.Index + 1
+		meta := ChunkMeta{Index: chunk.Index, Key: keys.ChunkKey(stream, chunk.Index), Checksum: chunk.Checksum, Size: len(chunk.Data), Timestamp: chunk.Timestamp}
+		if uploaded[chunk.Index] {
+			// Uploaded by an earlier run; the metadata still lists it so it describes the whole stream
 			log.Debug("Chunk already uploaded, skipping", zap.Int("chunk", chunk.Index))
+			chunkMetas = append(chunkMetas, meta)
+			totalSize += int64(len(chunk.Data))
 			continue
 		}
 		chunkStart := time.Now()
-		if err := s3Client.UploadChunk(ctx, streamID, chunk.Index, chunk.Data); err != nil {
+		if err := s3Client.UploadChunk(ctx, stream, chunk); err != nil {
 			log.Error("Chunk upload failed", zap.Error(err), zap.Int("chunk", chunk.Index))
 			metrics.UploadFailures.Inc()
+			failed++
 			continue
 		}
 		metrics.ChunkUploadDuration.Observe(time.Since(chunkStart).Seconds())
-		if err := redisClient.SetChunkUploaded(ctx, streamID, chunk.Index); err != nil {
-			log.Error("Redis set chunk uploaded failed", zap.Error(err))
+		// Mark the chunk uploaded and advance progress in one atomic step
+		if err := redisClient.CommitChunk(ctx, streamID, chunk.Index); err != nil {
+			log.Error("Redis commit chunk failed", zap.Error(err))
 			metrics.RedisErrors.Inc()
 		}
-		chunkMetas = append(chunkMetas, ChunkMeta{Index: chunk.Index, Checksum: chunk.Checksum, Timestamp: chunk.Timestamp})
+		chunkMetas = append(chunkMetas, meta)
 		totalSize += int64(len(chunk.Data))
 		metrics.ChunksUploaded.Inc()
-		// Update progress in Redis (last uploaded chunk)
-		redisClient.SetStreamProgress(ctx, streamID, chunk.Index)
 	}
-	meta := Metadata{TotalSize: totalSize, Chunks: chunkMetas}
+	if failed > 0 {
+		// Never mark a stream complete with missing chunks; the checkpoints let a later run resume it
+		log.Warn("File processing incomplete, stream left resumable", zap.String("file", file), zap.String("stream_id", streamID), zap.Int("failed_chunks", failed))
+		setStreamState(ctx, redisClient, streamID, redisstore.StatePartial, fmt.Sprintf("%d chunk(s) failed to upload", failed), log)
+		return
+	}
+	if err := setStreamState(ctx, redisClient, streamID, redisstore.StateFinalizing, "", log); err != nil {
+		// The stream was queued again or its state is unavailable; leave finalizing to a later run
+		return
+	}
+	meta := Metadata{TotalSize: totalSize, Chunks: chunkMetas, Encryption: encryptionMeta(cfg), Version: stream.Version, Container: string(format)}
 	metaBytes, _ := json.Marshal(meta)
-	if err := s3Client.UploadMetadata(ctx, streamID, metaBytes); err != nil {
+	if err := s3Client.UploadMetadata(ctx, stream, metaBytes); err != nil {
 		log.Error("Metadata upload failed", zap.Error(err))
 		metrics.UploadFailures.Inc()
+		setStreamState(ctx, redisClient, streamID, redisstore.StateFailed, "metadata upload: "+err.Error(), log)
+		return
+	}
+	// Remember where the manifest lives so readers can find it by stream ID
+	metadataKey := keys.MetadataKey(stream)
+	redisClient.SetValue(ctx, redisKeys.Stream(manifestKeyPrefix, streamID), metadataKey, 7*24*time.Hour)
+	if presigner != nil {
+		if err := publishSignedManifest(ctx, presigner, stream, metadataKey, meta); err != nil {
+			log.Error("Signed manifest upload failed", zap.String("stream_id", streamID), zap.Error(err))
+			metrics.UploadFailures.Inc()
+		}
+	}
+	if gc != nil {
+		gc.collect(ctx, redisClient, stream, keys, chunkCount, staleChunks)
+	}
+	// Status and TTL are applied together so a crash cannot leave a completed stream that never expires
+	if err := redisClient.CompleteStream(ctx, streamID, 7*24*time.Hour); err != nil {
+		log.Error("Redis complete stream failed", zap.String("stream_id", streamID), zap.Error(err))
+		metrics.RedisErrors.Inc()
 	}
-	redisClient.SetStreamStatus(ctx, streamID, "completed")
-	redisClient.SetStreamTTL(ctx, streamID, 7*24*time.Hour)
 	log.Info("File processing complete", zap.String("file", file), zap.String("stream_id", streamID))
 	metrics.LastFileProcessed.Set(float64(time.Now().Unix()))
 }
 
+// setStreamState moves the stream to state `to`, logging the error if the store rejects or fails the transition.
+func setStreamState(ctx context.Context, store redisstore.Store, streamID string, to redisstore.StreamState, reason string, log *zap.Logger) error {
+	err := store.TransitionStream(ctx, streamID, to, reason)
+	switch {
+	case errors.Is(err, redisstore.ErrInvalidTransition):
+		log.Warn("Stream state transition rejected", zap.String("stream_id", streamID), zap.String("state", string(to)), zap.Error(err))
+	case errors.Is(err, redisstore.ErrLeaseLost):
+		log.Warn("Stream state transition fenced, another instance owns the stream", zap.String("stream_id", streamID), zap.String("state", string(to)))
+	case err != nil:
+		log.Error("Failed to update stream state", zap.String("stream_id", streamID), zap.String("state", string(to)), zap.Error(err))
+		metrics.RedisErrors.Inc()
+	}
+	return err
+}
+
+// streamVersion returns the upload version of a stream, starting a new one if newRun is set
+// or the stream has no version yet. Versions are kept in Redis without a TTL so they never repeat.
+func streamVersion(ctx context.Context, store redisstore.Store, keys redisstore.Keys, streamID string, newRun bool, log *zap.Logger) int {
+	key := keys.Stream(streamVersionKeyPrefix, streamID)
+	v, _ := store.GetValue(ctx, key)
+	version, _ := strconv.Atoi(v)
+	if version > 0 && !newRun {
+		return version
+	}
+	version++
+	if err := store.SetValue(ctx, key, strconv.Itoa(version), 0); err != nil {
+		log.Error("Failed to store stream version", zap.String("stream_id", streamID), zap.Error(err))
+		metrics.RedisErrors.Inc()
+	}
+	return version
+}
+
+// encryptionMeta describes the configured server-side encryption, or returns nil if it is disabled.
+func encryptionMeta(cfg *config.Config) *EncryptionMeta {
+	switch cfg.SSEMode {
+	case "", s3uploader.SSENone:
+		return nil
+	case s3uploader.SSEKMS:
+		return &EncryptionMeta{Mode: cfg.SSEMode, KMSKeyID: cfg.SSEKMSKeyID}
+	}
+	return &EncryptionMeta{Mode: cfg.SSEMode}
+}
+
 // fileHash returns a short hash of the file contents (SHA256 hex, first 16 chars).
 func fileHash(path string) string {
 	f, err := os.Open(path)
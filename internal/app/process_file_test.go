@@ -2,12 +2,16 @@ package app
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"video-stream-processor/internal/chunker"
 	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/objectkey"
 	"video-stream-processor/internal/redisstore"
 	"video-stream-processor/internal/s3uploader"
 
@@ -19,8 +23,13 @@ type mockRedis struct {
 	chunkUploaded map[int]bool
 	progress      int
 	status        string
+	lastError     string
 	hash          string
+	values        map[string]string
+	deleted       []string
 	calls         map[string]int
+	chunkSize     int
+	keyTime       time.Time
 	failIsChunk   bool // add this flag
 	failSetChunk  bool // add this flag
 }
@@ -40,6 +49,23 @@ func (m *mockRedis) SetChunkUploaded(ctx context.Context, streamID string, chunk
 	m.chunkUploaded[chunkIdx] = true
 	return nil
 }
+func (m *mockRedis) CommitChunk(ctx context.Context, streamID string, chunkIdx int) error {
+	m.calls["CommitChunk"]++
+	if m.failSetChunk {
+		return errors.New("fail commit chunk")
+	}
+	m.chunkUploaded[chunkIdx] = true
+	m.progress = chunkIdx
+	return nil
+}
+func (m *mockRedis) CompleteStream(ctx context.Context, streamID string, ttl time.Duration) error {
+	m.calls["CompleteStream"]++
+	if m.status != "finalizing" {
+		return redisstore.ErrInvalidTransition
+	}
+	m.status = "completed"
+	return nil
+}
 func (m *mockRedis) SetStreamProgress(ctx context.Context, streamID string, chunkIdx int) error {
 	m.calls["SetStreamProgress"]++
 	m.progress = chunkIdx
@@ -47,20 +73,36 @@ func (m *mockRedis) SetStreamProgress(ctx context.Context, streamID string, chun
 }
 func (m *mockRedis) GetValue(ctx context.Context, key string) (string, error) {
 	m.calls["GetValue"]++
-	return m.hash, nil
+	if strings.HasPrefix(key, "file_hash:") {
+		return m.hash, nil
+	}
+	return m.values[key], nil
 }
 func (m *mockRedis) SetValue(ctx context.Context, key, value string, ttl time.Duration) error {
 	m.calls["SetValue"]++
-	m.hash = value
+	if strings.HasPrefix(key, "file_hash:") {
+		m.hash = value
+		return nil
+	}
+	if m.values == nil {
+		m.values = map[string]string{}
+	}
+	m.values[key] = value
 	return nil
 }
 func (m *mockRedis) GetStreamStatus(ctx context.Context, streamID string) (string, error) {
 	m.calls["GetStreamStatus"]++
 	return m.status, nil
 }
-func (m *mockRedis) SetStreamStatus(ctx context.Context, streamID, status string) error {
-	m.calls["SetStreamStatus"]++
-	m.status = status
+func (m *mockRedis) TransitionStream(ctx context.Context, streamID string, to redisstore.StreamState, reason string) error {
+	m.calls["TransitionStream"]++
+	if !redisstore.CanTransition(redisstore.StreamState(m.status), to) {
+		return redisstore.ErrInvalidTransition
+	}
+	m.status = string(to)
+	if reason != "" {
+		m.lastError = reason
+	}
 	return nil
 }
 func (m *mockRedis) SetStreamTTL(ctx context.Context, streamID string, ttl time.Duration) error {
@@ -69,6 +111,45 @@ func (m *mockRedis) SetStreamTTL(ctx context.Context, streamID string, ttl time.
 }
 func (m *mockRedis) DeleteKey(ctx context.Context, key string) error {
 	m.calls["DeleteKey"]++
+	m.deleted = append(m.deleted, key)
+	return nil
+}
+func (m *mockRedis) UploadedChunks(ctx context.Context, streamID string) ([]int, error) {
+	m.calls["UploadedChunks"]++
+	if m.failIsChunk {
+		return nil, errors.New("redis error")
+	}
+	var idx []int
+	for i, ok := range m.chunkUploaded {
+		if ok {
+			idx = append(idx, i)
+		}
+	}
+	return idx, nil
+}
+func (m *mockRedis) GetStreamInfo(ctx context.Context, streamID string) (redisstore.StreamInfo, error) {
+	if m.status == "" {
+		return redisstore.StreamInfo{}, redisstore.ErrNotFound
+	}
+	return redisstore.StreamInfo{State: redisstore.StreamState(m.status), ChunkSize: m.chunkSize, KeyTime: m.keyTime}, nil
+}
+func (m *mockRedis) SetStreamChunkSize(ctx context.Context, streamID string, size int) error {
+	m.calls["SetStreamChunkSize"]++
+	m.chunkSize = size
+	return nil
+}
+func (m *mockRedis) SetStreamKeyTime(ctx context.Context, streamID string, t time.Time) error {
+	m.calls["SetStreamKeyTime"]++
+	m.keyTime = t
+	return nil
+}
+func (m *mockRedis) ClearChunks(ctx context.Context, streamID string, fromIdx int) error {
+	m.calls["ClearChunks"]++
+	for i := range m.chunkUploaded {
+		if i >= fromIdx {
+			delete(m.chunkUploaded, i)
+		}
+	}
 	return nil
 }
 
@@ -83,22 +164,31 @@ type mockS3 struct {
 	failChunk bool
 	failMeta  bool
 	calls     map[string]int
+	metadata  []byte
+	layout    *objectkey.Layout // objectkey.Default() if nil
 }
 
-func (m *mockS3) UploadChunk(ctx context.Context, streamID string, chunkIdx int, data []byte) error {
+func (m *mockS3) UploadChunk(ctx context.Context, stream objectkey.Stream, chunk chunker.Chunk) error {
 	m.calls["UploadChunk"]++
 	if m.failChunk {
 		return errors.New("fail chunk")
 	}
 	return nil
 }
-func (m *mockS3) UploadMetadata(ctx context.Context, streamID string, metadata []byte) error {
+func (m *mockS3) UploadMetadata(ctx context.Context, stream objectkey.Stream, metadata []byte) error {
 	m.calls["UploadMetadata"]++
 	if m.failMeta {
 		return errors.New("fail meta")
 	}
+	m.metadata = metadata
 	return nil
 }
+func (m *mockS3) Layout() *objectkey.Layout {
+	if m.layout != nil {
+		return m.layout
+	}
+	return objectkey.Default()
+}
 
 func TestProcessFile_Success(t *testing.T) {
 	dir := t.TempDir()
@@ -108,16 +198,172 @@ func TestProcessFile_Success(t *testing.T) {
 	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
 	s3 := &mockS3{calls: map[string]int{}}
 	log := zap.NewNop()
-	processFile(context.Background(), f, cfg, log, redis, s3)
+	processFile(context.Background(), f, cfg, log, redis, s3, nil, nil)
 	if redis.status != "completed" {
 		t.Error("status not set to completed")
 	}
+	if redis.values["stream_source:test.mp4"] != f {
+		t.Error("source path not recorded for resumption")
+	}
 	if s3.calls["UploadChunk"] == 0 {
 		t.Error("UploadChunk not called")
 	}
 	if s3.calls["UploadMetadata"] == 0 {
 		t.Error("UploadMetadata not called")
 	}
+	var meta Metadata
+	if err := json.Unmarshal(s3.metadata, &meta); err != nil {
+		t.Fatalf("metadata is not valid JSON: %v", err)
+	}
+	if len(meta.Chunks) != 2 || meta.Chunks[1].Key != "test.mp4/chunk-00001" {
+		t.Errorf("unexpected chunk keys in metadata: %+v", meta.Chunks)
+	}
+}
+
+func TestProcessFile_ResumedMetadataListsAllChunks(t *testing.T) {
+	dir := t.TempDir()
+	f := dir + "/test.mp4"
+	os.WriteFile(f, []byte("somedata12"), 0644)
+	cfg := &config.Config{ChunkSize: 4}
+	// Chunks 0 and 2 were uploaded by an interrupted run
+	redis := &mockRedis{chunkUploaded: map[int]bool{0: true, 2: true}, calls: map[string]int{}, status: "uploading"}
+	s3 := &mockS3{calls: map[string]int{}}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	if s3.calls["UploadChunk"] != 1 {
+		t.Errorf("only the missing chunk should be uploaded, got %d uploads", s3.calls["UploadChunk"])
+	}
+	var meta Metadata
+	if err := json.Unmarshal(s3.metadata, &meta); err != nil {
+		t.Fatalf("metadata is not valid JSON: %v", err)
+	}
+	if len(meta.Chunks) != 3 || meta.TotalSize != 10 {
+		t.Fatalf("metadata should describe every chunk, got %d chunks and %d bytes", len(meta.Chunks), meta.TotalSize)
+	}
+	for i, c := range meta.Chunks {
+		if c.Index != i || c.Checksum == "" || c.Key == "" || (i < 2 && c.Size != 4) {
+			t.Errorf("unexpected chunk metadata %+v", c)
+		}
+	}
+}
+
+func TestProcessFile_Cancelled(t *testing.T) {
+	dir := t.TempDir()
+	f := dir + "/test.mp4"
+	os.WriteFile(f, []byte("somedata"), 0644)
+	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}, status: "cancelled"}
+	s3 := &mockS3{calls: map[string]int{}}
+	processFile(context.Background(), f, &config.Config{ChunkSize: 4}, zap.NewNop(), redis, s3, nil, nil)
+	if s3.calls["UploadChunk"] != 0 || redis.status != "cancelled" {
+		t.Errorf("a cancelled stream should be left alone, got %d uploads and status %q", s3.calls["UploadChunk"], redis.status)
+	}
+}
+
+func TestProcessFile_ChunkSizeChanged(t *testing.T) {
+	dir := t.TempDir()
+	f := dir + "/test.mp4"
+	os.WriteFile(f, []byte("somedata"), 0644)
+	cfg := &config.Config{ChunkSize: 4}
+	// The checkpoints were written by a run splitting the file into 8-byte chunks
+	redis := &mockRedis{chunkUploaded: map[int]bool{0: true}, chunkSize: 8, calls: map[string]int{}, status: "partial"}
+	s3 := &mockS3{calls: map[string]int{}}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	if redis.calls["ClearChunks"] != 1 || s3.calls["UploadChunk"] != 2 {
+		t.Errorf("checkpoints of another chunk size should be reset, got %d resets and %d uploads", redis.calls["ClearChunks"], s3.calls["UploadChunk"])
+	}
+	if redis.chunkSize != 4 {
+		t.Errorf("the new chunk size should be recorded, got %d", redis.chunkSize)
+	}
+
+	// Unchanged size: the checkpoints are kept
+	redis = &mockRedis{chunkUploaded: map[int]bool{0: true}, chunkSize: 4, calls: map[string]int{}, status: "partial"}
+	s3 = &mockS3{calls: map[string]int{}}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	if redis.calls["ClearChunks"] != 0 || s3.calls["UploadChunk"] != 1 {
+		t.Errorf("checkpoints of the same chunk size should be kept, got %d resets and %d uploads", redis.calls["ClearChunks"], s3.calls["UploadChunk"])
+	}
+}
+
+func TestProcessFile_ResumeKeepsKeyTime(t *testing.T) {
+	dir := t.TempDir()
+	f := dir + "/test.mp4"
+	os.WriteFile(f, []byte("somedata"), 0644)
+	// The file was touched after the first run started on 2026-03-01
+	touched := time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(f, touched, touched)
+	layout, err := objectkey.Parse("{date}/{stream}/{index:05}", "{date}/{stream}/metadata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{ChunkSize: 4}
+	started := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	redis := &mockRedis{chunkUploaded: map[int]bool{0: true}, chunkSize: 4, keyTime: started, calls: map[string]int{}, status: "partial"}
+	s3 := &mockS3{calls: map[string]int{}, layout: layout}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	var meta Metadata
+	json.Unmarshal(s3.metadata, &meta)
+	if len(meta.Chunks) != 2 || meta.Chunks[0].Key != "2026-03-01/test.mp4/00000" || meta.Chunks[1].Key != "2026-03-01/test.mp4/00001" {
+		t.Errorf("resumed chunks should keep the date the stream started with, got %+v", meta.Chunks)
+	}
+
+	// A new stream records the time its keys are rendered with
+	redis = &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
+	s3 = &mockS3{calls: map[string]int{}, layout: layout}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	if !redis.keyTime.Equal(touched) {
+		t.Errorf("expected key time %v to be recorded, got %v", touched, redis.keyTime)
+	}
+}
+
+func TestProcessFile_PathStreamID(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/cam1", 0755)
+	f := dir + "/cam1/out.mp4"
+	os.WriteFile(f, []byte("somedata"), 0644)
+	cfg := &config.Config{ChunkSize: 4, WatchDir: dir, StreamIDStrategy: "path"}
+	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
+	s3 := &mockS3{calls: map[string]int{}}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	if redis.values["stream_source:cam1/out.mp4"] != f {
+		t.Errorf("stream should be tracked by its path in the watch directory, got %v", redis.values)
+	}
+	var meta Metadata
+	json.Unmarshal(s3.metadata, &meta)
+	if len(meta.Chunks) == 0 || meta.Chunks[0].Key != "cam1/out.mp4/chunk-00000" {
+		t.Errorf("unexpected chunk keys in metadata: %+v", meta.Chunks)
+	}
+}
+
+func TestProcessFile_MislabeledTransportStream(t *testing.T) {
+	dir := t.TempDir()
+	f := dir + "/clip.mp4"
+	data := make([]byte, 4*188)
+	for i := 0; i < len(data); i += 188 {
+		data[i] = 0x47
+	}
+	os.WriteFile(f, data, 0644)
+	cfg := &config.Config{ChunkSize: 300, ContainerCheck: "route"}
+	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
+	s3 := &mockS3{calls: map[string]int{}}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	var meta Metadata
+	json.Unmarshal(s3.metadata, &meta)
+	if meta.Container != "mpegts" {
+		t.Errorf("expected the detected container in metadata, got %q", meta.Container)
+	}
+	if len(meta.Chunks) != 4 {
+		t.Errorf("transport stream should be chunked on packet boundaries, got %d chunks", len(meta.Chunks))
+	}
+
+	// With the check off the extension is trusted and the file is chunked as plain bytes
+	cfg.ContainerCheck = "off"
+	redis = &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
+	s3 = &mockS3{calls: map[string]int{}}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	meta = Metadata{}
+	json.Unmarshal(s3.metadata, &meta)
+	if meta.Container != "" || len(meta.Chunks) != 3 {
+		t.Errorf("expected 3 plain chunks without a container, got %q with %d chunks", meta.Container, len(meta.Chunks))
+	}
 }
 
 func TestProcessFile_AlreadyProcessed(t *testing.T) {
@@ -129,7 +375,7 @@ func TestProcessFile_AlreadyProcessed(t *testing.T) {
 	redis.hash = fileHash(f)
 	s3 := &mockS3{calls: map[string]int{}}
 	log := zap.NewNop()
-	processFile(context.Background(), f, cfg, log, redis, s3)
+	processFile(context.Background(), f, cfg, log, redis, s3, nil, nil)
 	if s3.calls["UploadChunk"] > 0 {
 		t.Error("should not upload chunk if already processed")
 	}
@@ -140,7 +386,7 @@ func TestProcessFile_ChunkingError(t *testing.T) {
 	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
 	s3 := &mockS3{calls: map[string]int{}}
 	log := zap.NewNop()
-	processFile(context.Background(), "/notfound.mp4", cfg, log, redis, s3)
+	processFile(context.Background(), "/notfound.mp4", cfg, log, redis, s3, nil, nil)
 	// Should not panic or call s3
 	if s3.calls["UploadChunk"] > 0 {
 		t.Error("should not upload chunk on chunking error")
@@ -155,10 +401,16 @@ func TestProcessFile_ChunkUploadError(t *testing.T) {
 	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
 	s3 := &mockS3{failChunk: true, calls: map[string]int{}}
 	log := zap.NewNop()
-	processFile(context.Background(), f, cfg, log, redis, s3)
+	processFile(context.Background(), f, cfg, log, redis, s3, nil, nil)
 	if s3.calls["UploadChunk"] == 0 {
 		t.Error("UploadChunk should be called even if it fails")
 	}
+	if redis.status != "partial" || s3.calls["UploadMetadata"] > 0 {
+		t.Errorf("stream with failed chunks should be left partial, got %q", redis.status)
+	}
+	if redis.lastError == "" {
+		t.Error("reason for the partial upload not recorded")
+	}
 }
 
 func TestProcessFile_RedisError(t *testing.T) {
@@ -169,7 +421,10 @@ func TestProcessFile_RedisError(t *testing.T) {
 	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}, failIsChunk: true}
 	s3 := &mockS3{calls: map[string]int{}}
 	log := zap.NewNop()
-	processFile(context.Background(), f, cfg, log, redis, s3)
+	processFile(context.Background(), f, cfg, log, redis, s3, nil, nil)
+	if redis.status != "failed" {
+		t.Errorf("stream should be failed when its checkpoints cannot be read, got %q", redis.status)
+	}
 }
 
 func TestProcessFile_MetadataUploadError(t *testing.T) {
@@ -180,7 +435,10 @@ func TestProcessFile_MetadataUploadError(t *testing.T) {
 	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
 	s3 := &mockS3{failMeta: true, calls: map[string]int{}}
 	log := zap.NewNop()
-	processFile(context.Background(), f, cfg, log, redis, s3)
+	processFile(context.Background(), f, cfg, log, redis, s3, nil, nil)
+	if redis.status != "failed" || redis.calls["CompleteStream"] > 0 {
+		t.Errorf("stream without metadata should be left failed, got %q", redis.status)
+	}
 }
 
 func TestProcessFile_HashChanged(t *testing.T) {
@@ -188,13 +446,16 @@ func TestProcessFile_HashChanged(t *testing.T) {
 	f := dir + "/test.mp4"
 	os.WriteFile(f, []byte("somedata"), 0644)
 	cfg := &config.Config{ChunkSize: 4}
-	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}, hash: "oldhash"}
+	redis := &mockRedis{chunkUploaded: map[int]bool{0: true, 1: true}, calls: map[string]int{}, hash: "oldhash"}
 	s3 := &mockS3{calls: map[string]int{}}
 	log := zap.NewNop()
-	processFile(context.Background(), f, cfg, log, redis, s3)
+	processFile(context.Background(), f, cfg, log, redis, s3, nil, nil)
 	if redis.calls["DeleteKey"] == 0 {
 		t.Error("DeleteKey should be called if hash changed")
 	}
+	if s3.calls["UploadChunk"] != 2 {
+		t.Errorf("chunk checkpoints of the old version should be reset, got %d uploads", s3.calls["UploadChunk"])
+	}
 }
 
 func TestProcessFile_FailedHash(t *testing.T) {
@@ -202,7 +463,7 @@ func TestProcessFile_FailedHash(t *testing.T) {
 	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
 	s3 := &mockS3{calls: map[string]int{}}
 	log := zap.NewNop()
-	processFile(context.Background(), "/doesnotexist.mp4", cfg, log, redis, s3)
+	processFile(context.Background(), "/doesnotexist.mp4", cfg, log, redis, s3, nil, nil)
 	// Should not panic or call s3
 	if s3.calls["UploadChunk"] > 0 {
 		t.Error("should not upload chunk if file hash fails")
@@ -217,5 +478,47 @@ func TestProcessFile_ChunkSetChunkUploadedError(t *testing.T) {
 	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}, failSetChunk: true}
 	s3 := &mockS3{calls: map[string]int{}}
 	log := zap.NewNop()
-	processFile(context.Background(), f, cfg, log, redis, s3)
+	processFile(context.Background(), f, cfg, log, redis, s3, nil, nil)
+}
+
+func TestEncryptionMeta(t *testing.T) {
+	if m := encryptionMeta(&config.Config{SSEMode: "none"}); m != nil {
+		t.Errorf("expected no encryption metadata, got %+v", m)
+	}
+	m := encryptionMeta(&config.Config{SSEMode: "sse-kms", SSEKMSKeyID: "key-1"})
+	if m == nil || m.Mode != "sse-kms" || m.KMSKeyID != "key-1" {
+		t.Errorf("unexpected sse-kms metadata: %+v", m)
+	}
+	m = encryptionMeta(&config.Config{SSEMode: "sse-c", SSECKeyFile: "/secret"})
+	if m == nil || m.Mode != "sse-c" || m.KMSKeyID != "" {
+		t.Errorf("unexpected sse-c metadata: %+v", m)
+	}
+}
+
+func TestProcessFile_StreamVersions(t *testing.T) {
+	dir := t.TempDir()
+	f := dir + "/test.mp4"
+	os.WriteFile(f, []byte("somedata"), 0644)
+	cfg := &config.Config{ChunkSize: 4, StreamVersions: 2}
+	redis := &mockRedis{chunkUploaded: map[int]bool{}, calls: map[string]int{}}
+	s3 := &mockS3{calls: map[string]int{}}
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	var meta Metadata
+	json.Unmarshal(s3.metadata, &meta)
+	if meta.Version != 1 || redis.values[streamVersionKeyPrefix+"test.mp4"] != "1" {
+		t.Errorf("first run should write version 1, got %d", meta.Version)
+	}
+
+	// An interrupted run resumes its version
+	if v := streamVersion(context.Background(), redis, redisstore.Keys{}, "test.mp4", false, zap.NewNop()); v != 1 {
+		t.Errorf("resumed run should keep version 1, got %d", v)
+	}
+
+	// A changed file starts a new version
+	os.WriteFile(f, []byte("otherdata"), 0644)
+	processFile(context.Background(), f, cfg, zap.NewNop(), redis, s3, nil, nil)
+	json.Unmarshal(s3.metadata, &meta)
+	if meta.Version != 2 {
+		t.Errorf("changed file should be written as version 2, got %d", meta.Version)
+	}
 }
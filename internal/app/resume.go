@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"os"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/metrics"
+	"video-stream-processor/internal/queue"
+	"video-stream-processor/internal/redisstore"
+
+	"go.uber.org/zap"
+)
+
+// orphanedTTL is how long an orphaned stream stays visible before its status expires.
+const orphanedTTL = 7 * 24 * time.Hour
+
+// resumeIncompleteStreams queues the source files of streams a previous run left incomplete, so they
+// are processed before newly detected files: each is queued for its profile with a priority above that
+// of every profile. Streams whose source file is unknown or no longer exists are moved to orphaned and
+// reported; their chunks stay in object storage for inspection. A stream that cannot be marked orphaned
+// is logged and skipped. Streams whose lease is held are being processed by a live instance and are left
+// alone. The state of queued streams is not touched: the worker that takes the stream's lease moves it on.
+// It returns the number of streams queued.
+func resumeIncompleteStreams(ctx context.Context, store redisstore.Store, keys redisstore.Keys, q queue.Queue, profiles []config.Profile, log *zap.Logger) (int, error) {
+	streams, err := store.ScanIncompleteStreams(ctx)
+	if err != nil {
+		return 0, err
+	}
+	boost := resumePriorityBoost(profiles)
+	queued := 0
+	for _, streamID := range streams {
+		if owner, _ := store.GetValue(ctx, keys.Stream("stream_lease:", streamID)); owner != "" {
+			log.Info("Incomplete stream is leased by a running instance, not resuming it", zap.String("stream_id", streamID), zap.String("owner", owner))
+			continue
+		}
+		file, _ := store.GetValue(ctx, keys.Stream(streamSourceKeyPrefix, streamID))
+		if file != "" {
+			if _, err := os.Stat(file); err == nil {
+				job := queue.Job{File: file, Priority: boost}
+				if p, ok := resumeProfile(profiles, file); ok {
+					job.Profile, job.Priority = p.Name, p.Priority+boost
+				}
+				if err := q.Enqueue(ctx, job); err != nil {
+					return queued, err
+				}
+				log.Info("Resuming incomplete stream", zap.String("stream_id", streamID), zap.String("file", file), zap.String("profile", job.Profile))
+				queued++
+				continue
+			}
+		}
+		log.Warn("Source file of incomplete stream is gone, marking it orphaned", zap.String("stream_id", streamID), zap.String("file", file))
+		metrics.OrphanedStreams.Inc()
+		if err := store.TransitionStream(ctx, streamID, redisstore.StateOrphaned, "source file missing"); err != nil {
+			log.Error("Failed to mark stream orphaned", zap.String("stream_id", streamID), zap.Error(err))
+			metrics.RedisErrors.Inc()
+			continue
+		}
+		if err := store.SetStreamTTL(ctx, streamID, orphanedTTL); err != nil {
+			log.Error("Failed to expire orphaned stream", zap.String("stream_id", streamID), zap.Error(err))
+			metrics.RedisErrors.Inc()
+		}
+	}
+	return queued, nil
+}
+
+// resumeProfile returns the profile a resumed file belongs to, as profileRuntimeFor finds it for the worker.
+func resumeProfile(profiles []config.Profile, file string) (config.Profile, bool) {
+	if len(profiles) == 1 {
+		return profiles[0], true
+	}
+	return config.MatchProfile(profiles, file)
+}
+
+// resumePriorityBoost returns the priority added to resumed streams, so that even those of the lowest
+// priority profile are taken before new files of the highest.
+func resumePriorityBoost(profiles []config.Profile) int {
+	if len(profiles) == 0 {
+		return 1
+	}
+	lo, hi := profiles[0].Priority, profiles[0].Priority
+	for _, p := range profiles[1:] {
+		lo, hi = min(lo, p.Priority), max(hi, p.Priority)
+	}
+	return hi - lo + 1
+}
@@ -0,0 +1,127 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/queue"
+	"video-stream-processor/internal/redisstore"
+
+	"go.uber.org/zap"
+)
+
+// mockResumeStore implements the methods of redisstore.Store used when resuming streams
+type mockResumeStore struct {
+	redisstore.Store
+	incomplete []string
+	values     map[string]string
+	status     map[string]string
+	ttl        map[string]time.Duration
+	failing    string // stream whose transitions fail
+}
+
+func (m *mockResumeStore) ScanIncompleteStreams(ctx context.Context) ([]string, error) {
+	return m.incomplete, nil
+}
+func (m *mockResumeStore) GetValue(ctx context.Context, key string) (string, error) {
+	return m.values[key], nil
+}
+func (m *mockResumeStore) TransitionStream(ctx context.Context, streamID string, to redisstore.StreamState, reason string) error {
+	if streamID == m.failing {
+		return errors.New("redis unavailable")
+	}
+	m.status[streamID] = string(to)
+	return nil
+}
+func (m *mockResumeStore) SetStreamTTL(ctx context.Context, streamID string, ttl time.Duration) error {
+	m.ttl[streamID] = ttl
+	return nil
+}
+
+func TestResumeIncompleteStreams(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present.mp4")
+	os.WriteFile(present, []byte("data"), 0644)
+	store := &mockResumeStore{
+		incomplete: []string{"broken.mp4", "present.mp4", "leased.mp4", "deleted.mp4", "unknown.mp4"},
+		values: map[string]string{
+			"stream_source:present.mp4": present,
+			"stream_source:leased.mp4":  present,
+			"stream_lease:leased.mp4":   "other-instance:3",
+			"stream_source:deleted.mp4": filepath.Join(dir, "deleted.mp4"),
+		},
+		status:  map[string]string{},
+		ttl:     map[string]time.Duration{},
+		failing: "broken.mp4",
+	}
+	profiles := []config.Profile{{Name: "archive", WatchDir: dir, Priority: -2}, {Name: "cameras", WatchDir: "/cameras", Priority: 10}}
+	q := queue.NewChannel(10)
+	// A new file of the highest priority profile is already waiting
+	q.Enqueue(context.Background(), queue.Job{File: "/cameras/new.ts", Profile: "cameras", Priority: 10})
+	n, err := resumeIncompleteStreams(context.Background(), store, redisstore.Keys{}, q, profiles, zap.NewNop())
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 stream queued, got %d (%v)", n, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if job, err := q.Dequeue(ctx); err != nil || job.File != present || job.Profile != "archive" {
+		t.Errorf("Expected %s to be queued for its profile ahead of new files, got %+v (%v)", present, job, err)
+	}
+	if job, _ := q.Dequeue(ctx); job.File != "/cameras/new.ts" {
+		t.Errorf("Expected the new file after the resumed stream, got %+v", job)
+	}
+	for _, id := range []string{"deleted.mp4", "unknown.mp4"} {
+		if store.status[id] != "orphaned" || store.ttl[id] != orphanedTTL {
+			t.Errorf("%s should be marked orphaned with a TTL, got %q %v", id, store.status[id], store.ttl[id])
+		}
+	}
+	if _, ok := store.status["broken.mp4"]; ok {
+		t.Error("broken.mp4 should not have changed state")
+	}
+	if job, ok := dequeueWithin(q, 50*time.Millisecond); ok {
+		t.Errorf("A stream leased by another instance should not be queued, got %+v", job)
+	}
+	for _, id := range []string{"present.mp4", "leased.mp4"} {
+		if state, ok := store.status[id]; ok {
+			t.Errorf("The state of %s should be left to the worker, got %q", id, state)
+		}
+	}
+}
+
+func dequeueWithin(q queue.Queue, d time.Duration) (queue.Job, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	job, err := q.Dequeue(ctx)
+	return job, err == nil
+}
+
+func TestProfileRuntimeFor(t *testing.T) {
+	profiles := []config.Profile{
+		{Name: "videos", WatchDir: "/data/videos"},
+		{Name: "cameras", WatchDir: "/data/videos/cameras"},
+	}
+	runtimes := map[string]*profileRuntime{"videos": {}, "cameras": {}}
+	cases := []struct {
+		job  queue.Job
+		want string
+	}{
+		{queue.Job{File: "/data/videos/cameras/a.ts", Profile: "videos"}, "videos"},
+		{queue.Job{File: "/data/videos/cameras/a.ts"}, "cameras"}, // Resumed: deepest directory wins
+		{queue.Job{File: "/data/videos/b.mp4", Profile: "removed"}, "videos"},
+		{queue.Job{File: "/elsewhere/c.mp4"}, ""},
+	}
+	for _, c := range cases {
+		rt := profileRuntimeFor(runtimes, profiles, c.job)
+		if (c.want == "" && rt != nil) || (c.want != "" && rt != runtimes[c.want]) {
+			t.Errorf("%+v: expected profile %q", c.job, c.want)
+		}
+	}
+	single := []config.Profile{{Name: config.DefaultProfile, WatchDir: "/data/videos"}}
+	if rt := profileRuntimeFor(map[string]*profileRuntime{config.DefaultProfile: {}}, single, queue.Job{File: "/elsewhere/c.mp4"}); rt == nil {
+		t.Error("With a single profile every file should belong to it")
+	}
+}
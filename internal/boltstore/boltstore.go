@@ -0,0 +1,624 @@
+// Package boltstore provides a redisstore.Store backed by an embedded bbolt database, for edge
+// boxes that run the processor as a single binary without Redis.
+//
+// Keys are named exactly as in Redis (see redisstore.Keys) and every update that Redis performs in
+// a Lua script runs in a single bbolt transaction, so checkpoints, leases and fencing behave the same.
+// Each value carries its expiry time: expired keys are treated as missing on read and deleted by Run.
+package boltstore
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/redisstore"
+
+	bolt "go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// replicaChunkTTL and fenceTTL match the lifetimes the Redis store gives the same keys.
+const (
+	replicaChunkTTL = 7 * 24 * time.Hour
+	fenceTTL        = 7 * 24 * time.Hour
+)
+
+var bucketName = []byte("keys")
+
+// Store is a redisstore.Store backed by a bbolt database file.
+type Store struct {
+	db   *bolt.DB
+	keys redisstore.Keys
+	now  func() time.Time
+	log  *zap.Logger
+}
+
+var _ redisstore.Store = (*Store)(nil)
+
+// Open opens (or creates) the database at cfg.BoltPath. The caller is expected to run the sweeper and close the store.
+func Open(cfg *config.Config, log *zap.Logger) (*Store, error) {
+	db, err := bolt.Open(cfg.BoltPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db, keys: redisstore.NewKeys(cfg), now: time.Now, log: log}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Run deletes expired keys every interval until ctx is done.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.Sweep()
+			if err != nil {
+				s.log.Error("Failed to sweep expired checkpoints", zap.Error(err))
+			} else if n > 0 {
+				s.log.Debug("Swept expired checkpoints", zap.Int("keys", n))
+			}
+		}
+	}
+}
+
+// Sweep deletes all expired keys and returns how many were deleted.
+func (s *Store) Sweep() (int, error) {
+	swept := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		now := s.now()
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if isExpired(v, now) {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		swept = len(expired)
+		return nil
+	})
+	return swept, err
+}
+
+// txn wraps a bucket with Redis-like key operations that honour expiry.
+type txn struct {
+	b   *bolt.Bucket
+	now time.Time
+}
+
+func (s *Store) update(fn func(t txn) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(txn{b: tx.Bucket(bucketName), now: s.now()})
+	})
+}
+
+func (s *Store) view(fn func(t txn) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(txn{b: tx.Bucket(bucketName), now: s.now()})
+	})
+}
+
+// Values are stored as an 8 byte expiry (Unix nanoseconds, 0 for none) followed by the value.
+func isExpired(raw []byte, now time.Time) bool {
+	if len(raw) < 8 {
+		return true
+	}
+	exp := int64(binary.BigEndian.Uint64(raw))
+	return exp != 0 && exp <= now.UnixNano()
+}
+
+// get returns the value of key and its expiry (zero for none), or false if it is missing or expired.
+func (t txn) get(key string) ([]byte, time.Time, bool) {
+	raw := t.b.Get([]byte(key))
+	if raw == nil || isExpired(raw, t.now) {
+		return nil, time.Time{}, false
+	}
+	var exp time.Time
+	if n := int64(binary.BigEndian.Uint64(raw)); n != 0 {
+		exp = time.Unix(0, n)
+	}
+	return append([]byte(nil), raw[8:]...), exp, true
+}
+
+// set stores value with the given expiry (zero for none).
+func (t txn) set(key string, value []byte, exp time.Time) error {
+	raw := make([]byte, 8+len(value))
+	if !exp.IsZero() {
+		binary.BigEndian.PutUint64(raw, uint64(exp.UnixNano()))
+	}
+	copy(raw[8:], value)
+	return t.b.Put([]byte(key), raw)
+}
+
+// expiry returns the expiry time for ttl, or zero for a ttl of 0 (no expiry).
+func (t txn) expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return t.now.Add(ttl)
+}
+
+// expire sets the TTL of an existing key, like EXPIRE (ttl 0 persists it).
+func (t txn) expire(key string, ttl time.Duration) error {
+	value, _, ok := t.get(key)
+	if !ok {
+		return nil
+	}
+	return t.set(key, value, t.expiry(ttl))
+}
+
+func (t txn) del(key string) error {
+	return t.b.Delete([]byte(key))
+}
+
+// keysWithPrefix returns the live keys starting with prefix.
+func (t txn) keysWithPrefix(prefix string) []string {
+	var keys []string
+	c := t.b.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+		if !isExpired(v, t.now) {
+			keys = append(keys, string(k))
+		}
+	}
+	return keys
+}
+
+// setBit sets or clears a bit of the bitmap at key like SETBIT, keeping its expiry.
+func (t txn) setBit(key string, idx int, on bool) error {
+	bitmap, exp, _ := t.get(key)
+	if idx/8 >= len(bitmap) {
+		if !on {
+			return nil
+		}
+		bitmap = append(bitmap, make([]byte, idx/8+1-len(bitmap))...)
+	}
+	// Bits are numbered from the most significant bit of the first byte, as in Redis
+	if on {
+		bitmap[idx/8] |= 0x80 >> (idx % 8)
+	} else {
+		bitmap[idx/8] &^= 0x80 >> (idx % 8)
+	}
+	return t.set(key, bitmap, exp)
+}
+
+func (t txn) getBit(key string, idx int) bool {
+	bitmap, _, _ := t.get(key)
+	return idx/8 < len(bitmap) && bitmap[idx/8]&(0x80>>(idx%8)) != 0
+}
+
+// setBits returns the offsets of the set bits of a bitmap.
+func setBits(bitmap []byte) []int {
+	var idx []int
+	for i, b := range bitmap {
+		for j := 0; j < 8; j++ {
+			if b&(0x80>>j) != 0 {
+				idx = append(idx, i*8+j)
+			}
+		}
+	}
+	return idx
+}
+
+func (s *Store) SetChunkUploaded(ctx context.Context, streamID string, chunkIdx int) error {
+	return s.update(func(t txn) error {
+		return t.setBit(s.keys.Stream("chunk_bitmap:", streamID), chunkIdx, true)
+	})
+}
+
+func (s *Store) IsChunkUploaded(ctx context.Context, streamID string, chunkIdx int) (bool, error) {
+	var uploaded bool
+	err := s.view(func(t txn) error {
+		uploaded = t.getBit(s.keys.Stream("chunk_bitmap:", streamID), chunkIdx)
+		return nil
+	})
+	return uploaded, err
+}
+
+func (s *Store) UploadedChunks(ctx context.Context, streamID string) ([]int, error) {
+	var idx []int
+	err := s.view(func(t txn) error {
+		bitmap, _, _ := t.get(s.keys.Stream("chunk_bitmap:", streamID))
+		idx = setBits(bitmap)
+		return nil
+	})
+	return idx, err
+}
+
+func (s *Store) ClearChunks(ctx context.Context, streamID string, fromIdx int) error {
+	return s.update(func(t txn) error {
+		keys := []string{s.keys.Stream("chunk_bitmap:", streamID)}
+		prefix := s.keys.Name("replica_bitmap:")
+		for _, key := range t.keysWithPrefix(prefix) {
+			if dest, _, ok := strings.Cut(strings.TrimPrefix(key, prefix), ":"); ok && key == s.keys.Replica(dest, streamID) {
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			if fromIdx <= 0 {
+				if err := t.del(key); err != nil {
+					return err
+				}
+				continue
+			}
+			bitmap, _, _ := t.get(key)
+			for _, idx := range setBits(bitmap) {
+				if idx < fromIdx {
+					continue
+				}
+				if err := t.setBit(key, idx, false); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateChunkKeys is a no-op: per-chunk keys were only ever written to Redis.
+func (s *Store) MigrateChunkKeys(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+func (s *Store) SetStreamProgress(ctx context.Context, streamID string, chunkIdx int) error {
+	return s.SetValue(ctx, s.keys.Stream("stream_progress:", streamID), strconv.Itoa(chunkIdx), 0)
+}
+
+func (s *Store) GetStreamProgress(ctx context.Context, streamID string) (int, error) {
+	v, err := s.GetValue(ctx, s.keys.Stream("stream_progress:", streamID))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
+
+// status returns the status hash of a stream, stored as a JSON object, or nil if it has none.
+func (s *Store) status(t txn, streamID string) map[string]string {
+	v, _, ok := t.get(s.keys.Stream("stream_status:", streamID))
+	if !ok {
+		return nil
+	}
+	var fields map[string]string
+	json.Unmarshal(v, &fields)
+	return fields
+}
+
+// transition applies a state transition to the stream's status and stores it with the given expiry.
+func (s *Store) transition(t txn, streamID string, to redisstore.StreamState, reason string, exp time.Time) error {
+	fields := s.status(t, streamID)
+	if fields == nil {
+		fields = map[string]string{}
+	}
+	if err := redisstore.ApplyTransition(fields, to, reason, t.now); err != nil {
+		return err
+	}
+	v, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return t.set(s.keys.Stream("stream_status:", streamID), v, exp)
+}
+
+func (s *Store) GetStreamStatus(ctx context.Context, streamID string) (string, error) {
+	info, err := s.GetStreamInfo(ctx, streamID)
+	return string(info.State), err
+}
+
+// TransitionStream atomically moves a stream to state `to`; see redisstore.StreamState.
+// Like in Redis, the status loses its TTL until the stream is completed or orphaned.
+func (s *Store) TransitionStream(ctx context.Context, streamID string, to redisstore.StreamState, reason string) error {
+	return s.update(func(t txn) error {
+		if err := s.checkFence(ctx, t, streamID); err != nil {
+			return err
+		}
+		return s.transition(t, streamID, to, reason, time.Time{})
+	})
+}
+
+// ResetStream moves a cancelled stream back to detected; see redisstore.StreamState.
+func (s *Store) ResetStream(ctx context.Context, streamID string) error {
+	return s.update(func(t txn) error {
+		fields := s.status(t, streamID)
+		if fields == nil {
+			fields = map[string]string{}
+		}
+		if err := redisstore.ApplyReset(fields, t.now); err != nil {
+			return err
+		}
+		v, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		return t.set(s.keys.Stream("stream_status:", streamID), v, time.Time{})
+	})
+}
+
+func (s *Store) GetStreamInfo(ctx context.Context, streamID string) (redisstore.StreamInfo, error) {
+	var fields map[string]string
+	s.view(func(t txn) error {
+		fields = s.status(t, streamID)
+		return nil
+	})
+	if fields == nil {
+		return redisstore.StreamInfo{}, redisstore.ErrNotFound
+	}
+	return redisstore.ParseStreamInfo(fields), nil
+}
+
+// SetStreamChunkSize records the chunk size in the stream's status, keeping its expiry.
+func (s *Store) SetStreamChunkSize(ctx context.Context, streamID string, size int) error {
+	return s.updateStatus(streamID, func(fields map[string]string) { redisstore.ApplyChunkSize(fields, size) })
+}
+
+// SetStreamKeyTime records the key time in the stream's status, keeping its expiry.
+func (s *Store) SetStreamKeyTime(ctx context.Context, streamID string, t time.Time) error {
+	return s.updateStatus(streamID, func(fields map[string]string) { redisstore.ApplyKeyTime(fields, t) })
+}
+
+// updateStatus applies apply to the fields of the stream's status, keeping its expiry.
+func (s *Store) updateStatus(streamID string, apply func(fields map[string]string)) error {
+	return s.update(func(t txn) error {
+		key := s.keys.Stream("stream_status:", streamID)
+		_, exp, _ := t.get(key)
+		fields := s.status(t, streamID)
+		if fields == nil {
+			fields = map[string]string{}
+		}
+		apply(fields)
+		v, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		return t.set(key, v, exp)
+	})
+}
+
+// MigrateStatusKeys is a no-op: plain string statuses were only ever written to Redis.
+func (s *Store) MigrateStatusKeys(ctx context.Context) (int, error) {
+	return 0, nil
+}
+
+// SetStreamTTL expires the stream status together with the stream's chunk bitmap.
+func (s *Store) SetStreamTTL(ctx context.Context, streamID string, ttl time.Duration) error {
+	return s.update(func(t txn) error {
+		if err := t.expire(s.keys.Stream("chunk_bitmap:", streamID), ttl); err != nil {
+			return err
+		}
+		return t.expire(s.keys.Stream("stream_status:", streamID), ttl)
+	})
+}
+
+// ScanIncompleteStreams returns the streams whose state is not terminal.
+func (s *Store) ScanIncompleteStreams(ctx context.Context) ([]string, error) {
+	var streams []string
+	err := s.view(func(t txn) error {
+		for _, key := range t.keysWithPrefix(s.keys.Name("stream_status:")) {
+			streamID := s.keys.StreamID("stream_status:", key)
+			if fields := s.status(t, streamID); fields != nil && !redisstore.ParseStreamInfo(fields).State.Terminal() {
+				streams = append(streams, streamID)
+			}
+		}
+		return nil
+	})
+	return streams, err
+}
+
+// checkFence returns redisstore.ErrLeaseLost if ctx carries a fencing token older than the stream's latest lease.
+func (s *Store) checkFence(ctx context.Context, t txn, streamID string) error {
+	token := redisstore.FenceToken(ctx)
+	if token == 0 {
+		return nil
+	}
+	v, _, _ := t.get(s.keys.Stream("stream_fence:", streamID))
+	if current, _ := strconv.ParseInt(string(v), 10, 64); current > token {
+		return redisstore.ErrLeaseLost
+	}
+	return nil
+}
+
+// CommitChunk atomically sets the chunk's bit and advances the stream progress to chunkIdx.
+func (s *Store) CommitChunk(ctx context.Context, streamID string, chunkIdx int) error {
+	return s.update(func(t txn) error {
+		if err := s.checkFence(ctx, t, streamID); err != nil {
+			return err
+		}
+		if err := t.setBit(s.keys.Stream("chunk_bitmap:", streamID), chunkIdx, true); err != nil {
+			return err
+		}
+		key := s.keys.Stream("stream_progress:", streamID)
+		v, _, ok := t.get(key)
+		if progress, err := strconv.Atoi(string(v)); ok && err == nil && progress >= chunkIdx {
+			return nil
+		}
+		return t.set(key, []byte(strconv.Itoa(chunkIdx)), time.Time{})
+	})
+}
+
+// CompleteStream atomically moves the stream from finalizing to completed and expires its status, chunk bitmap
+// and progress after ttl.
+func (s *Store) CompleteStream(ctx context.Context, streamID string, ttl time.Duration) error {
+	return s.update(func(t txn) error {
+		if err := s.checkFence(ctx, t, streamID); err != nil {
+			return err
+		}
+		if err := s.transition(t, streamID, redisstore.StateCompleted, "", t.expiry(ttl)); err != nil {
+			return err
+		}
+		if err := t.expire(s.keys.Stream("chunk_bitmap:", streamID), ttl); err != nil {
+			return err
+		}
+		return t.expire(s.keys.Stream("stream_progress:", streamID), ttl)
+	})
+}
+
+func (s *Store) SetReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) error {
+	return s.update(func(t txn) error {
+		key := s.keys.Replica(dest, streamID)
+		if err := t.setBit(key, chunkIdx, true); err != nil {
+			return err
+		}
+		return t.expire(key, replicaChunkTTL)
+	})
+}
+
+func (s *Store) IsReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) (bool, error) {
+	var uploaded bool
+	err := s.view(func(t txn) error {
+		uploaded = t.getBit(s.keys.Replica(dest, streamID), chunkIdx)
+		return nil
+	})
+	return uploaded, err
+}
+
+// PushBackfill queues an entry for a destination that missed an upload.
+func (s *Store) PushBackfill(ctx context.Context, dest, entry string) error {
+	return s.update(func(t txn) error {
+		key := s.keys.Name("replica_backfill:" + dest)
+		var entries []string
+		if v, _, ok := t.get(key); ok {
+			if err := json.Unmarshal(v, &entries); err != nil {
+				return err
+			}
+		}
+		v, err := json.Marshal(append(entries, entry))
+		if err != nil {
+			return err
+		}
+		return t.set(key, v, time.Time{})
+	})
+}
+
+// PopBackfill returns the oldest queued entry for dest, or "" if the queue is empty.
+func (s *Store) PopBackfill(ctx context.Context, dest string) (string, error) {
+	var entry string
+	err := s.update(func(t txn) error {
+		key := s.keys.Name("replica_backfill:" + dest)
+		v, _, ok := t.get(key)
+		if !ok {
+			return nil
+		}
+		var entries []string
+		if err := json.Unmarshal(v, &entries); err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return t.del(key)
+		}
+		entry = entries[0]
+		if len(entries) == 1 {
+			return t.del(key)
+		}
+		v, err := json.Marshal(entries[1:])
+		if err != nil {
+			return err
+		}
+		return t.set(key, v, time.Time{})
+	})
+	return entry, err
+}
+
+// AcquireLease gives owner exclusive ownership of the stream for ttl and returns its fencing token.
+func (s *Store) AcquireLease(ctx context.Context, streamID, owner string, ttl time.Duration) (int64, error) {
+	var token int64
+	err := s.update(func(t txn) error {
+		leaseKey := s.keys.Stream("stream_lease:", streamID)
+		if _, _, held := t.get(leaseKey); held {
+			return redisstore.ErrLeaseHeld
+		}
+		fenceKey := s.keys.Stream("stream_fence:", streamID)
+		v, _, _ := t.get(fenceKey)
+		current, _ := strconv.ParseInt(string(v), 10, 64)
+		token = current + 1
+		if err := t.set(fenceKey, []byte(strconv.FormatInt(token, 10)), t.expiry(fenceTTL)); err != nil {
+			return err
+		}
+		return t.set(leaseKey, []byte(owner+":"+strconv.FormatInt(token, 10)), t.expiry(ttl))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return token, nil
+}
+
+// RenewLease extends a lease held with token, or returns redisstore.ErrLeaseLost if it expired or was taken over.
+func (s *Store) RenewLease(ctx context.Context, streamID string, token int64, ttl time.Duration) error {
+	return s.update(func(t txn) error {
+		key := s.keys.Stream("stream_lease:", streamID)
+		v, _, ok := t.get(key)
+		if !ok || !strings.HasSuffix(string(v), ":"+strconv.FormatInt(token, 10)) {
+			return redisstore.ErrLeaseLost
+		}
+		return t.set(key, v, t.expiry(ttl))
+	})
+}
+
+// ReleaseLease gives up a lease held with token. Releasing a lease that was lost is not an error.
+func (s *Store) ReleaseLease(ctx context.Context, streamID string, token int64) error {
+	return s.update(func(t txn) error {
+		key := s.keys.Stream("stream_lease:", streamID)
+		if v, _, ok := t.get(key); ok && strings.HasSuffix(string(v), ":"+strconv.FormatInt(token, 10)) {
+			return t.del(key)
+		}
+		return nil
+	})
+}
+
+// GetValue returns the value of key, or redisstore.ErrNotFound if it does not exist.
+func (s *Store) GetValue(ctx context.Context, key string) (string, error) {
+	var value string
+	err := s.view(func(t txn) error {
+		v, _, ok := t.get(key)
+		if !ok {
+			return redisstore.ErrNotFound
+		}
+		value = string(v)
+		return nil
+	})
+	return value, err
+}
+
+func (s *Store) SetValue(ctx context.Context, key, value string, ttl time.Duration) error {
+	return s.update(func(t txn) error {
+		return t.set(key, []byte(value), t.expiry(ttl))
+	})
+}
+
+func (s *Store) SetValueNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	set := false
+	err := s.update(func(t txn) error {
+		if _, _, ok := t.get(key); ok {
+			return nil
+		}
+		set = true
+		return t.set(key, []byte(value), t.expiry(ttl))
+	})
+	return set && err == nil, err
+}
+
+func (s *Store) DeleteKey(ctx context.Context, key string) error {
+	return s.update(func(t txn) error {
+		return t.del(key)
+	})
+}
@@ -0,0 +1,206 @@
+package boltstore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/redisstore"
+
+	"go.uber.org/zap"
+)
+
+func openTestStore(t *testing.T) (*Store, *time.Time) {
+	t.Helper()
+	s, err := Open(&config.Config{BoltPath: filepath.Join(t.TempDir(), "checkpoints.db")}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	now := time.Date(2025, 5, 27, 12, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func TestChunksAndProgress(t *testing.T) {
+	s, _ := openTestStore(t)
+	ctx := context.Background()
+	for _, idx := range []int{0, 9, 3} {
+		if err := s.CommitChunk(ctx, "s1", idx); err != nil {
+			t.Fatalf("CommitChunk failed: %v", err)
+		}
+	}
+	if idx, _ := s.UploadedChunks(ctx, "s1"); len(idx) != 3 || idx[0] != 0 || idx[1] != 3 || idx[2] != 9 {
+		t.Errorf("unexpected uploaded chunks %v", idx)
+	}
+	if ok, _ := s.IsChunkUploaded(ctx, "s1", 3); !ok {
+		t.Error("chunk 3 should be uploaded")
+	}
+	if p, _ := s.GetStreamProgress(ctx, "s1"); p != 9 {
+		t.Errorf("progress should only move forward, got %d", p)
+	}
+	if _, err := s.GetStreamProgress(ctx, "missing"); err != redisstore.ErrNotFound {
+		t.Errorf("missing progress should return ErrNotFound, got %v", err)
+	}
+
+	s.SetReplicaChunkUploaded(ctx, "dr", "s1", 9)
+	s.SetReplicaChunkUploaded(ctx, "dr", "s10", 9)
+	if err := s.ClearChunks(ctx, "s1", 5); err != nil {
+		t.Fatalf("ClearChunks failed: %v", err)
+	}
+	if idx, _ := s.UploadedChunks(ctx, "s1"); len(idx) != 2 {
+		t.Errorf("chunks from 5 should be cleared, got %v", idx)
+	}
+	if ok, _ := s.IsReplicaChunkUploaded(ctx, "dr", "s1", 9); ok {
+		t.Error("replica checkpoint should be cleared")
+	}
+	if ok, _ := s.IsReplicaChunkUploaded(ctx, "dr", "s10", 9); !ok {
+		t.Error("replica checkpoint of another stream should be kept")
+	}
+}
+
+func TestExpiryAndSweep(t *testing.T) {
+	s, now := openTestStore(t)
+	ctx := context.Background()
+	s.CommitChunk(ctx, "s1", 0)
+	s.SetValue(ctx, "file_hash:s1", "abc", time.Hour)
+	if err := s.CompleteStream(ctx, "s1", 2*time.Hour); !errors.Is(err, redisstore.ErrInvalidTransition) {
+		t.Errorf("only a finalizing stream can be completed, got %v", err)
+	}
+	s.TransitionStream(ctx, "s1", redisstore.StateUploading, "")
+	s.TransitionStream(ctx, "s1", redisstore.StateFinalizing, "")
+	if err := s.CompleteStream(ctx, "s1", 2*time.Hour); err != nil {
+		t.Fatalf("CompleteStream failed: %v", err)
+	}
+	if st, _ := s.GetStreamStatus(ctx, "s1"); st != "completed" {
+		t.Errorf("status should be completed, got %q", st)
+	}
+
+	*now = now.Add(90 * time.Minute)
+	if _, err := s.GetValue(ctx, "file_hash:s1"); err != redisstore.ErrNotFound {
+		t.Errorf("expired key should be missing, got %v", err)
+	}
+	if idx, _ := s.UploadedChunks(ctx, "s1"); len(idx) != 1 {
+		t.Errorf("bitmap should still be live, got %v", idx)
+	}
+	if n, err := s.Sweep(); err != nil || n != 1 {
+		t.Errorf("expected 1 swept key, got %d (%v)", n, err)
+	}
+
+	*now = now.Add(time.Hour)
+	if n, _ := s.Sweep(); n != 3 {
+		t.Errorf("status, bitmap and progress should expire together, swept %d", n)
+	}
+}
+
+func TestScanIncompleteStreams(t *testing.T) {
+	s, _ := openTestStore(t)
+	ctx := context.Background()
+	s.TransitionStream(ctx, "a", redisstore.StateUploading, "")
+	s.TransitionStream(ctx, "b", redisstore.StateQueued, "")
+	s.TransitionStream(ctx, "b", redisstore.StateCancelled, "")
+	s.TransitionStream(ctx, "c", redisstore.StateUploading, "")
+	s.TransitionStream(ctx, "c", redisstore.StateOrphaned, "")
+	s.SetValue(ctx, "stream_source:a", "/videos/a.mp4", 0)
+	streams, err := s.ScanIncompleteStreams(ctx)
+	if err != nil || len(streams) != 1 || streams[0] != "a" {
+		t.Errorf("expected only a as incomplete, got %v (%v)", streams, err)
+	}
+}
+
+func TestStreamTransitions(t *testing.T) {
+	s, now := openTestStore(t)
+	ctx := context.Background()
+	if _, err := s.GetStreamInfo(ctx, "s1"); err != redisstore.ErrNotFound {
+		t.Errorf("stream without status should return ErrNotFound, got %v", err)
+	}
+	s.TransitionStream(ctx, "s1", redisstore.StateUploading, "")
+	if err := s.TransitionStream(ctx, "s1", redisstore.StateDetected, ""); !errors.Is(err, redisstore.ErrInvalidTransition) {
+		t.Errorf("uploading stream should not go back to detected, got %v", err)
+	}
+	s.TransitionStream(ctx, "s1", redisstore.StatePartial, "chunk 1 failed")
+	*now = now.Add(time.Minute)
+	s.TransitionStream(ctx, "s1", redisstore.StateUploading, "")
+	info, err := s.GetStreamInfo(ctx, "s1")
+	if err != nil || info.State != redisstore.StateUploading || info.Attempts != 2 || info.LastError != "chunk 1 failed" {
+		t.Errorf("unexpected stream info %+v (%v)", info, err)
+	}
+	if !info.UpdatedAt.Equal(*now) || !info.Transitions[redisstore.StatePartial].Equal(now.Add(-time.Minute)) {
+		t.Errorf("unexpected transition times %+v", info)
+	}
+	s.TransitionStream(ctx, "s1", redisstore.StateCancelled, "")
+	if err := s.TransitionStream(ctx, "s1", redisstore.StateQueued, ""); !errors.Is(err, redisstore.ErrInvalidTransition) {
+		t.Errorf("cancelled stream should only be left through a reset, got %v", err)
+	}
+	if err := s.ResetStream(ctx, "s1"); err != nil {
+		t.Fatalf("ResetStream failed: %v", err)
+	}
+	if err := s.ResetStream(ctx, "s1"); !errors.Is(err, redisstore.ErrInvalidTransition) {
+		t.Errorf("only cancelled streams can be reset, got %v", err)
+	}
+	s.SetStreamChunkSize(ctx, "s1", 376)
+	if info, _ := s.GetStreamInfo(ctx, "s1"); info.ChunkSize != 376 || info.State != redisstore.StateDetected {
+		t.Errorf("chunk size should be recorded next to the state, got %+v", info)
+	}
+	keyTime := time.Date(2026, 3, 1, 23, 0, 0, 0, time.UTC)
+	s.SetStreamKeyTime(ctx, "s1", keyTime)
+	if info, _ := s.GetStreamInfo(ctx, "s1"); !info.KeyTime.Equal(keyTime) || info.ChunkSize != 376 {
+		t.Errorf("key time should be recorded next to the chunk size, got %+v", info)
+	}
+}
+
+func TestLeasesAndFencing(t *testing.T) {
+	s, now := openTestStore(t)
+	ctx := context.Background()
+	token, err := s.AcquireLease(ctx, "s1", "a", time.Minute)
+	if err != nil || token != 1 {
+		t.Fatalf("expected token 1, got %d (%v)", token, err)
+	}
+	if _, err := s.AcquireLease(ctx, "s1", "b", time.Minute); err != redisstore.ErrLeaseHeld {
+		t.Errorf("expected ErrLeaseHeld, got %v", err)
+	}
+	if err := s.RenewLease(ctx, "s1", token, time.Minute); err != nil {
+		t.Errorf("RenewLease failed: %v", err)
+	}
+
+	// The owner stops renewing and another instance takes over
+	*now = now.Add(2 * time.Minute)
+	if err := s.RenewLease(ctx, "s1", token, time.Minute); err != redisstore.ErrLeaseLost {
+		t.Errorf("expected ErrLeaseLost, got %v", err)
+	}
+	newToken, err := s.AcquireLease(ctx, "s1", "b", time.Minute)
+	if err != nil || newToken != 2 {
+		t.Fatalf("expected token 2, got %d (%v)", newToken, err)
+	}
+	if err := s.CommitChunk(redisstore.WithFenceToken(ctx, token), "s1", 0); err != redisstore.ErrLeaseLost {
+		t.Errorf("stale owner should be fenced, got %v", err)
+	}
+	if err := s.TransitionStream(redisstore.WithFenceToken(ctx, token), "s1", redisstore.StatePartial, ""); err != redisstore.ErrLeaseLost {
+		t.Errorf("stale owner's transition should be fenced, got %v", err)
+	}
+	if err := s.CommitChunk(redisstore.WithFenceToken(ctx, newToken), "s1", 0); err != nil {
+		t.Errorf("current owner should be allowed, got %v", err)
+	}
+	s.ReleaseLease(ctx, "s1", token)
+	if _, err := s.AcquireLease(ctx, "s1", "c", time.Minute); err != redisstore.ErrLeaseHeld {
+		t.Error("a stale token must not release the current lease")
+	}
+	s.ReleaseLease(ctx, "s1", newToken)
+	if _, err := s.AcquireLease(ctx, "s1", "c", time.Minute); err != nil {
+		t.Errorf("released lease should be free, got %v", err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	s, _ := openTestStore(t)
+	ctx := context.Background()
+	s.PushBackfill(ctx, "dr", "first")
+	s.PushBackfill(ctx, "dr", "second")
+	for _, want := range []string{"first", "second", ""} {
+		if got, err := s.PopBackfill(ctx, "dr"); err != nil || got != want {
+			t.Errorf("expected %q, got %q (%v)", want, got, err)
+		}
+	}
+}
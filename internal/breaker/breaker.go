@@ -0,0 +1,241 @@
+// Package breaker implements a circuit breaker for the processor's external dependencies
+// (object storage and Redis).
+//
+// A Breaker starts closed. After a configurable number of consecutive failures it opens:
+// calls are rejected with ErrOpen and Wait blocks, which pauses file intake. While open, Run
+// probes the dependency periodically; when a probe succeeds the breaker becomes half-open and
+// intake resumes, but only a single trial call reaches the dependency while the others wait for
+// its outcome. A successful trial closes the breaker, a failed one opens it again.
+// The state of every breaker is exported as the vsp_circuit_breaker_state gauge.
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"video-stream-processor/internal/metrics"
+
+	"go.uber.org/zap"
+)
+
+// ErrOpen is returned for calls rejected while the breaker is open.
+var ErrOpen = errors.New("circuit breaker open")
+
+// State is the breaker state. Its numeric value is exported as the gauge value.
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Breaker guards a single dependency. It is safe for concurrent use.
+type Breaker struct {
+	name          string
+	threshold     int
+	probeInterval time.Duration
+	probe         func(ctx context.Context) error
+	log           *zap.Logger
+
+	mu       sync.Mutex
+	state    State
+	failures int
+	ready    chan struct{} // closed whenever the breaker is not open
+	trial    bool          // a half-open trial call is in flight
+	trialAt  time.Time     // when the trial call was admitted
+	settled  chan struct{} // closed when the trial call's outcome is known or it is abandoned
+}
+
+// New returns a closed Breaker that opens after threshold consecutive failures and,
+// while open, calls probe every probeInterval.
+func New(name string, threshold int, probeInterval time.Duration, probe func(ctx context.Context) error, log *zap.Logger) *Breaker {
+	if probeInterval <= 0 {
+		probeInterval = time.Second
+	}
+	b := &Breaker{
+		name:          name,
+		threshold:     threshold,
+		probeInterval: probeInterval,
+		probe:         probe,
+		log:           log,
+		ready:         make(chan struct{}),
+	}
+	close(b.ready)
+	metrics.CircuitBreakerState.WithLabelValues(name).Set(float64(Closed))
+	return b
+}
+
+// Name returns the name the breaker was created with.
+func (b *Breaker) Name() string {
+	return b.name
+}
+
+// State returns the current state.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Allow returns ErrOpen if calls are currently rejected. While half-open it admits a single trial
+// call and blocks the others until the trial's outcome is recorded, then admits them if it closed the
+// breaker. It returns ctx.Err() if ctx is cancelled while waiting.
+func (b *Breaker) Allow(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		switch {
+		case b.state == Closed:
+			b.mu.Unlock()
+			return nil
+		case b.state == Open:
+			b.mu.Unlock()
+			return ErrOpen
+		case !b.trial:
+			b.trial, b.trialAt, b.settled = true, time.Now(), make(chan struct{})
+			b.mu.Unlock()
+			return nil
+		}
+		settled := b.settled
+		b.mu.Unlock()
+		select {
+		case <-settled:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Do runs fn unless the breaker rejects it (see Allow) and records its outcome.
+func (b *Breaker) Do(ctx context.Context, fn func() error) error {
+	if err := b.Allow(ctx); err != nil {
+		return err
+	}
+	err := fn()
+	b.Record(err)
+	return err
+}
+
+// Record updates the breaker with the outcome of a call. Context cancellation is not a failure, and a
+// trial call that is cancelled is abandoned by Run after one probe interval.
+func (b *Breaker) Record(err error) {
+	if err == nil {
+		b.success()
+		return
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrOpen) {
+		return
+	}
+	b.failure()
+}
+
+func (b *Breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if b.state == HalfOpen {
+		b.setState(Closed)
+	}
+}
+
+func (b *Breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == HalfOpen || (b.state == Closed && b.failures >= b.threshold) {
+		b.setState(Open)
+	}
+}
+
+// setState must be called with b.mu held.
+func (b *Breaker) setState(s State) {
+	if b.state == s {
+		return
+	}
+	if s == Open {
+		b.ready = make(chan struct{})
+	} else if b.state == Open {
+		close(b.ready)
+	}
+	if b.state == HalfOpen {
+		b.endTrial()
+	}
+	b.log.Warn("Circuit breaker state changed", zap.String("breaker", b.name), zap.Stringer("from", b.state), zap.Stringer("to", s))
+	b.state = s
+	metrics.CircuitBreakerState.WithLabelValues(b.name).Set(float64(s))
+}
+
+// endTrial wakes the calls waiting for the half-open trial. It must be called with b.mu held.
+func (b *Breaker) endTrial() {
+	if b.trial {
+		close(b.settled)
+		b.trial = false
+	}
+}
+
+// Wait blocks while the breaker is open. It returns ctx.Err() if ctx is cancelled first.
+func (b *Breaker) Wait(ctx context.Context) error {
+	b.mu.Lock()
+	ready := b.ready
+	b.mu.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run probes the dependency every probe interval while the breaker is open, until ctx is cancelled.
+// A half-open trial call whose outcome is not recorded within a probe interval, e.g. because it was
+// cancelled, is abandoned so another call can take its place.
+func (b *Breaker) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.mu.Lock()
+			state := b.state
+			if state == HalfOpen && b.trial && time.Since(b.trialAt) >= b.probeInterval {
+				b.endTrial()
+			}
+			b.mu.Unlock()
+			if state != Open {
+				continue
+			}
+			if err := b.probe(ctx); err != nil {
+				b.log.Debug("Circuit breaker probe failed", zap.String("breaker", b.name), zap.Error(err))
+				continue
+			}
+			b.mu.Lock()
+			if b.state == Open {
+				b.setState(HalfOpen)
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// WaitAll blocks until none of the breakers is open.
+func WaitAll(ctx context.Context, breakers ...*Breaker) error {
+	for _, b := range breakers {
+		if err := b.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
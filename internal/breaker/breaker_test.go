@@ -0,0 +1,157 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errDown = errors.New("down")
+
+func TestBreaker_OpensAfterThreshold(t *testing.T) {
+	b := New("test", 3, time.Hour, nil, zap.NewNop())
+	for i := 0; i < 2; i++ {
+		b.Do(context.Background(), func() error { return errDown })
+	}
+	if b.State() != Closed {
+		t.Fatal("breaker should stay closed below the threshold")
+	}
+	b.Do(context.Background(), func() error { return nil })
+	b.Do(context.Background(), func() error { return errDown })
+	b.Do(context.Background(), func() error { return errDown })
+	if b.State() != Closed {
+		t.Fatal("a success should reset the consecutive failure count")
+	}
+	b.Do(context.Background(), func() error { return errDown })
+	if b.State() != Open {
+		t.Fatal("breaker should open after 3 consecutive failures")
+	}
+	called := false
+	if err := b.Do(context.Background(), func() error { called = true; return nil }); !errors.Is(err, ErrOpen) || called {
+		t.Errorf("open breaker should reject calls, got %v (called=%v)", err, called)
+	}
+}
+
+func TestBreaker_IgnoresCancellation(t *testing.T) {
+	b := New("test", 1, time.Hour, nil, zap.NewNop())
+	b.Record(context.Canceled)
+	if b.State() != Closed {
+		t.Error("context cancellation should not open the breaker")
+	}
+}
+
+func TestBreaker_ProbeAndRecover(t *testing.T) {
+	healthy := make(chan bool, 1)
+	healthy <- false
+	probe := func(ctx context.Context) error {
+		select {
+		case ok := <-healthy:
+			if ok {
+				return nil
+			}
+		default:
+		}
+		return errDown
+	}
+	b := New("test", 1, 10*time.Millisecond, probe, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	b.Record(errDown)
+	waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	if err := b.Wait(waitCtx); err == nil {
+		t.Fatal("Wait should block while the breaker is open")
+	}
+	waitCancel()
+
+	healthy <- true
+	waitCtx, waitCancel = context.WithTimeout(ctx, time.Second)
+	defer waitCancel()
+	if err := WaitAll(waitCtx, b); err != nil {
+		t.Fatalf("breaker did not recover after a successful probe: %v", err)
+	}
+	if b.State() != HalfOpen {
+		t.Fatalf("expected half-open after probe, got %v", b.State())
+	}
+	b.Record(errDown)
+	if b.State() != Open {
+		t.Fatal("a failure in half-open should reopen the breaker")
+	}
+	b.mu.Lock()
+	b.setState(HalfOpen)
+	b.mu.Unlock()
+	b.Record(nil)
+	if b.State() != Closed {
+		t.Fatal("a success in half-open should close the breaker")
+	}
+}
+
+func TestBreaker_HalfOpenAdmitsSingleTrial(t *testing.T) {
+	b := New("test", 1, time.Hour, nil, zap.NewNop())
+	b.Record(errDown)
+	b.mu.Lock()
+	b.setState(HalfOpen)
+	b.mu.Unlock()
+
+	ctx := context.Background()
+	if err := b.Allow(ctx); err != nil {
+		t.Fatalf("the first call in half-open should be admitted as the trial, got %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := b.Allow(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("other calls should wait for the trial, got %v", err)
+	}
+
+	admitted := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { admitted <- b.Allow(ctx) }()
+	}
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-admitted:
+		t.Fatalf("a call got through before the trial finished: %v", err)
+	default:
+	}
+	b.Record(nil)
+	for i := 0; i < 2; i++ {
+		if err := <-admitted; err != nil {
+			t.Errorf("waiting calls should be admitted once the trial closes the breaker, got %v", err)
+		}
+	}
+
+	// A failed trial reopens the breaker and rejects the waiting calls
+	b.Record(errDown)
+	b.mu.Lock()
+	b.setState(HalfOpen)
+	b.mu.Unlock()
+	b.Allow(ctx)
+	go func() { admitted <- b.Allow(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	b.Record(errDown)
+	if err := <-admitted; !errors.Is(err, ErrOpen) {
+		t.Errorf("waiting calls should be rejected once the trial fails, got %v", err)
+	}
+}
+
+func TestBreaker_AbandonedTrial(t *testing.T) {
+	b := New("test", 1, 10*time.Millisecond, func(ctx context.Context) error { return errDown }, zap.NewNop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.Record(errDown)
+	b.mu.Lock()
+	b.setState(HalfOpen)
+	b.mu.Unlock()
+	b.Allow(ctx)
+	b.Record(context.Canceled)
+	go b.Run(ctx)
+	waitCtx, waitCancel := context.WithTimeout(ctx, time.Second)
+	defer waitCancel()
+	if err := b.Allow(waitCtx); err != nil {
+		t.Errorf("a cancelled trial should be replaced after a probe interval, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 // Package chunker provides logic for splitting files into binary chunks for upload and processing.
 // Note: Chunks are not guaranteed to be independently playable video segments. For real-time streaming,
 // use a tool like ffmpeg to split video into proper segments (e.g., HLS/DASH).
+// MPEG transport streams are the exception: their chunks end on packet boundaries, see ForContainer.
 package chunker
 
 import (
@@ -11,6 +12,7 @@ import (
 	"io"
 	"os"
 	"time"
+	"video-stream-processor/internal/container"
 )
 
 type Chunk struct {
@@ -30,6 +32,38 @@ func New() Chunker {
 	return &fileChunker{}
 }
 
+// ForContainer returns the chunker for files of the given container format. Transport streams
+// are split on 188-byte packet boundaries; every other format is split at fixed byte offsets.
+func ForContainer(format container.Format) Chunker {
+	if format == container.MPEGTS {
+		return &tsChunker{}
+	}
+	return New()
+}
+
+// ChunkSize returns the size of the chunks ForContainer(format) splits a file into when asked for chunkSize.
+// Checkpoints are only valid for chunks of the size they were written with.
+func ChunkSize(format container.Format, chunkSize int) int {
+	if format != container.MPEGTS {
+		return chunkSize
+	}
+	aligned := chunkSize - chunkSize%container.TSPacketSize
+	if aligned < container.TSPacketSize {
+		aligned = container.TSPacketSize
+	}
+	return aligned
+}
+
+// tsChunker rounds the chunk size down to a whole number of transport stream packets, so no
+// packet is split between two chunks.
+type tsChunker struct {
+	fileChunker
+}
+
+func (c *tsChunker) ChunkFile(ctx context.Context, filePath string, chunkSize int) (<-chan Chunk, error) {
+	return c.fileChunker.ChunkFile(ctx, filePath, ChunkSize(container.MPEGTS, chunkSize))
+}
+
 func (c *fileChunker) ChunkFile(ctx context.Context, filePath string, chunkSize int) (<-chan Chunk, error) {
 	out := make(chan Chunk)
 	f, err := os.Open(filePath)
@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"testing"
+	"video-stream-processor/internal/container"
 )
 
 // TestChunker_SmallFile verifies that a small file is split into the correct number of non-empty chunks.
@@ -40,3 +41,33 @@ func TestChunker_SmallFile(t *testing.T) {
 		}
 	}
 }
+
+// TestForContainer_TS verifies that transport streams are split on packet boundaries.
+func TestForContainer_TS(t *testing.T) {
+	f, err := os.CreateTemp("", "testfile-*.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	data := make([]byte, 5*container.TSPacketSize)
+	for i := 0; i < len(data); i += container.TSPacketSize {
+		data[i] = container.TSSyncByte
+	}
+	f.Write(data)
+	f.Close()
+
+	if ChunkSize(container.MPEGTS, 500) != 376 || ChunkSize(container.MPEGTS, 100) != 188 || ChunkSize(container.MP4, 500) != 500 {
+		t.Error("ChunkSize should report the packet-aligned size for transport streams only")
+	}
+	for _, size := range []int{500, 100} {
+		chunks, err := ForContainer(container.MPEGTS).ChunkFile(context.Background(), f.Name(), size)
+		if err != nil {
+			t.Fatalf("ChunkFile error: %v", err)
+		}
+		for chunk := range chunks {
+			if len(chunk.Data)%container.TSPacketSize != 0 || chunk.Data[0] != container.TSSyncByte {
+				t.Errorf("chunk size %d: chunk %d is not packet aligned (%d bytes)", size, chunk.Index, len(chunk.Data))
+			}
+		}
+	}
+}
@@ -6,27 +6,104 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"video-stream-processor/internal/objectkey"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	RedisAddr          string
-	RedisPassword      string
-	RedisDB            int
-	MinioEndpoint      string
-	MinioAccessKey     string
-	MinioSecretKey     string
-	MinioBucket        string
-	MinioUseSSL        bool
-	WatchDir           string
-	ChunkSize          int
-	StabilityThreshold int
-	StreamTimeout      int
-	PrometheusPort     string
-	LogLevel           string
-	WorkerCount        int      // Number of parallel file processing workers
-	VideoFileFormats   []string // Supported video file formats
+	RedisAddr            string // Redis address; comma separated seed nodes in cluster mode
+	RedisUsername        string // ACL username, empty for password-only auth
+	RedisPassword        string
+	RedisDB              int
+	RedisMode            string   // standalone, sentinel or cluster
+	RedisKeyPrefix       string   // Namespace prepended to every Redis key, e.g. "tenant-a:"
+	RedisSentinelMaster  string   // Master name monitored by Sentinel
+	RedisSentinelAddrs   []string // Sentinel addresses
+	RedisSentinelPass    string   // Password of the Sentinels themselves, if they require one
+	RedisTLS             bool     // Connect to Redis (and Sentinel) over TLS
+	RedisTLSCAFile       string   // PEM CA bundle used to verify the server, system roots if empty
+	RedisTLSCertFile     string   // PEM client certificate for mutual TLS
+	RedisTLSKeyFile      string   // PEM client key for mutual TLS
+	RedisTLSServerName   string   // Server name to verify, if it differs from the address
+	CheckpointStore      string   // Where checkpoints are kept: redis or bolt (embedded database file)
+	BoltPath             string   // Database file of the bolt checkpoint store
+	BoltSweepInterval    int      // Seconds between deletions of expired keys in the bolt checkpoint store
+	MinioEndpoint        string
+	MinioAccessKey       string
+	MinioSecretKey       string
+	MinioBucket          string
+	MinioUseSSL          bool
+	ChunkKeyTemplate     string            // Object key template for chunks, see package objectkey
+	MetadataKeyTemplate  string            // Object key template for metadata.json
+	CurrentKeyTemplate   string            // Object key template for the version pointer of versioned streams
+	StreamVersions       int               // Upload each run under a new {version} and keep the last N, 0 overwrites in place
+	ObjectTags           map[string]string // S3 object tags applied to every uploaded object
+	ChunkStorageClass    string            // Optional storage class for chunk objects
+	MetadataStorageClass string            // Optional storage class for metadata objects
+	SSEMode              string            // Server-side encryption: none, sse-s3, sse-kms or sse-c
+	SSEKMSKeyID          string            // KMS key ID used with sse-kms
+	SSECKeyFile          string            // File holding the 32-byte customer key used with sse-c
+	BucketCreate         bool              // Create MinioBucket at startup if it does not exist
+	BucketVersioning     bool              // Enable bucket versioning at startup
+	BucketObjectLock     bool              // Enable object lock when creating the bucket
+	ObjectLockMode       string            // Default retention mode (GOVERNANCE or COMPLIANCE), used with ObjectLockDays
+	ObjectLockDays       int               // Default retention in days, 0 disables default retention
+	ChunkExpiryDays      int               // Lifecycle rule: expire chunk objects after N days, 0 disables
+	AbortUploadDays      int               // Lifecycle rule: abort incomplete multipart uploads after N days, 0 disables
+	Replicas             []ReplicaConfig   // Additional storage destinations every stream is copied to
+	ReplicationMode      string            // "all" (every destination must succeed) or "quorum"
+	ReplicationQuorum    int               // Destinations that must succeed in quorum mode, 0 means a majority
+	BackfillInterval     int               // Seconds between backfill runs for destinations that missed uploads
+	UploadRateLimit      int64             // Upload cap in bytes/sec shared by all workers, 0 means unlimited
+	UploadRateSchedule   string            // Time-of-day overrides, e.g. "08:00-18:00=1048576,18:00-08:00=0"
+	BreakerThreshold     int               // Consecutive failures that open a circuit breaker, 0 disables breakers
+	BreakerProbeInterval int               // Seconds between probes while a breaker is open
+	PresignMode          string            // Presigned URLs: off, object, http or both
+	PresignExpiry        int               // Lifetime of presigned URLs in seconds
+	ManifestAddr         string            // Listen address of the /streams/ manifest endpoint, separate from the metrics port
+	ManifestToken        string            // Bearer token the manifest endpoint requires
+	GCMode               string            // Orphaned chunk collection after a stream completes: off, dry-run or delete
+	LeaseTTL             int               // Seconds a stream lease lasts without renewal, 0 disables leases
+	InstanceID           string            // Lease owner name of this instance
+	QueueBackend         string            // Work queue between watcher and workers: channel or redis
+	QueueStream          string            // Redis stream holding queued files
+	QueueGroup           string            // Redis consumer group shared by all instances
+	QueueClaimIdle       int               // Seconds a job may stay unacknowledged before another consumer claims it, 0 disables claiming
+	StreamIDStrategy     string            // How files map to stream IDs: basename, path (relative to WatchDir), hash or uuid
+	StreamIDNamespace    string            // Prepended to stream IDs; set to "<profile>/" by ForProfile when profiles are configured
+	WatchDir             string
+	ProfilesFile         string   // YAML or JSON file listing watch profiles, see Profile; WatchDir alone is watched if empty
+	WatchRecursive       bool     // Watch subdirectories of WatchDir, including ones created later
+	WatchMaxDepth        int      // Deepest subdirectory level watched when recursive (1 = direct subdirectories), 0 means unlimited
+	WatchInclude         []string // Glob patterns a file must match one of; patterns with a "/" match the path relative to WatchDir, others the file name
+	WatchExclude         []string // Glob patterns of files to ignore, e.g. "*.part" or "*_preview.mp4"
+	WatchSkipHidden      bool     // Ignore dot files and files in dot directories
+	WatchMinSize         int64    // Ignore files smaller than this many bytes when they become stable
+	WatchMaxSize         int64    // Ignore files larger than this many bytes, 0 means unlimited
+	WatchMinAge          int      // Wait until files were last modified at least this many seconds ago
+	WatchMaxAge          int      // Ignore files modified more than this many seconds ago, 0 means unlimited
+	WatchReadiness       string   // When a file is complete: stable (unchanged for StabilityThreshold), marker or rename
+	WatchMarkerSuffix    string   // Suffix of the sidecar marker of the marker strategy, e.g. ".done" for "clip.mp4.done"
+	ContainerCheck       string   // Content sniffing in the watcher: off, route (process mislabeled files by content) or reject
+	ChunkSize            int
+	StabilityThreshold   int
+	StreamTimeout        int
+	PrometheusPort       string
+	LogLevel             string
+	WorkerCount          int      // Number of parallel file processing workers
+	VideoFileFormats     []string // Supported video file formats
+}
+
+// ReplicaConfig describes a secondary S3-compatible destination, configured with
+// REPLICA_<NAME>_ENDPOINT, _ACCESS_KEY, _SECRET_KEY, _BUCKET and _USE_SSL for each name in REPLICA_DESTINATIONS.
+type ReplicaConfig struct {
+	Name      string
+	Endpoint  string
+	AccessKey string
+	SecretKey string
+	Bucket    string
+	UseSSL    bool
 }
 
 func Load() *Config {
@@ -38,40 +115,184 @@ func Load() *Config {
 	streamTimeout, _ := strconv.Atoi(getEnv("STREAM_TIMEOUT", "30"))
 	minioUseSSL := getEnv("MINIO_USE_SSL", "false") == "true"
 	workerCount, _ := strconv.Atoi(getEnv("WORKER_COUNT", "4"))
-	formats := getEnv("VIDEO_FILE_FORMATS", ".mp4,.mkv")
-	var videoFileFormats []string
-	for _, f := range strings.Split(formats, ",") {
+	objectLockDays, _ := strconv.Atoi(getEnv("OBJECT_LOCK_DAYS", "0"))
+	chunkExpiryDays, _ := strconv.Atoi(getEnv("CHUNK_EXPIRY_DAYS", "0"))
+	abortUploadDays, _ := strconv.Atoi(getEnv("ABORT_INCOMPLETE_UPLOAD_DAYS", "0"))
+	replicationQuorum, _ := strconv.Atoi(getEnv("REPLICATION_QUORUM", "0"))
+	backfillInterval, _ := strconv.Atoi(getEnv("REPLICATION_BACKFILL_INTERVAL", "60"))
+	bucket := getEnv("MINIO_BUCKET", "video-streams")
+	uploadRateLimit, _ := strconv.ParseInt(getEnv("UPLOAD_RATE_LIMIT", "0"), 10, 64)
+	breakerThreshold, _ := strconv.Atoi(getEnv("BREAKER_FAILURE_THRESHOLD", "0"))
+	breakerProbeInterval, _ := strconv.Atoi(getEnv("BREAKER_PROBE_INTERVAL", "10"))
+	presignExpiry, _ := strconv.Atoi(getEnv("PRESIGN_EXPIRY", "3600"))
+	streamVersions, _ := strconv.Atoi(getEnv("STREAM_VERSIONS", "0"))
+	leaseTTL, _ := strconv.Atoi(getEnv("LEASE_TTL", "30"))
+	queueClaimIdle, _ := strconv.Atoi(getEnv("QUEUE_CLAIM_IDLE", "600"))
+	boltSweepInterval, _ := strconv.Atoi(getEnv("BOLT_SWEEP_INTERVAL", "60"))
+	watchRecursive := getEnv("WATCH_RECURSIVE", "false") == "true"
+	watchMaxDepth, _ := strconv.Atoi(getEnv("WATCH_MAX_DEPTH", "0"))
+	watchMinSize, _ := strconv.ParseInt(getEnv("WATCH_MIN_SIZE", "0"), 10, 64)
+	watchMaxSize, _ := strconv.ParseInt(getEnv("WATCH_MAX_SIZE", "0"), 10, 64)
+	watchMinAge, _ := strconv.Atoi(getEnv("WATCH_MIN_AGE", "0"))
+	watchMaxAge, _ := strconv.Atoi(getEnv("WATCH_MAX_AGE", "0"))
+	// Files in different subdirectories often share a name, so recursive watching keys streams by relative path
+	defaultStrategy := "basename"
+	if watchRecursive {
+		defaultStrategy = "path"
+	}
+	hostname, _ := os.Hostname()
+	chunkTemplate, metadataTemplate := objectkey.DefaultChunkTemplate, objectkey.DefaultMetadataTemplate
+	if streamVersions > 0 {
+		chunkTemplate, metadataTemplate = objectkey.VersionedChunkTemplate, objectkey.VersionedMetadataTemplate
+	}
+	videoFileFormats := normalizeFormats(strings.Split(getEnv("VIDEO_FILE_FORMATS", ".mp4,.mkv"), ","))
+	return &Config{
+		RedisAddr:            getEnv("REDIS_ADDR", "localhost:6379"),
+		RedisUsername:        getEnv("REDIS_USERNAME", ""),
+		RedisPassword:        getEnv("REDIS_PASSWORD", ""),
+		RedisDB:              redisDB,
+		RedisMode:            strings.ToLower(getEnv("REDIS_MODE", "standalone")),
+		RedisKeyPrefix:       getEnv("REDIS_KEY_PREFIX", ""),
+		RedisSentinelMaster:  getEnv("REDIS_SENTINEL_MASTER", ""),
+		RedisSentinelAddrs:   splitList(getEnv("REDIS_SENTINEL_ADDRS", "")),
+		RedisSentinelPass:    getEnv("REDIS_SENTINEL_PASSWORD", ""),
+		RedisTLS:             getEnv("REDIS_TLS", "false") == "true",
+		RedisTLSCAFile:       getEnv("REDIS_TLS_CA_FILE", ""),
+		RedisTLSCertFile:     getEnv("REDIS_TLS_CERT_FILE", ""),
+		RedisTLSKeyFile:      getEnv("REDIS_TLS_KEY_FILE", ""),
+		RedisTLSServerName:   getEnv("REDIS_TLS_SERVER_NAME", ""),
+		CheckpointStore:      strings.ToLower(getEnv("CHECKPOINT_STORE", "redis")),
+		BoltPath:             getEnv("BOLT_PATH", "./checkpoints.db"),
+		BoltSweepInterval:    boltSweepInterval,
+		MinioEndpoint:        getEnv("MINIO_ENDPOINT", "localhost:9000"),
+		MinioAccessKey:       getEnv("MINIO_ACCESS_KEY", "minioadmin"),
+		MinioSecretKey:       getEnv("MINIO_SECRET_KEY", "minioadmin"),
+		MinioBucket:          bucket,
+		MinioUseSSL:          minioUseSSL,
+		ChunkKeyTemplate:     getEnv("CHUNK_KEY_TEMPLATE", chunkTemplate),
+		MetadataKeyTemplate:  getEnv("METADATA_KEY_TEMPLATE", metadataTemplate),
+		CurrentKeyTemplate:   getEnv("CURRENT_KEY_TEMPLATE", objectkey.DefaultCurrentTemplate),
+		StreamVersions:       streamVersions,
+		ObjectTags:           parseKeyValues(getEnv("OBJECT_TAGS", "")),
+		ChunkStorageClass:    getEnv("CHUNK_STORAGE_CLASS", ""),
+		MetadataStorageClass: getEnv("METADATA_STORAGE_CLASS", ""),
+		SSEMode:              strings.ToLower(getEnv("SSE_MODE", "none")),
+		SSEKMSKeyID:          getEnv("SSE_KMS_KEY_ID", ""),
+		SSECKeyFile:          getEnv("SSE_C_KEY_FILE", ""),
+		BucketCreate:         getEnv("BUCKET_CREATE", "true") == "true",
+		BucketVersioning:     getEnv("BUCKET_VERSIONING", "false") == "true",
+		BucketObjectLock:     getEnv("BUCKET_OBJECT_LOCK", "false") == "true",
+		ObjectLockMode:       strings.ToUpper(getEnv("OBJECT_LOCK_MODE", "GOVERNANCE")),
+		ObjectLockDays:       objectLockDays,
+		ChunkExpiryDays:      chunkExpiryDays,
+		AbortUploadDays:      abortUploadDays,
+		Replicas:             loadReplicas(getEnv("REPLICA_DESTINATIONS", ""), bucket),
+		ReplicationMode:      strings.ToLower(getEnv("REPLICATION_MODE", "all")),
+		ReplicationQuorum:    replicationQuorum,
+		BackfillInterval:     backfillInterval,
+		UploadRateLimit:      uploadRateLimit,
+		UploadRateSchedule:   getEnv("UPLOAD_RATE_SCHEDULE", ""),
+		BreakerThreshold:     breakerThreshold,
+		BreakerProbeInterval: breakerProbeInterval,
+		PresignMode:          strings.ToLower(getEnv("PRESIGN_MODE", "off")),
+		PresignExpiry:        presignExpiry,
+		ManifestAddr:         getEnv("MANIFEST_ADDR", ":8090"),
+		ManifestToken:        getEnv("MANIFEST_TOKEN", ""),
+		GCMode:               strings.ToLower(getEnv("GC_MODE", "off")),
+		LeaseTTL:             leaseTTL,
+		InstanceID:           getEnv("INSTANCE_ID", hostname+"-"+strconv.Itoa(os.Getpid())),
+		QueueBackend:         strings.ToLower(getEnv("QUEUE_BACKEND", "channel")),
+		QueueStream:          getEnv("QUEUE_STREAM", "vsp:files"),
+		QueueGroup:           getEnv("QUEUE_GROUP", "vsp-workers"),
+		QueueClaimIdle:       queueClaimIdle,
+		StreamIDStrategy:     strings.ToLower(getEnv("STREAM_ID_STRATEGY", defaultStrategy)),
+		WatchDir:             getEnv("WATCH_DIR", "./input_files"),
+		ProfilesFile:         getEnv("WATCH_PROFILES_FILE", ""),
+		WatchRecursive:       watchRecursive,
+		WatchMaxDepth:        watchMaxDepth,
+		WatchInclude:         splitList(getEnv("WATCH_INCLUDE", "")),
+		WatchExclude:         splitList(getEnv("WATCH_EXCLUDE", "")),
+		WatchSkipHidden:      getEnv("WATCH_SKIP_HIDDEN", "true") == "true",
+		WatchMinSize:         watchMinSize,
+		WatchMaxSize:         watchMaxSize,
+		WatchMinAge:          watchMinAge,
+		WatchMaxAge:          watchMaxAge,
+		WatchReadiness:       strings.ToLower(getEnv("WATCH_READINESS", "stable")),
+		WatchMarkerSuffix:    getEnv("WATCH_MARKER_SUFFIX", ".done"),
+		ContainerCheck:       strings.ToLower(getEnv("CONTAINER_CHECK", "route")),
+		ChunkSize:            chunkSize,
+		StabilityThreshold:   stabilityThreshold,
+		StreamTimeout:        streamTimeout,
+		PrometheusPort:       getEnv("PROMETHEUS_PORT", "2112"),
+		LogLevel:             getEnv("LOG_LEVEL", "info"),
+		WorkerCount:          workerCount,
+		VideoFileFormats:     videoFileFormats,
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// loadReplicas reads the settings of each destination named in the comma separated list.
+func loadReplicas(names, defaultBucket string) []ReplicaConfig {
+	var replicas []ReplicaConfig
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		prefix := "REPLICA_" + strings.ToUpper(name) + "_"
+		replicas = append(replicas, ReplicaConfig{
+			Name:      name,
+			Endpoint:  getEnv(prefix+"ENDPOINT", ""),
+			AccessKey: getEnv(prefix+"ACCESS_KEY", ""),
+			SecretKey: getEnv(prefix+"SECRET_KEY", ""),
+			Bucket:    getEnv(prefix+"BUCKET", defaultBucket),
+			UseSSL:    getEnv(prefix+"USE_SSL", "false") == "true",
+		})
+	}
+	return replicas
+}
+
+// normalizeFormats lowercases file extensions and adds the leading dot where missing, dropping empty entries.
+func normalizeFormats(formats []string) []string {
+	var exts []string
+	for _, f := range formats {
 		f = strings.TrimSpace(f)
 		if f != "" {
 			if !strings.HasPrefix(f, ".") {
 				f = "." + f
 			}
-			videoFileFormats = append(videoFileFormats, strings.ToLower(f))
+			exts = append(exts, strings.ToLower(f))
 		}
 	}
-	return &Config{
-		RedisAddr:          getEnv("REDIS_ADDR", "localhost:6379"),
-		RedisPassword:      getEnv("REDIS_PASSWORD", ""),
-		RedisDB:            redisDB,
-		MinioEndpoint:      getEnv("MINIO_ENDPOINT", "localhost:9000"),
-		MinioAccessKey:     getEnv("MINIO_ACCESS_KEY", "minioadmin"),
-		MinioSecretKey:     getEnv("MINIO_SECRET_KEY", "minioadmin"),
-		MinioBucket:        getEnv("MINIO_BUCKET", "video-streams"),
-		MinioUseSSL:        minioUseSSL,
-		WatchDir:           getEnv("WATCH_DIR", "./input_files"),
-		ChunkSize:          chunkSize,
-		StabilityThreshold: stabilityThreshold,
-		StreamTimeout:      streamTimeout,
-		PrometheusPort:     getEnv("PROMETHEUS_PORT", "2112"),
-		LogLevel:           getEnv("LOG_LEVEL", "info"),
-		WorkerCount:        workerCount,
-		VideoFileFormats:   videoFileFormats,
+	return exts
+}
+
+// splitList splits a comma separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
 	}
+	return list
 }
 
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+// parseKeyValues parses a comma separated list of key=value pairs, e.g. "team=video,env=prod".
+func parseKeyValues(s string) map[string]string {
+	kv := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if k != "" {
+			kv[k] = strings.TrimSpace(v)
+		}
 	}
-	return fallback
+	return kv
 }
@@ -0,0 +1,162 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultProfile is the name of the profile built from the WATCH_DIR settings when no profiles file is configured.
+const DefaultProfile = "default"
+
+// Profile describes one watched directory and how its files are uploaded. Profiles are listed in the
+// file named by WATCH_PROFILES_FILE, in YAML or JSON. Unset fields fall back to the global settings.
+//
+//   - name: cameras
+//     watch_dir: /videos/cameras
+//     extensions: [.ts]
+//     chunk_size: 1048576
+//     bucket: camera-streams
+//     prefix: cameras/
+//     stability_threshold: 5
+//     priority: 10
+type Profile struct {
+	Name               string   `yaml:"name" json:"name"`
+	WatchDir           string   `yaml:"watch_dir" json:"watch_dir"`
+	Extensions         []string `yaml:"extensions" json:"extensions"`                   // VIDEO_FILE_FORMATS if empty
+	ChunkSize          int      `yaml:"chunk_size" json:"chunk_size"`                   // CHUNK_SIZE if 0
+	Bucket             string   `yaml:"bucket" json:"bucket"`                           // MINIO_BUCKET if empty
+	Prefix             string   `yaml:"prefix" json:"prefix"`                           // Prepended to the object key templates
+	StabilityThreshold int      `yaml:"stability_threshold" json:"stability_threshold"` // STABILITY_THRESHOLD if 0
+	Priority           int      `yaml:"priority" json:"priority"`                       // Files of higher priority profiles are processed first
+	Include            []string `yaml:"include" json:"include"`                         // WATCH_INCLUDE if empty
+	Exclude            []string `yaml:"exclude" json:"exclude"`                         // WATCH_EXCLUDE if empty
+	SkipHidden         *bool    `yaml:"skip_hidden" json:"skip_hidden"`                 // WATCH_SKIP_HIDDEN if unset
+	MinSize            int64    `yaml:"min_size" json:"min_size"`                       // WATCH_MIN_SIZE if 0
+	MaxSize            int64    `yaml:"max_size" json:"max_size"`                       // WATCH_MAX_SIZE if 0
+	MinAge             int      `yaml:"min_age" json:"min_age"`                         // WATCH_MIN_AGE if 0
+	MaxAge             int      `yaml:"max_age" json:"max_age"`                         // WATCH_MAX_AGE if 0
+	Readiness          string   `yaml:"readiness" json:"readiness"`                     // WATCH_READINESS if empty
+	MarkerSuffix       string   `yaml:"marker_suffix" json:"marker_suffix"`             // WATCH_MARKER_SUFFIX if empty
+}
+
+// LoadProfiles reads the watch profiles from cfg.ProfilesFile. Without a profiles file it returns a
+// single profile watching cfg.WatchDir with the global settings.
+func LoadProfiles(cfg *Config) ([]Profile, error) {
+	if cfg.ProfilesFile == "" {
+		return []Profile{{Name: DefaultProfile, WatchDir: cfg.WatchDir}}, nil
+	}
+	data, err := os.ReadFile(cfg.ProfilesFile)
+	if err != nil {
+		return nil, err
+	}
+	// YAML is a superset of JSON, so one decoder reads both
+	var profiles []Profile
+	if err := yaml.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", cfg.ProfilesFile, err)
+	}
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("%s defines no profiles", cfg.ProfilesFile)
+	}
+	names := make(map[string]bool)
+	for i := range profiles {
+		p := &profiles[i]
+		if p.Name == "" || p.WatchDir == "" {
+			return nil, fmt.Errorf("profile %d: name and watch_dir are required", i+1)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("duplicate profile %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.ChunkSize < 0 || p.StabilityThreshold < 0 || p.MinSize < 0 || p.MaxSize < 0 || p.MinAge < 0 || p.MaxAge < 0 {
+			return nil, fmt.Errorf("profile %q: sizes, ages and thresholds must not be negative", p.Name)
+		}
+		p.Extensions = normalizeFormats(p.Extensions)
+	}
+	return profiles, nil
+}
+
+// ForProfile returns a copy of cfg with the profile's settings applied, as used by the watcher
+// and the workers handling the profile's files.
+func (c *Config) ForProfile(p Profile) *Config {
+	pc := *c
+	if p.WatchDir != "" {
+		pc.WatchDir = p.WatchDir
+	}
+	if len(p.Extensions) > 0 {
+		pc.VideoFileFormats = p.Extensions
+	}
+	if p.ChunkSize > 0 {
+		pc.ChunkSize = p.ChunkSize
+	}
+	if p.Bucket != "" {
+		pc.MinioBucket = p.Bucket
+	}
+	if p.StabilityThreshold > 0 {
+		pc.StabilityThreshold = p.StabilityThreshold
+	}
+	if len(p.Include) > 0 {
+		pc.WatchInclude = p.Include
+	}
+	if len(p.Exclude) > 0 {
+		pc.WatchExclude = p.Exclude
+	}
+	if p.SkipHidden != nil {
+		pc.WatchSkipHidden = *p.SkipHidden
+	}
+	if p.MinSize > 0 {
+		pc.WatchMinSize = p.MinSize
+	}
+	if p.MaxSize > 0 {
+		pc.WatchMaxSize = p.MaxSize
+	}
+	if p.MinAge > 0 {
+		pc.WatchMinAge = p.MinAge
+	}
+	if p.MaxAge > 0 {
+		pc.WatchMaxAge = p.MaxAge
+	}
+	if p.Readiness != "" {
+		pc.WatchReadiness = strings.ToLower(p.Readiness)
+	}
+	if p.MarkerSuffix != "" {
+		pc.WatchMarkerSuffix = p.MarkerSuffix
+	}
+	if c.ProfilesFile != "" {
+		// Profiles watch different directories with their own WatchDir, so the same file name or relative
+		// path can occur in several of them; the profile name keeps their streams apart
+		pc.StreamIDNamespace = p.Name + "/"
+	}
+	pc.ChunkKeyTemplate = p.Prefix + c.ChunkKeyTemplate
+	pc.MetadataKeyTemplate = p.Prefix + c.MetadataKeyTemplate
+	pc.CurrentKeyTemplate = p.Prefix + c.CurrentKeyTemplate
+	return &pc
+}
+
+// MatchProfile returns the profile whose watch directory contains file, preferring the most
+// deeply nested directory when several do.
+func MatchProfile(profiles []Profile, file string) (Profile, bool) {
+	var match Profile
+	found, depth := false, -1
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return match, false
+	}
+	for _, p := range profiles {
+		dir, err := filepath.Abs(p.WatchDir)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if d := strings.Count(dir, string(filepath.Separator)); d > depth {
+			match, found, depth = p, true, d
+		}
+	}
+	return match, found
+}
@@ -0,0 +1,117 @@
+// Package container identifies the container format of a video file from its first bytes,
+// so files are handled according to their content rather than their extension.
+package container
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Format is a container format. The zero value means the content was not recognized.
+type Format string
+
+// Recognized container formats.
+const (
+	Unknown  Format = ""
+	MP4      Format = "mp4"
+	MOV      Format = "mov"
+	Matroska Format = "mkv"
+	WebM     Format = "webm"
+	MPEGTS   Format = "mpegts"
+	AVI      Format = "avi"
+)
+
+// TSPacketSize is the size of an MPEG transport stream packet; every packet starts with TSSyncByte.
+const (
+	TSPacketSize = 188
+	TSSyncByte   = 0x47
+)
+
+// sniffBytes is how much of a file Detect reads: enough for three TS packets and the EBML header.
+const sniffBytes = 4 * TSPacketSize
+
+// extensions lists the file extensions expected for each format.
+var extensions = map[Format][]string{
+	MP4:      {".mp4", ".m4v"},
+	MOV:      {".mov"},
+	Matroska: {".mkv"},
+	WebM:     {".webm"},
+	MPEGTS:   {".ts"},
+	AVI:      {".avi"},
+}
+
+// DetectFile returns the container format of the file at path.
+func DetectFile(path string) (Format, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Unknown, err
+	}
+	defer f.Close()
+	buf := make([]byte, sniffBytes)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return Unknown, err
+	}
+	return Detect(buf[:n]), nil
+}
+
+// Detect returns the container format of a file starting with header.
+func Detect(header []byte) Format {
+	switch {
+	case len(header) >= 12 && string(header[4:8]) == "ftyp":
+		// ISO base media: the major brand tells QuickTime from MP4
+		if string(header[8:12]) == "qt  " {
+			return MOV
+		}
+		return MP4
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "AVI ":
+		return AVI
+	case len(header) >= 4 && bytes.Equal(header[:4], []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return ebmlDocType(header)
+	case isTransportStream(header):
+		return MPEGTS
+	}
+	return Unknown
+}
+
+// MatchesExt reports whether file's extension is one expected for format.
+func MatchesExt(format Format, file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	for _, e := range extensions[format] {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// ebmlDocType tells WebM from Matroska by the DocType element of the EBML header.
+func ebmlDocType(header []byte) Format {
+	i := bytes.Index(header, []byte{0x42, 0x82}) // DocType element ID
+	if i < 0 || i+3 > len(header) {
+		return Matroska
+	}
+	// The size is a variable-length integer; DocType values are short enough for the one-byte form
+	size := int(header[i+2] &^ 0x80)
+	if header[i+2]&0x80 != 0 && i+3+size <= len(header) && string(header[i+3:i+3+size]) == "webm" {
+		return WebM
+	}
+	return Matroska
+}
+
+// isTransportStream reports whether header holds consecutive TS packets: a sync byte every 188 bytes,
+// checked on up to three packets. A file shorter than one packet is not recognized.
+func isTransportStream(header []byte) bool {
+	if len(header) < TSPacketSize {
+		return false
+	}
+	for off := 0; off < len(header) && off < 3*TSPacketSize; off += TSPacketSize {
+		if header[off] != TSSyncByte {
+			return false
+		}
+	}
+	return true
+}
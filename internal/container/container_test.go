@@ -0,0 +1,53 @@
+package container
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	ts := make([]byte, 3*TSPacketSize)
+	for i := 0; i < len(ts); i += TSPacketSize {
+		ts[i] = TSSyncByte
+	}
+	cases := []struct {
+		name   string
+		header []byte
+		want   Format
+	}{
+		{"mp4", []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00"), MP4},
+		{"mov", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x00\x00"), MOV},
+		{"mkv", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska"), Matroska},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), WebM},
+		{"ts", ts, MPEGTS},
+		{"avi", []byte("RIFF\x00\x10\x00\x00AVI LIST"), AVI},
+		{"wav", []byte("RIFF\x00\x10\x00\x00WAVEfmt "), Unknown},
+		{"text", []byte("somedata"), Unknown},
+		{"short ts", ts[:100], Unknown},
+	}
+	for _, c := range cases {
+		if got := Detect(c.header); got != c.want {
+			t.Errorf("%s: expected %q, got %q", c.name, c.want, got)
+		}
+	}
+	broken := append([]byte{}, ts...)
+	broken[TSPacketSize] = 0
+	if Detect(broken) != Unknown {
+		t.Error("a missing sync byte should not be detected as a transport stream")
+	}
+}
+
+func TestDetectFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "clip.mp4")
+	os.WriteFile(p, []byte("\x00\x00\x00\x20ftypmp42"), 0644)
+	if f, err := DetectFile(p); err != nil || f != MP4 {
+		t.Errorf("expected mp4, got %q (%v)", f, err)
+	}
+	if _, err := DetectFile(p + ".missing"); err == nil {
+		t.Error("a missing file should be an error")
+	}
+	if !MatchesExt(MP4, "/videos/CLIP.MP4") || MatchesExt(MPEGTS, "/videos/clip.mp4") {
+		t.Error("unexpected extension match")
+	}
+}
@@ -61,13 +61,82 @@ var (
 			Help: "Unix timestamp of the last successfully processed file.",
 		},
 	)
+	ReplicaUploadFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vsp_replica_upload_failures_total",
+			Help: "Total number of failed uploads per storage destination.",
+		},
+		[]string{"destination"},
+	)
+	ReplicaBackfilled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vsp_replica_backfilled_total",
+			Help: "Total number of objects copied to a destination that missed them.",
+		},
+		[]string{"destination"},
+	)
+	UploadedBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "vsp_uploaded_bytes_total",
+			Help: "Total number of chunk bytes uploaded.",
+		},
+	)
+	UploadThroughput = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "vsp_upload_throughput_bytes_per_second",
+			Help: "Chunk bytes sent through the upload rate limiter during the last second.",
+		},
+	)
+	UploadRateLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "vsp_upload_rate_limit_bytes_per_second",
+			Help: "Upload rate cap currently in effect, 0 when unlimited.",
+		},
+	)
+	UploadThrottleWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "vsp_upload_throttle_wait_seconds",
+			Help:    "Histogram of time chunk uploads spent waiting for the rate limiter.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8), // 0.01s, 0.04s, ...
+		},
+	)
+	CircuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "vsp_circuit_breaker_state",
+			Help: "Circuit breaker state per dependency: 0 closed, 1 open, 2 half-open.",
+		},
+		[]string{"breaker"},
+	)
+	GarbageCollected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vsp_gc_deleted_total",
+			Help: "Unreferenced chunk objects and checkpoint keys deleted by garbage collection.",
+		},
+		[]string{"type"}, // object or checkpoint
+	)
+	OrphanedStreams = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "vsp_orphaned_streams_total",
+			Help: "Incomplete streams found at startup whose source file no longer exists.",
+		},
+	)
+	StreamLeaseEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "vsp_stream_lease_events_total",
+			Help: "Stream lease events: held (owned by another instance, retried later) and lost (taken over mid-upload).",
+		},
+		[]string{"event"},
+	)
 	initOnce sync.Once
 )
 
 func Init(port string) {
 	initOnce.Do(func() {
 		prometheus.MustRegister(FilesDetected, ChunksUploaded, UploadFailures, RedisErrors,
-			FilesInProgress, FileProcessingDuration, ChunkUploadDuration, LastFileProcessed)
+			FilesInProgress, FileProcessingDuration, ChunkUploadDuration, LastFileProcessed,
+			ReplicaUploadFailures, ReplicaBackfilled,
+			UploadedBytes, UploadThroughput, UploadRateLimit, UploadThrottleWait,
+			CircuitBreakerState, GarbageCollected, StreamLeaseEvents, OrphanedStreams)
 		go func() {
 			http.Handle("/metrics", promhttp.Handler())
 			http.ListenAndServe(":"+port, nil)
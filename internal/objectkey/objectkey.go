@@ -0,0 +1,273 @@
+// Package objectkey renders object storage key names from configurable templates.
+// Templates are plain strings with {variable} placeholders, for example:
+//
+//	{date}/{camera}/{stream}/{index:08}
+//
+// Supported variables:
+//   - {stream}  stream ID
+//   - {file}    source file name (with extension)
+//   - {name}    source file name without extension
+//   - {ext}     source file extension without the dot
+//   - {camera}  name of the directory containing the source file
+//   - {date}    source file modification date (YYYY-MM-DD, UTC)
+//   - {year}, {month}, {day}, {hour}  parts of the modification time (UTC, zero padded)
+//   - {index}   chunk index; {index:08} pads it with zeros to 8 digits
+//   - {version} upload version of the stream, rendered as "v3"
+//
+// A versioned layout also has a "current" template naming the small pointer object that is
+// rewritten last to publish a new version; it must not depend on {version} or {index}.
+//
+// The same Layout is used by the uploader when writing objects and by any tooling that reads them back.
+package objectkey
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultChunkTemplate reproduces the historical "<stream>/chunk-00000" layout. Its keys only sort
+	// in chunk order up to 99,999 chunks per stream; streams with more chunks need a wider {index:NN}.
+	DefaultChunkTemplate = "{stream}/chunk-{index:05}"
+	// DefaultMetadataTemplate reproduces the historical "<stream>/metadata.json" layout.
+	DefaultMetadataTemplate = "{stream}/metadata.json"
+	// VersionedChunkTemplate and VersionedMetadataTemplate are the defaults when versioned uploads are enabled.
+	VersionedChunkTemplate    = "{stream}/{version}/chunk-{index:05}"
+	VersionedMetadataTemplate = "{stream}/{version}/metadata.json"
+	// DefaultCurrentTemplate names the pointer object to the current version of a stream.
+	DefaultCurrentTemplate = "{stream}/current.json"
+)
+
+// Stream carries the per-stream values that templates are rendered from.
+type Stream struct {
+	ID      string    // Stream ID
+	Path    string    // Source file path
+	ModTime time.Time // Source file modification time
+	Version int       // Upload version, 0 when uploads are not versioned
+}
+
+// Layout holds the parsed chunk and metadata templates.
+type Layout struct {
+	chunk    template
+	metadata template
+	current  template // nil unless set with WithCurrent
+}
+
+type segment struct {
+	literal string
+	name    string // variable name, empty for literal segments
+	width   int    // zero padding width for {index:NN}
+}
+
+type template []segment
+
+// Parse parses the chunk and metadata templates. The chunk template must contain {index}
+// and the metadata template must not.
+func Parse(chunkTmpl, metadataTmpl string) (*Layout, error) {
+	chunk, err := parseTemplate(chunkTmpl)
+	if err != nil {
+		return nil, fmt.Errorf("chunk key template: %w", err)
+	}
+	if !chunk.has("index") {
+		return nil, fmt.Errorf("chunk key template %q must contain {index}", chunkTmpl)
+	}
+	metadata, err := parseTemplate(metadataTmpl)
+	if err != nil {
+		return nil, fmt.Errorf("metadata key template: %w", err)
+	}
+	if metadata.has("index") {
+		return nil, fmt.Errorf("metadata key template %q must not contain {index}", metadataTmpl)
+	}
+	return &Layout{chunk: chunk, metadata: metadata}, nil
+}
+
+// WithCurrent returns a copy of the layout that names version pointer objects with tmpl.
+func (l *Layout) WithCurrent(tmpl string) (*Layout, error) {
+	current, err := parseTemplate(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("current key template: %w", err)
+	}
+	if current.has("index") || current.has("version") {
+		return nil, fmt.Errorf("current key template %q must not contain {index} or {version}", tmpl)
+	}
+	c := *l
+	c.current = current
+	return &c, nil
+}
+
+// Versioned reports whether both the chunk and metadata templates contain {version}.
+func (l *Layout) Versioned() bool {
+	return l.chunk.has("version") && l.metadata.has("version")
+}
+
+// Default returns the layout built from DefaultChunkTemplate and DefaultMetadataTemplate.
+func Default() *Layout {
+	l, _ := Parse(DefaultChunkTemplate, DefaultMetadataTemplate)
+	return l
+}
+
+// ChunkKey returns the object key of the given chunk.
+func (l *Layout) ChunkKey(s Stream, chunkIdx int) string {
+	return l.chunk.render(s, chunkIdx)
+}
+
+// MetadataKey returns the object key of the stream's metadata document.
+func (l *Layout) MetadataKey(s Stream) string {
+	return l.metadata.render(s, 0)
+}
+
+// CurrentKey returns the object key of the stream's version pointer, or "" if the layout has none.
+func (l *Layout) CurrentKey(s Stream) string {
+	return l.current.render(s, 0)
+}
+
+// ChunkPrefix returns the rendered part of the chunk template that precedes {index},
+// trimmed back to the last "/". All chunk keys of the stream share this prefix, so it
+// can be used to list them.
+func (l *Layout) ChunkPrefix(s Stream) string {
+	var b strings.Builder
+	for _, seg := range l.chunk {
+		if seg.name == "index" {
+			break
+		}
+		b.WriteString(seg.value(s, 0))
+	}
+	prefix := b.String()
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		return prefix[:i+1]
+	}
+	return ""
+}
+
+// ChunkIndex reverses ChunkKey: it reports the chunk index encoded in key, or false
+// if key was not produced by this layout for the given stream.
+func (l *Layout) ChunkIndex(s Stream, key string) (int, bool) {
+	rest := key
+	for i, seg := range l.chunk {
+		if seg.name != "index" {
+			v := seg.value(s, 0)
+			if !strings.HasPrefix(rest, v) {
+				return 0, false
+			}
+			rest = rest[len(v):]
+			continue
+		}
+		// Everything up to the next literal belongs to the index.
+		suffix := l.chunk[i+1:].render(s, 0)
+		if !strings.HasSuffix(rest, suffix) {
+			return 0, false
+		}
+		// Only the exact rendering of an index matches: padded to the template's width, no sign
+		digits := rest[:len(rest)-len(suffix)]
+		idx, err := strconv.Atoi(digits)
+		if err != nil || idx < 0 || seg.value(s, idx) != digits {
+			return 0, false
+		}
+		return idx, true
+	}
+	return 0, false
+}
+
+func parseTemplate(tmpl string) (template, error) {
+	if tmpl == "" {
+		return nil, fmt.Errorf("empty template")
+	}
+	var t template
+	for len(tmpl) > 0 {
+		open := strings.IndexByte(tmpl, '{')
+		if open < 0 {
+			t = append(t, segment{literal: tmpl})
+			break
+		}
+		if open > 0 {
+			t = append(t, segment{literal: tmpl[:open]})
+		}
+		end := strings.IndexByte(tmpl[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated variable in %q", tmpl)
+		}
+		seg, err := parseVariable(tmpl[open+1 : open+end])
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, seg)
+		tmpl = tmpl[open+end+1:]
+	}
+	return t, nil
+}
+
+func parseVariable(v string) (segment, error) {
+	name, format, hasFormat := strings.Cut(v, ":")
+	switch name {
+	case "stream", "file", "name", "ext", "camera", "date", "year", "month", "day", "hour", "version":
+		if hasFormat {
+			return segment{}, fmt.Errorf("variable {%s} does not take a format", name)
+		}
+		return segment{name: name}, nil
+	case "index":
+		seg := segment{name: name}
+		if hasFormat {
+			width, err := strconv.Atoi(format)
+			if err != nil || width <= 0 {
+				return segment{}, fmt.Errorf("invalid index width %q", format)
+			}
+			seg.width = width
+		}
+		return seg, nil
+	}
+	return segment{}, fmt.Errorf("unknown variable {%s}", name)
+}
+
+func (t template) has(name string) bool {
+	for _, seg := range t {
+		if seg.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (t template) render(s Stream, chunkIdx int) string {
+	var b strings.Builder
+	for _, seg := range t {
+		b.WriteString(seg.value(s, chunkIdx))
+	}
+	return b.String()
+}
+
+func (seg segment) value(s Stream, chunkIdx int) string {
+	mt := s.ModTime.UTC()
+	switch seg.name {
+	case "":
+		return seg.literal
+	case "stream":
+		return s.ID
+	case "file":
+		return filepath.Base(s.Path)
+	case "name":
+		base := filepath.Base(s.Path)
+		return strings.TrimSuffix(base, filepath.Ext(base))
+	case "ext":
+		return strings.TrimPrefix(filepath.Ext(s.Path), ".")
+	case "camera":
+		return filepath.Base(filepath.Dir(s.Path))
+	case "date":
+		return mt.Format("2006-01-02")
+	case "year":
+		return mt.Format("2006")
+	case "month":
+		return mt.Format("01")
+	case "day":
+		return mt.Format("02")
+	case "hour":
+		return mt.Format("15")
+	case "version":
+		return "v" + strconv.Itoa(s.Version)
+	case "index":
+		return fmt.Sprintf("%0*d", seg.width, chunkIdx)
+	}
+	return ""
+}
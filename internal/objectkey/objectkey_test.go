@@ -0,0 +1,113 @@
+package objectkey
+
+import (
+	"testing"
+	"time"
+)
+
+var testStream = Stream{
+	ID:      "out.mp4",
+	Path:    "/input/site1/cam7/out.mp4",
+	ModTime: time.Date(2025, 5, 27, 18, 23, 25, 0, time.UTC),
+}
+
+func TestDefaultLayout(t *testing.T) {
+	l := Default()
+	if got := l.ChunkKey(testStream, 2); got != "out.mp4/chunk-00002" {
+		t.Errorf("unexpected chunk key: %s", got)
+	}
+	if got := l.MetadataKey(testStream); got != "out.mp4/metadata.json" {
+		t.Errorf("unexpected metadata key: %s", got)
+	}
+}
+
+func TestLayoutVariables(t *testing.T) {
+	l, err := Parse("{year}/{month}/{day}/{hour}/{camera}/{name}.{ext}/{file}-{index}", "{date}/{stream}.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.ChunkKey(testStream, 123456); got != "2025/05/27/18/cam7/out.mp4/out.mp4-123456" {
+		t.Errorf("unexpected chunk key: %s", got)
+	}
+	if got := l.MetadataKey(testStream); got != "2025-05-27/out.mp4.json" {
+		t.Errorf("unexpected metadata key: %s", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		chunk, metadata string
+	}{
+		{"{stream}/chunk", DefaultMetadataTemplate},
+		{"{stream}/{unknown}/{index}", DefaultMetadataTemplate},
+		{"{stream}/{index:x}", DefaultMetadataTemplate},
+		{"{stream/{index}", DefaultMetadataTemplate},
+		{"{stream:5}/{index}", DefaultMetadataTemplate},
+		{DefaultChunkTemplate, "{stream}/{index}.json"},
+		{DefaultChunkTemplate, ""},
+	}
+	for _, c := range cases {
+		if _, err := Parse(c.chunk, c.metadata); err == nil {
+			t.Errorf("Parse(%q, %q) should fail", c.chunk, c.metadata)
+		}
+	}
+}
+
+func TestChunkPrefixAndIndex(t *testing.T) {
+	l, err := Parse("{date}/{camera}/{stream}/{index:08}.bin", DefaultMetadataTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.ChunkPrefix(testStream); got != "2025-05-27/cam7/out.mp4/" {
+		t.Errorf("unexpected prefix: %s", got)
+	}
+	key := l.ChunkKey(testStream, 42)
+	if idx, ok := l.ChunkIndex(testStream, key); !ok || idx != 42 {
+		t.Errorf("ChunkIndex(%q) = %d, %v", key, idx, ok)
+	}
+	if idx, ok := l.ChunkIndex(testStream, "2025-05-27/cam7/out.mp4/123456789.bin"); !ok || idx != 123456789 {
+		t.Errorf("indexes wider than the padding should match, got %d, %v", idx, ok)
+	}
+	for _, key := range []string{
+		"2025-05-27/cam7/out.mp4/metadata.json", "2025-05-27/cam7/other.mp4/00000042.bin", "2025-05-27/cam7/out.mp4/.bin",
+		"2025-05-27/cam7/out.mp4/42.bin", "2025-05-27/cam7/out.mp4/+0000042.bin", "2025-05-27/cam7/out.mp4/000000042.bin",
+	} {
+		if _, ok := l.ChunkIndex(testStream, key); ok {
+			t.Errorf("ChunkIndex(%q) should not match", key)
+		}
+	}
+}
+
+func TestVersionedLayout(t *testing.T) {
+	l, err := Parse(VersionedChunkTemplate, VersionedMetadataTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Versioned() || Default().Versioned() {
+		t.Error("only templates with {version} should be versioned")
+	}
+	if got := l.CurrentKey(testStream); got != "" {
+		t.Errorf("layout without a current template should have no current key, got %q", got)
+	}
+	l, err = l.WithCurrent(DefaultCurrentTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := testStream
+	s.Version = 3
+	if got := l.ChunkKey(s, 1); got != "out.mp4/v3/chunk-00001" {
+		t.Errorf("unexpected chunk key: %s", got)
+	}
+	if got := l.ChunkPrefix(s); got != "out.mp4/v3/" {
+		t.Errorf("unexpected chunk prefix: %s", got)
+	}
+	if got := l.MetadataKey(s); got != "out.mp4/v3/metadata.json" {
+		t.Errorf("unexpected metadata key: %s", got)
+	}
+	if got := l.CurrentKey(s); got != "out.mp4/current.json" {
+		t.Errorf("unexpected current key: %s", got)
+	}
+	if _, err := l.WithCurrent("{stream}/{version}/current.json"); err == nil {
+		t.Error("current template with {version} should be rejected")
+	}
+}
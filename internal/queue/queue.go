@@ -0,0 +1,152 @@
+// Package queue distributes files detected by the watcher to the workers.
+//
+// The channel queue keeps jobs in memory: they are lost on restart and only visible to the
+// local workers, and higher priority jobs are handed out first. The Redis queue keeps jobs in a Redis stream read through a consumer group, so
+// queued work survives restarts and is shared between instances. A job is removed once acknowledged;
+// jobs left unacknowledged by a consumer that died are claimed by another one after an idle timeout,
+// so workers keep the jobs they are processing alive with KeepAlive.
+// Jobs in the Redis queue are handed out in the order they were queued, whatever their priority.
+package queue
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"video-stream-processor/internal/config"
+
+	"go.uber.org/zap"
+)
+
+// Supported QUEUE_BACKEND values.
+const (
+	BackendChannel = "channel"
+	BackendRedis   = "redis"
+)
+
+// Job is a file waiting to be processed.
+type Job struct {
+	ID       string // Backend message ID, empty for the channel queue
+	File     string // Path of the file to process
+	Profile  string // Name of the watch profile the file belongs to, empty if unknown
+	Priority int    // Jobs with a higher priority are processed first by the channel queue
+}
+
+// Queue is a work queue of files.
+type Queue interface {
+	// Enqueue adds a job to the queue. Its ID is assigned by the backend.
+	Enqueue(ctx context.Context, job Job) error
+	// Dequeue blocks until a job is available or ctx is done.
+	Dequeue(ctx context.Context) (Job, error)
+	// Ack removes a processed job from the queue. Unacknowledged jobs are redelivered by backends that support it.
+	Ack(ctx context.Context, job Job) error
+	// Touch reports that the job is still being processed, so backends that redeliver unacknowledged
+	// jobs do not hand it to another consumer. See KeepAlive.
+	Touch(ctx context.Context, job Job) error
+}
+
+// KeepAlive touches the job every interval until the returned function is called, so a job that takes
+// longer than the claim timeout is not claimed by another consumer while it is being processed.
+func KeepAlive(ctx context.Context, q Queue, job Job, interval time.Duration, log *zap.Logger) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := q.Touch(ctx, job); err != nil && ctx.Err() == nil {
+					log.Warn("Failed to extend queued job", zap.String("id", job.ID), zap.String("file", job.File), zap.Error(err))
+				}
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// New returns the queue selected by cfg.QueueBackend.
+func New(cfg *config.Config, log *zap.Logger) (Queue, error) {
+	switch cfg.QueueBackend {
+	case "", BackendChannel:
+		return NewChannel(100), nil
+	case BackendRedis:
+		return NewRedis(cfg, log)
+	}
+	return nil, fmt.Errorf("unknown queue backend %q", cfg.QueueBackend)
+}
+
+// channelQueue is an in-memory priority queue. Jobs of equal priority are handed out in the order they were queued.
+type channelQueue struct {
+	mu    sync.Mutex
+	jobs  jobHeap
+	seq   uint64
+	slots chan struct{} // One token per queued job, bounding the queue's size
+	ready chan struct{} // One token per queued job, taken by Dequeue
+}
+
+// NewChannel returns an in-memory queue holding up to size jobs. Enqueue blocks while it is full.
+func NewChannel(size int) Queue {
+	return &channelQueue{slots: make(chan struct{}, size), ready: make(chan struct{}, size)}
+}
+
+func (q *channelQueue) Enqueue(ctx context.Context, job Job) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	q.mu.Lock()
+	q.seq++
+	heap.Push(&q.jobs, queuedJob{Job: job, seq: q.seq})
+	q.mu.Unlock()
+	q.ready <- struct{}{}
+	return nil
+}
+
+func (q *channelQueue) Dequeue(ctx context.Context) (Job, error) {
+	select {
+	case <-q.ready:
+	case <-ctx.Done():
+		return Job{}, ctx.Err()
+	}
+	q.mu.Lock()
+	job := heap.Pop(&q.jobs).(queuedJob).Job
+	q.mu.Unlock()
+	<-q.slots
+	return job, nil
+}
+
+func (q *channelQueue) Ack(ctx context.Context, job Job) error   { return nil }
+func (q *channelQueue) Touch(ctx context.Context, job Job) error { return nil }
+
+type queuedJob struct {
+	Job
+	seq uint64
+}
+
+// jobHeap orders jobs by descending priority, then by arrival.
+type jobHeap []queuedJob
+
+func (h jobHeap) Len() int { return len(h) }
+func (h jobHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority > h[j].Priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h jobHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x any)   { *h = append(*h, x.(queuedJob)) }
+func (h *jobHeap) Pop() any {
+	old := *h
+	job := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return job
+}
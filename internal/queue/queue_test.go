@@ -0,0 +1,220 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+	"video-stream-processor/internal/config"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// mockStreamClient emulates a single Redis stream with one consumer group
+type mockStreamClient struct {
+	mu        sync.Mutex
+	groups    int
+	seq       int
+	messages  []redis.XMessage
+	delivered int                  // Messages before this index were delivered to the group
+	pending   map[string]time.Time // Message ID -> last delivery
+	deleted   []string
+}
+
+func newMockStreamClient() *mockStreamClient {
+	return &mockStreamClient{pending: map[string]time.Time{}}
+}
+
+func (m *mockStreamClient) XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd {
+	m.groups++
+	if m.groups > 1 {
+		return redis.NewStatusResult("", fmt.Errorf("BUSYGROUP Consumer Group name already exists"))
+	}
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (m *mockStreamClient) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seq++
+	id := fmt.Sprintf("%d-0", m.seq)
+	m.messages = append(m.messages, redis.XMessage{ID: id, Values: a.Values.(map[string]any)})
+	return redis.NewStringResult(id, nil)
+}
+
+func (m *mockStreamClient) XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.delivered == len(m.messages) {
+		time.Sleep(time.Millisecond) // Stands in for the blocking read
+		return redis.NewXStreamSliceCmdResult(nil, redis.Nil)
+	}
+	msg := m.messages[m.delivered]
+	m.delivered++
+	m.pending[msg.ID] = time.Now()
+	return redis.NewXStreamSliceCmdResult([]redis.XStream{{Stream: a.Streams[0], Messages: []redis.XMessage{msg}}}, nil)
+}
+
+func (m *mockStreamClient) XAutoClaim(ctx context.Context, a *redis.XAutoClaimArgs) *redis.XAutoClaimCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cmd := redis.NewXAutoClaimCmd(ctx)
+	for _, msg := range m.messages[:m.delivered] {
+		if at, ok := m.pending[msg.ID]; ok && time.Since(at) >= a.MinIdle {
+			m.pending[msg.ID] = time.Now()
+			cmd.SetVal([]redis.XMessage{msg}, "0-0")
+			return cmd
+		}
+	}
+	cmd.SetVal(nil, "0-0")
+	return cmd
+}
+
+func (m *mockStreamClient) XClaimJustID(ctx context.Context, a *redis.XClaimArgs) *redis.StringSliceCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for _, id := range a.Messages {
+		if at, ok := m.pending[id]; ok && time.Since(at) >= a.MinIdle {
+			m.pending[id] = time.Now()
+			ids = append(ids, id)
+		}
+	}
+	return redis.NewStringSliceResult(ids, nil)
+}
+
+func (m *mockStreamClient) XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		delete(m.pending, id)
+	}
+	return redis.NewIntResult(int64(len(ids)), nil)
+}
+
+func (m *mockStreamClient) XDel(ctx context.Context, stream string, ids ...string) *redis.IntCmd {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, ids...)
+	return redis.NewIntResult(int64(len(ids)), nil)
+}
+
+func TestChannelQueue(t *testing.T) {
+	q := NewChannel(1)
+	ctx := context.Background()
+	if err := q.Enqueue(ctx, Job{File: "a.mp4"}); err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	job, err := q.Dequeue(ctx)
+	if err != nil || job.File != "a.mp4" {
+		t.Fatalf("Expected a.mp4, got %+v (%v)", job, err)
+	}
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.Dequeue(timeout); err == nil {
+		t.Error("Dequeue on an empty queue should return when the context is done")
+	}
+}
+
+func TestChannelQueue_Priority(t *testing.T) {
+	q := NewChannel(4)
+	ctx := context.Background()
+	q.Enqueue(ctx, Job{File: "low.mp4"})
+	q.Enqueue(ctx, Job{File: "high.mp4", Priority: 10})
+	q.Enqueue(ctx, Job{File: "low2.mp4"})
+	q.Enqueue(ctx, Job{File: "high2.mp4", Priority: 10})
+	for _, want := range []string{"high.mp4", "high2.mp4", "low.mp4", "low2.mp4"} {
+		if job, _ := q.Dequeue(ctx); job.File != want {
+			t.Fatalf("Expected %s, got %s", want, job.File)
+		}
+	}
+
+	// A full queue blocks until a job is taken
+	full := NewChannel(1)
+	full.Enqueue(ctx, Job{File: "a.mp4"})
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := full.Enqueue(timeout, Job{File: "b.mp4"}); err == nil {
+		t.Error("Enqueue on a full queue should return when the context is done")
+	}
+}
+
+func TestRedisQueue(t *testing.T) {
+	client := newMockStreamClient()
+	cfg := &config.Config{QueueStream: "vsp:files", QueueGroup: "workers", InstanceID: "a", QueueClaimIdle: 600}
+	ctx := context.Background()
+	q, err := newRedisQueue(ctx, client, cfg, zap.NewNop())
+	if err != nil {
+		t.Fatalf("newRedisQueue failed: %v", err)
+	}
+	// A second instance finds the group already created
+	if _, err := newRedisQueue(ctx, client, cfg, zap.NewNop()); err != nil {
+		t.Fatalf("Existing consumer group should not be an error: %v", err)
+	}
+
+	q.Enqueue(ctx, Job{File: "a.mp4", Profile: "cameras", Priority: 5})
+	q.Enqueue(ctx, Job{File: "b.mp4"})
+	job, err := q.Dequeue(ctx)
+	if err != nil || job.File != "a.mp4" || job.ID != "1-0" || job.Profile != "cameras" || job.Priority != 5 {
+		t.Fatalf("Expected a.mp4 as 1-0, got %+v (%v)", job, err)
+	}
+	if err := q.Ack(ctx, job); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if len(client.pending) != 0 || len(client.deleted) != 1 {
+		t.Errorf("Acknowledged job should be removed, pending %v deleted %v", client.pending, client.deleted)
+	}
+
+	// b.mp4 is delivered but never acknowledged, as if the consumer died
+	if job, _ := q.Dequeue(ctx); job.File != "b.mp4" {
+		t.Fatalf("Expected b.mp4, got %+v", job)
+	}
+	q.claimIdle = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	job, err = q.Dequeue(ctx)
+	if err != nil || job.File != "b.mp4" {
+		t.Errorf("Stuck job should be claimed, got %+v (%v)", job, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := q.Dequeue(cancelled); err == nil {
+		t.Error("Dequeue should stop when the context is cancelled")
+	}
+}
+
+func TestRedisQueue_KeepAlive(t *testing.T) {
+	client := newMockStreamClient()
+	cfg := &config.Config{QueueBackend: BackendRedis, QueueStream: "vsp:files", QueueGroup: "workers", InstanceID: "a", QueueClaimIdle: 600}
+	ctx := context.Background()
+	a, _ := newRedisQueue(ctx, client, cfg, zap.NewNop())
+	cfg.InstanceID = "b"
+	b, _ := newRedisQueue(ctx, client, cfg, zap.NewNop())
+	a.claimIdle, b.claimIdle = 30*time.Millisecond, 30*time.Millisecond
+	if KeepAliveInterval(cfg) != 200*time.Second {
+		t.Errorf("Jobs should be touched three times per claim timeout, got %v", KeepAliveInterval(cfg))
+	}
+
+	a.Enqueue(ctx, Job{File: "slow.mp4"})
+	job, err := a.Dequeue(ctx)
+	if err != nil {
+		t.Fatalf("Dequeue failed: %v", err)
+	}
+	// The job takes several claim timeouts to process
+	stop := KeepAlive(ctx, a, job, 10*time.Millisecond, zap.NewNop())
+	time.Sleep(100 * time.Millisecond)
+	short, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if claimed, err := b.Dequeue(short); err == nil {
+		t.Fatalf("A job kept alive should not be claimed, got %+v", claimed)
+	}
+
+	// Once the worker stops touching it, e.g. because it died, the job is claimed again
+	stop()
+	time.Sleep(40 * time.Millisecond)
+	if claimed, err := b.Dequeue(ctx); err != nil || claimed.ID != job.ID {
+		t.Errorf("Expected %s to be claimed, got %+v (%v)", job.ID, claimed, err)
+	}
+}
@@ -0,0 +1,155 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/redisstore"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// StreamClient is the subset of the Redis client used by the Redis queue.
+type StreamClient interface {
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	XDel(ctx context.Context, stream string, ids ...string) *redis.IntCmd
+	XGroupCreateMkStream(ctx context.Context, stream, group, start string) *redis.StatusCmd
+	XReadGroup(ctx context.Context, a *redis.XReadGroupArgs) *redis.XStreamSliceCmd
+	XAck(ctx context.Context, stream, group string, ids ...string) *redis.IntCmd
+	XAutoClaim(ctx context.Context, a *redis.XAutoClaimArgs) *redis.XAutoClaimCmd
+	XClaimJustID(ctx context.Context, a *redis.XClaimArgs) *redis.StringSliceCmd
+}
+
+// blockTimeout bounds a single blocking read, so Dequeue notices cancellation and claims stuck jobs in time.
+const blockTimeout = 5 * time.Second
+
+// redisQueue is a queue backed by a Redis stream and a consumer group (requires Redis 6.2 for XAUTOCLAIM).
+// Each instance reads as its own consumer; a job stays pending until acknowledged, and a job pending
+// for longer than claimIdle is claimed by the next consumer that asks for work. Touch resets a job's idle time.
+type redisQueue struct {
+	client    StreamClient
+	stream    string
+	group     string
+	consumer  string
+	claimIdle time.Duration
+	log       *zap.Logger
+}
+
+// NewRedis returns a queue on the stream cfg.QueueStream, creating the stream and consumer group
+// cfg.QueueGroup if they do not exist. Workers of this instance consume as cfg.InstanceID.
+func NewRedis(cfg *config.Config, log *zap.Logger) (Queue, error) {
+	client, err := redisstore.NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return newRedisQueue(context.Background(), client, cfg, log)
+}
+
+func newRedisQueue(ctx context.Context, client StreamClient, cfg *config.Config, log *zap.Logger) (*redisQueue, error) {
+	q := &redisQueue{
+		client:    client,
+		stream:    redisstore.NewKeys(cfg).Name(cfg.QueueStream),
+		group:     cfg.QueueGroup,
+		consumer:  cfg.InstanceID,
+		claimIdle: time.Duration(cfg.QueueClaimIdle) * time.Second,
+		log:       log,
+	}
+	// Start at the beginning of the stream, so jobs queued before the group existed are processed
+	err := client.XGroupCreateMkStream(ctx, q.stream, q.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *redisQueue) Enqueue(ctx context.Context, job Job) error {
+	values := map[string]any{"file": job.File, "profile": job.Profile, "priority": job.Priority}
+	return q.client.XAdd(ctx, &redis.XAddArgs{Stream: q.stream, Values: values}).Err()
+}
+
+// Dequeue returns a stuck job of another consumer if there is one, and otherwise waits for a new job.
+func (q *redisQueue) Dequeue(ctx context.Context) (Job, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return Job{}, err
+		}
+		if q.claimIdle > 0 {
+			msgs, _, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream: q.stream, Group: q.group, Consumer: q.consumer,
+				MinIdle: q.claimIdle, Start: "0-0", Count: 1,
+			}).Result()
+			if err != nil && err != redis.Nil {
+				return Job{}, err
+			}
+			if len(msgs) > 0 {
+				q.log.Info("Claimed stuck job", zap.String("id", msgs[0].ID), zap.Any("file", msgs[0].Values["file"]))
+				if job, ok := q.job(ctx, msgs[0]); ok {
+					return job, nil
+				}
+				continue
+			}
+		}
+		streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: q.group, Consumer: q.consumer,
+			Streams: []string{q.stream, ">"}, Count: 1, Block: blockTimeout,
+		}).Result()
+		if err == redis.Nil {
+			continue // Nothing new within the block timeout
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return Job{}, ctx.Err()
+			}
+			return Job{}, err
+		}
+		for _, s := range streams {
+			if len(s.Messages) > 0 {
+				if job, ok := q.job(ctx, s.Messages[0]); ok {
+					return job, nil
+				}
+			}
+		}
+	}
+}
+
+// job converts a stream message into a Job. Malformed messages are acknowledged and skipped.
+func (q *redisQueue) job(ctx context.Context, msg redis.XMessage) (Job, bool) {
+	file, _ := msg.Values["file"].(string)
+	if file == "" {
+		q.log.Warn("Dropping malformed queue message", zap.String("id", msg.ID))
+		q.Ack(ctx, Job{ID: msg.ID})
+		return Job{}, false
+	}
+	// Messages queued by older versions have no profile or priority
+	profile, _ := msg.Values["profile"].(string)
+	priority, _ := strconv.Atoi(fmt.Sprint(msg.Values["priority"]))
+	return Job{ID: msg.ID, File: file, Profile: profile, Priority: priority}, true
+}
+
+// Ack acknowledges the job and deletes it from the stream, which otherwise grows without bound.
+func (q *redisQueue) Ack(ctx context.Context, job Job) error {
+	if err := q.client.XAck(ctx, q.stream, q.group, job.ID).Err(); err != nil {
+		return err
+	}
+	return q.client.XDel(ctx, q.stream, job.ID).Err()
+}
+
+// Touch claims the job again for this consumer, which resets its idle time without redelivering it.
+func (q *redisQueue) Touch(ctx context.Context, job Job) error {
+	return q.client.XClaimJustID(ctx, &redis.XClaimArgs{
+		Stream: q.stream, Group: q.group, Consumer: q.consumer, Messages: []string{job.ID},
+	}).Err()
+}
+
+// KeepAliveInterval returns how often workers should touch the jobs they process: a third of the
+// claim timeout, or 0 if jobs are never claimed.
+func KeepAliveInterval(cfg *config.Config) time.Duration {
+	if cfg.QueueBackend != BackendRedis {
+		return 0
+	}
+	return time.Duration(cfg.QueueClaimIdle) * time.Second / 3
+}
@@ -0,0 +1,173 @@
+// Package ratelimit provides a byte-based token bucket shared by all upload workers.
+// The bucket refills at a configurable rate in bytes per second, which can be raised or lowered
+// by time-of-day schedule windows (for example to leave WAN capacity to production traffic during
+// business hours). A rate of 0 means unlimited.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"video-stream-processor/internal/metrics"
+)
+
+// Window overrides the base rate between Start and End, given as offsets from local midnight.
+// Windows where End is before Start wrap around midnight.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+	Rate  int64 // Bytes per second, 0 means unlimited
+}
+
+// contains reports whether the time of day of t falls within the window.
+func (w Window) contains(t time.Time) bool {
+	y, m, d := t.Date()
+	tod := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if w.Start <= w.End {
+		return tod >= w.Start && tod < w.End
+	}
+	return tod >= w.Start || tod < w.End
+}
+
+// Limiter is a token bucket measured in bytes. The bucket holds at most one second worth of tokens.
+// Requests larger than the bucket are allowed and put the bucket into debt, so later callers wait
+// until it is paid back. Limiter is safe for concurrent use.
+type Limiter struct {
+	mu       sync.Mutex
+	base     int64
+	schedule []Window
+	tokens   float64
+	last     time.Time
+	reserved int64 // Bytes reserved since the last throughput report
+	now      func() time.Time
+}
+
+// New returns a Limiter with the given base rate in bytes per second and optional schedule windows.
+// The first matching window wins.
+func New(rate int64, schedule []Window) *Limiter {
+	return &Limiter{base: rate, schedule: schedule, now: time.Now}
+}
+
+// Rate returns the rate in effect at t.
+func (l *Limiter) Rate(t time.Time) int64 {
+	for _, w := range l.schedule {
+		if w.contains(t) {
+			return w.Rate
+		}
+	}
+	return l.base
+}
+
+// WaitN blocks until n bytes may be sent and returns the time spent waiting.
+// It returns early with ctx.Err() if ctx is cancelled.
+func (l *Limiter) WaitN(ctx context.Context, n int) (time.Duration, error) {
+	wait := l.reserve(n)
+	if wait <= 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return wait, ctx.Err()
+	case <-timer.C:
+		return wait, nil
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller must wait for them.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.reserved += int64(n)
+	rate := l.Rate(now)
+	if rate <= 0 {
+		l.tokens = 0
+		l.last = now
+		return 0
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	} else {
+		l.tokens = float64(rate)
+	}
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// Run reports the current rate cap and the upload throughput to Prometheus every second until ctx is cancelled.
+func (l *Limiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := l.now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			now := l.now()
+			reserved := l.reserved
+			l.reserved = 0
+			l.mu.Unlock()
+			if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+				metrics.UploadThroughput.Set(float64(reserved) / elapsed)
+			}
+			last = now
+			metrics.UploadRateLimit.Set(float64(l.Rate(now)))
+		}
+	}
+}
+
+// ParseSchedule parses a comma separated list of windows in the form "HH:MM-HH:MM=RATE",
+// e.g. "08:00-18:00=1048576,18:00-08:00=0".
+func ParseSchedule(s string) ([]Window, error) {
+	var windows []Window
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		span, rate, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("schedule window %q: missing =RATE", item)
+		}
+		from, to, ok := strings.Cut(span, "-")
+		if !ok {
+			return nil, fmt.Errorf("schedule window %q: expected HH:MM-HH:MM", item)
+		}
+		start, err := parseTimeOfDay(from)
+		if err != nil {
+			return nil, fmt.Errorf("schedule window %q: %w", item, err)
+		}
+		end, err := parseTimeOfDay(to)
+		if err != nil {
+			return nil, fmt.Errorf("schedule window %q: %w", item, err)
+		}
+		r, err := strconv.ParseInt(strings.TrimSpace(rate), 10, 64)
+		if err != nil || r < 0 {
+			return nil, fmt.Errorf("schedule window %q: invalid rate", item)
+		}
+		windows = append(windows, Window{Start: start, End: end, Rate: r})
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	windows, err := ParseSchedule("08:00-18:00=1048576, 22:30-06:00=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 2 {
+		t.Fatalf("expected 2 windows, got %d", len(windows))
+	}
+	if windows[0].Start != 8*time.Hour || windows[0].End != 18*time.Hour || windows[0].Rate != 1048576 {
+		t.Errorf("unexpected first window: %+v", windows[0])
+	}
+	if windows[1].Start != 22*time.Hour+30*time.Minute || windows[1].Rate != 0 {
+		t.Errorf("unexpected second window: %+v", windows[1])
+	}
+	for _, bad := range []string{"08:00-18:00", "08:00=5", "8am-18:00=5", "08:00-18:00=-1"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Errorf("ParseSchedule(%q) should fail", bad)
+		}
+	}
+}
+
+func TestRateSchedule(t *testing.T) {
+	windows, _ := ParseSchedule("08:00-18:00=100,22:00-06:00=0")
+	l := New(1000, windows)
+	day := func(h int) time.Time { return time.Date(2025, 5, 27, h, 0, 0, 0, time.Local) }
+	cases := map[int]int64{9: 100, 18: 1000, 23: 0, 3: 0, 7: 1000}
+	for hour, want := range cases {
+		if got := l.Rate(day(hour)); got != want {
+			t.Errorf("Rate at %02d:00 = %d, want %d", hour, got, want)
+		}
+	}
+}
+
+func TestReserve(t *testing.T) {
+	now := time.Date(2025, 5, 27, 12, 0, 0, 0, time.Local)
+	l := New(100, nil)
+	l.now = func() time.Time { return now }
+	if wait := l.reserve(100); wait != 0 {
+		t.Errorf("first second worth of bytes should not wait, got %v", wait)
+	}
+	if wait := l.reserve(50); wait != 500*time.Millisecond {
+		t.Errorf("expected 500ms wait, got %v", wait)
+	}
+	// A concurrent caller queues behind the outstanding debt
+	if wait := l.reserve(100); wait != 1500*time.Millisecond {
+		t.Errorf("expected 1.5s wait, got %v", wait)
+	}
+	now = now.Add(10 * time.Second)
+	if wait := l.reserve(100); wait != 0 {
+		t.Errorf("bucket should refill up to one second of tokens, got %v", wait)
+	}
+}
+
+func TestWaitN_Unlimited(t *testing.T) {
+	l := New(0, nil)
+	if wait, err := l.WaitN(context.Background(), 1<<30); wait != 0 || err != nil {
+		t.Errorf("unlimited limiter should not wait, got %v, %v", wait, err)
+	}
+}
+
+func TestWaitN_Cancelled(t *testing.T) {
+	l := New(1, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.WaitN(ctx, 1)
+	if _, err := l.WaitN(ctx, 100); err == nil {
+		t.Error("WaitN should return the context error when cancelled")
+	}
+}
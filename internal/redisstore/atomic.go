@@ -0,0 +1,66 @@
+package redisstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// fenceCheckLua rejects the write if a lease newer than the caller's was issued. It expects
+// the fence counter in KEYS[#KEYS] and the caller's token in ARGV[#ARGV]; token 0 disables the check.
+const fenceCheckLua = `
+local token = tonumber(ARGV[#ARGV])
+if token > 0 and (tonumber(redis.call('GET', KEYS[#KEYS])) or 0) > token then
+	return redis.error_reply('FENCED stale lease token')
+end
+`
+
+// commitChunkLua marks a chunk uploaded and advances the stream progress in one step.
+// KEYS: chunk bitmap, progress, fence counter. ARGV: chunk index, fencing token.
+// Progress only moves forward, so it never falls behind the uploaded chunks.
+const commitChunkLua = fenceCheckLua + `
+redis.call('SETBIT', KEYS[1], ARGV[1], 1)
+local progress = tonumber(redis.call('GET', KEYS[2]))
+if not progress or progress < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[2], ARGV[1])
+end
+return 1
+`
+
+// completeStreamLua moves a finalizing stream to completed and applies the TTL to all of its keys in one step.
+// KEYS: status, chunk bitmap, progress, fence counter. ARGV: as for transitionCheckLua, then TTL in
+// seconds (0 for none) and fencing token.
+const completeStreamLua = fenceCheckLua + transitionCheckLua + `
+local ttl = tonumber(ARGV[5])
+if ttl > 0 then
+	redis.call('EXPIRE', KEYS[1], ttl)
+	redis.call('EXPIRE', KEYS[2], ttl)
+	redis.call('EXPIRE', KEYS[3], ttl)
+else
+	redis.call('PERSIST', KEYS[1])
+	redis.call('PERSIST', KEYS[2])
+	redis.call('PERSIST', KEYS[3])
+end
+return 1
+`
+
+var (
+	commitChunkScript    = redis.NewScript(commitChunkLua)
+	completeStreamScript = redis.NewScript(completeStreamLua)
+)
+
+// CommitChunk atomically sets the chunk's bit and advances the stream progress to chunkIdx.
+// If ctx carries a fencing token (see WithFenceToken) that is no longer current, it returns ErrLeaseLost.
+func (r *redisStore) CommitChunk(ctx context.Context, streamID string, chunkIdx int) error {
+	keys := []string{r.keys.Stream("chunk_bitmap:", streamID), r.keys.Stream("stream_progress:", streamID), r.keys.Stream("stream_fence:", streamID)}
+	return fencedErr(commitChunkScript.Run(ctx, r.client, keys, chunkIdx, FenceToken(ctx)).Err())
+}
+
+// CompleteStream atomically moves the stream from finalizing to completed and expires its status, chunk bitmap
+// and progress after ttl. It is fenced like CommitChunk, and returns ErrInvalidTransition if the stream is not finalizing.
+func (r *redisStore) CompleteStream(ctx context.Context, streamID string, ttl time.Duration) error {
+	keys := []string{r.keys.Stream("stream_status:", streamID), r.keys.Stream("chunk_bitmap:", streamID), r.keys.Stream("stream_progress:", streamID), r.keys.Stream("stream_fence:", streamID)}
+	err := completeStreamScript.Run(ctx, r.client, keys, string(StateCompleted), allowedFrom(StateCompleted), time.Now().UnixMilli(), "", int64(ttl/time.Second), FenceToken(ctx)).Err()
+	return transitionErr(fencedErr(err))
+}
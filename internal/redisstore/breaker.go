@@ -0,0 +1,71 @@
+package redisstore
+
+import (
+	"context"
+	"strings"
+	"time"
+	"video-stream-processor/internal/breaker"
+	"video-stream-processor/internal/config"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// NewWithBreaker is like New but routes every Redis command through a circuit breaker.
+// The breaker opens after cfg.BreakerThreshold consecutive command failures and probes Redis
+// with PING every cfg.BreakerProbeInterval seconds. The caller is expected to run the breaker.
+func NewWithBreaker(cfg *config.Config, log *zap.Logger) (Store, *breaker.Breaker) {
+	client, err := NewClient(cfg)
+	if err != nil {
+		log.Fatal("Failed to create Redis client", zap.Error(err))
+	}
+	probe := func(ctx context.Context) error { return client.Ping(ctx).Err() }
+	b := breaker.New("redis", cfg.BreakerThreshold, time.Duration(cfg.BreakerProbeInterval)*time.Second, probe, log)
+	client.AddHook(breakerHook{b: b})
+	return &redisStore{client: client, keys: NewKeys(cfg), log: log}, b
+}
+
+// breakerHook rejects commands while the breaker is open, holds them back behind a half-open trial
+// and records their outcome.
+// PING is always let through so the breaker can probe. redis.Nil, NOSCRIPT, FENCED and INVALID are normal replies, not failures.
+type breakerHook struct {
+	b *breaker.Breaker
+}
+
+func (h breakerHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if cmd.Name() == "ping" {
+		return ctx, nil
+	}
+	return ctx, h.b.Allow(ctx)
+}
+
+func (h breakerHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if cmd.Name() != "ping" {
+		h.record(cmd.Err())
+	}
+	return nil
+}
+
+func (h breakerHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, h.b.Allow(ctx)
+}
+
+func (h breakerHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			h.b.Record(err)
+			return nil
+		}
+	}
+	h.b.Record(nil)
+	return nil
+}
+
+func (h breakerHook) record(err error) {
+	if err == redis.Nil || (err != nil && (strings.HasPrefix(err.Error(), "NOSCRIPT ") || strings.HasPrefix(err.Error(), "FENCED ") || strings.HasPrefix(err.Error(), "INVALID "))) {
+		// NOSCRIPT only means a Lua script must be sent in full, and FENCED and INVALID are rejected
+		// stale writes and state transitions; Redis itself is fine
+		err = nil
+	}
+	h.b.Record(err)
+}
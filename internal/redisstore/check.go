@@ -0,0 +1,208 @@
+package redisstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+	"video-stream-processor/internal/config"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Problems reported by Checker.
+const (
+	ProblemCompletedWithoutTTL = "completed_without_ttl" // status is completed but never expires
+	ProblemBitmapWithoutTTL    = "bitmap_without_ttl"    // stream is completed but its chunk bitmap never expires
+	ProblemProgressBehind      = "progress_behind"       // progress is lower than the highest uploaded chunk
+	ProblemProgressAhead       = "progress_ahead"        // progress points at a chunk that is not uploaded
+)
+
+// Issue is an inconsistency between the checkpoint keys of one stream.
+type Issue struct {
+	StreamID string
+	Problem  string
+	Detail   string
+	Repaired bool
+}
+
+func (i Issue) String() string {
+	s := fmt.Sprintf("%s: %s (%s)", i.StreamID, i.Problem, i.Detail)
+	if i.Repaired {
+		s += " [repaired]"
+	}
+	return s
+}
+
+// Checker verifies that the status, chunk bitmap and progress keys of every stream agree,
+// and optionally repairs them. It is meant for operators, e.g. after a crash of an older
+// version that did not update checkpoints atomically.
+type Checker struct {
+	client RedisClient
+	keys   Keys
+	ttl    time.Duration // TTL given to completed streams that have none
+}
+
+// NewChecker returns a Checker for the configured Redis. Completed streams without a TTL are given ttl when repaired.
+func NewChecker(cfg *config.Config, ttl time.Duration) (*Checker, error) {
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Checker{client: client, keys: NewKeys(cfg), ttl: ttl}, nil
+}
+
+// checkpointState is the checkpoint state of one stream as read by the checker.
+type checkpointState struct {
+	status      string
+	statusTTL   time.Duration
+	bitmapTTL   time.Duration
+	hasBitmap   bool
+	uploaded    []int
+	progress    int
+	hasProgress bool
+}
+
+// Check inspects every stream with checkpoint keys and returns the inconsistencies found,
+// ordered by stream ID. With repair set, each issue is fixed and marked as repaired.
+func (c *Checker) Check(ctx context.Context, repair bool) ([]Issue, error) {
+	streams, err := c.streams(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var issues []Issue
+	for _, id := range streams {
+		st, err := c.load(ctx, id)
+		if err != nil {
+			return issues, fmt.Errorf("read stream %s: %w", id, err)
+		}
+		found, err := c.checkStream(ctx, id, st, repair)
+		issues = append(issues, found...)
+		if err != nil {
+			return issues, fmt.Errorf("repair stream %s: %w", id, err)
+		}
+	}
+	return issues, nil
+}
+
+// streams returns the IDs of all streams that have a status, bitmap or progress key.
+func (c *Checker) streams(ctx context.Context) ([]string, error) {
+	seen := map[string]bool{}
+	for _, prefix := range []string{"stream_status:", "chunk_bitmap:", "stream_progress:"} {
+		err := scanKeys(ctx, c.client, c.keys.Pattern(prefix), func(key string) error {
+			seen[c.keys.StreamID(prefix, key)] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (c *Checker) load(ctx context.Context, id string) (checkpointState, error) {
+	var st checkpointState
+	var err error
+	if st.status, err = c.client.HGet(ctx, c.keys.Stream("stream_status:", id), fieldState).Result(); err != nil && err != redis.Nil {
+		return st, err
+	}
+	if st.statusTTL, err = c.client.TTL(ctx, c.keys.Stream("stream_status:", id)).Result(); err != nil {
+		return st, err
+	}
+	bitmap, err := c.client.Get(ctx, c.keys.Stream("chunk_bitmap:", id)).Bytes()
+	switch {
+	case err == redis.Nil:
+	case err != nil:
+		return st, err
+	default:
+		st.hasBitmap = true
+		st.uploaded = setBits(bitmap)
+		if st.bitmapTTL, err = c.client.TTL(ctx, c.keys.Stream("chunk_bitmap:", id)).Result(); err != nil {
+			return st, err
+		}
+	}
+	st.progress, err = c.client.Get(ctx, c.keys.Stream("stream_progress:", id)).Int()
+	switch {
+	case err == redis.Nil:
+	case err != nil:
+		return st, err
+	default:
+		st.hasProgress = true
+	}
+	return st, nil
+}
+
+func (c *Checker) checkStream(ctx context.Context, id string, st checkpointState, repair bool) ([]Issue, error) {
+	var issues []Issue
+	// report records an issue and, when repairing, applies fix
+	report := func(problem, detail string, fix func() error) error {
+		issue := Issue{StreamID: id, Problem: problem, Detail: detail}
+		if repair {
+			if err := fix(); err != nil {
+				issues = append(issues, issue)
+				return err
+			}
+			issue.Repaired = true
+		}
+		issues = append(issues, issue)
+		return nil
+	}
+
+	// A TTL of -1 means the key exists but never expires
+	if st.status == string(StateCompleted) && st.statusTTL == -1 {
+		err := report(ProblemCompletedWithoutTTL, "status has no expiry", func() error {
+			return c.client.Expire(ctx, c.keys.Stream("stream_status:", id), c.ttl).Err()
+		})
+		if err != nil {
+			return issues, err
+		}
+	}
+	if st.status == string(StateCompleted) && st.hasBitmap && st.bitmapTTL == -1 {
+		ttl := c.ttl
+		if st.statusTTL > 0 {
+			ttl = st.statusTTL
+		}
+		err := report(ProblemBitmapWithoutTTL, "chunk bitmap has no expiry", func() error {
+			return c.client.Expire(ctx, c.keys.Stream("chunk_bitmap:", id), ttl).Err()
+		})
+		if err != nil {
+			return issues, err
+		}
+	}
+
+	last := -1
+	if n := len(st.uploaded); n > 0 {
+		last = st.uploaded[n-1]
+	}
+	setProgress := func() error {
+		if last < 0 {
+			return c.client.Del(ctx, c.keys.Stream("stream_progress:", id)).Err()
+		}
+		return c.client.Set(ctx, c.keys.Stream("stream_progress:", id), last, redis.KeepTTL).Err()
+	}
+	switch {
+	case last >= 0 && (!st.hasProgress || st.progress < last):
+		progress := "none"
+		if st.hasProgress {
+			progress = fmt.Sprint(st.progress)
+		}
+		if err := report(ProblemProgressBehind, fmt.Sprintf("progress %s, highest uploaded chunk %d", progress, last), setProgress); err != nil {
+			return issues, err
+		}
+	case st.hasProgress && (st.progress > last || !contains(st.uploaded, st.progress)):
+		if err := report(ProblemProgressAhead, fmt.Sprintf("progress %d, highest uploaded chunk %d", st.progress, last), setProgress); err != nil {
+			return issues, err
+		}
+	}
+	return issues, nil
+}
+
+func contains(sorted []int, v int) bool {
+	i := sort.SearchInts(sorted, v)
+	return i < len(sorted) && sorted[i] == v
+}
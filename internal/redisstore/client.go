@@ -0,0 +1,119 @@
+package redisstore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"video-stream-processor/internal/config"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Supported REDIS_MODE values.
+const (
+	ModeStandalone = "standalone"
+	ModeSentinel   = "sentinel"
+	ModeCluster    = "cluster"
+)
+
+// NewClient returns a Redis client for the configured deployment: a single server, a master
+// discovered through Sentinel, or a cluster. Packages that keep their own keys in Redis use it too.
+func NewClient(cfg *config.Config) (redis.UniversalClient, error) {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	addrs := strings.Split(cfg.RedisAddr, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	switch cfg.RedisMode {
+	case "", ModeStandalone:
+		return redis.NewClient(&redis.Options{
+			Addr:      addrs[0],
+			Username:  cfg.RedisUsername,
+			Password:  cfg.RedisPassword,
+			DB:        cfg.RedisDB,
+			TLSConfig: tlsConfig,
+		}), nil
+	case ModeSentinel:
+		if cfg.RedisSentinelMaster == "" || len(cfg.RedisSentinelAddrs) == 0 {
+			return nil, fmt.Errorf("sentinel mode requires REDIS_SENTINEL_MASTER and REDIS_SENTINEL_ADDRS")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       cfg.RedisSentinelMaster,
+			SentinelAddrs:    cfg.RedisSentinelAddrs,
+			SentinelPassword: cfg.RedisSentinelPass,
+			Username:         cfg.RedisUsername,
+			Password:         cfg.RedisPassword,
+			DB:               cfg.RedisDB,
+			TLSConfig:        tlsConfig,
+		}), nil
+	case ModeCluster:
+		if cfg.RedisDB != 0 {
+			return nil, fmt.Errorf("redis cluster only supports database 0, got REDIS_DB=%d", cfg.RedisDB)
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:     addrs,
+			Username:  cfg.RedisUsername,
+			Password:  cfg.RedisPassword,
+			TLSConfig: tlsConfig,
+		}), nil
+	}
+	return nil, fmt.Errorf("unknown redis mode %q", cfg.RedisMode)
+}
+
+// newTLSConfig returns the TLS settings for Redis connections, or nil if TLS is disabled.
+func newTLSConfig(cfg *config.Config) (*tls.Config, error) {
+	if !cfg.RedisTLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.RedisTLSServerName}
+	if cfg.RedisTLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.RedisTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in redis CA file %s", cfg.RedisTLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.RedisTLSCertFile != "" || cfg.RedisTLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.RedisTLSCertFile, cfg.RedisTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load redis client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// scanner is the part of the Redis client scanKeys needs.
+type scanner interface {
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+}
+
+// scanKeys calls fn for every key matching pattern. On a cluster every master is scanned,
+// since SCAN only covers the node it is sent to.
+func scanKeys(ctx context.Context, client scanner, pattern string, fn func(key string) error) error {
+	scan := func(ctx context.Context, client scanner) error {
+		iter := client.Scan(ctx, 0, pattern, 0).Iterator()
+		for iter.Next(ctx) {
+			if err := fn(iter.Val()); err != nil {
+				return err
+			}
+		}
+		return iter.Err()
+	}
+	if cluster, ok := client.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scan(ctx, node)
+		})
+	}
+	return scan(ctx, client)
+}
@@ -0,0 +1,53 @@
+package redisstore
+
+import (
+	"strings"
+	"video-stream-processor/internal/config"
+)
+
+// Keys names the processor's Redis keys, e.g. "stream_status:<stream>". Every key starts with the
+// configured namespace (REDIS_KEY_PREFIX), so deployments sharing a Redis do not collide. In cluster
+// mode the stream ID is wrapped in a hash tag ("stream_status:{<stream>}"), so all keys of a stream map
+// to one slot and can be used together in a Lua script. Code outside this package that reads or writes
+// the processor's keys directly must name them through Keys as well.
+type Keys struct {
+	namespace string
+	hashTag   bool
+}
+
+// NewKeys returns the key naming for the configured namespace and Redis deployment.
+func NewKeys(cfg *config.Config) Keys {
+	return Keys{namespace: cfg.RedisKeyPrefix, hashTag: cfg.RedisMode == ModeCluster}
+}
+
+// Name returns a key that is not tied to a stream, such as a backfill queue, in the namespace.
+func (k Keys) Name(key string) string {
+	return k.namespace + key
+}
+
+// Pattern returns a SCAN pattern matching the keys with the given prefix in the namespace.
+func (k Keys) Pattern(prefix string) string {
+	return escapePattern(k.namespace+prefix) + "*"
+}
+
+// Stream returns the key with the given prefix (e.g. "file_hash:") for a stream.
+func (k Keys) Stream(prefix, streamID string) string {
+	if k.hashTag {
+		return k.namespace + prefix + "{" + streamID + "}"
+	}
+	return k.namespace + prefix + streamID
+}
+
+// Replica returns the key of a stream's chunk bitmap on a replica destination.
+func (k Keys) Replica(dest, streamID string) string {
+	return k.Stream("replica_bitmap:"+dest+":", streamID)
+}
+
+// StreamID returns the stream ID of a key built by Stream with the given prefix.
+func (k Keys) StreamID(prefix, key string) string {
+	id := strings.TrimPrefix(key, k.namespace+prefix)
+	if k.hashTag && strings.HasPrefix(id, "{") && strings.HasSuffix(id, "}") {
+		id = id[1 : len(id)-1]
+	}
+	return id
+}
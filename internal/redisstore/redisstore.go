@@ -1,10 +1,19 @@
 // Package redisstore provides Redis-backed checkpointing and progress tracking for resumable uploads.
 // It is used to track chunk upload status, stream progress, and support recovery after interruptions.
+//
+// Uploaded chunks are tracked in one bitmap per stream ("chunk_bitmap:<stream>", bit N set once
+// chunk N is uploaded) that expires together with the stream status. Replica destinations keep their
+// own bitmaps ("replica_bitmap:<dest>:<stream>"). Per-chunk keys written by older versions are
+// converted by MigrateChunkKeys.
+//
+// The lifecycle of a stream is kept in a hash ("stream_status:<stream>") holding its state, attempt
+// count, last error and the time of each transition; see StreamState for the allowed transitions.
 package redisstore
 
 import (
 	"context"
-	"fmt"
+	"strconv"
+	"strings"
 	"time"
 	"video-stream-processor/internal/config"
 
@@ -12,93 +21,299 @@ import (
 	"go.uber.org/zap"
 )
 
+// ErrNotFound is returned when a key does not exist. It is redis.Nil, so every Store reports a missing key the same way.
+var ErrNotFound = redis.Nil
+
 type Store interface {
 	SetChunkUploaded(ctx context.Context, streamID string, chunkIdx int) error
 	IsChunkUploaded(ctx context.Context, streamID string, chunkIdx int) (bool, error)
 	SetStreamProgress(ctx context.Context, streamID string, chunkIdx int) error
 	GetStreamProgress(ctx context.Context, streamID string) (int, error)
-	SetStreamStatus(ctx context.Context, streamID, status string) error
+	// GetStreamStatus returns the current state of a stream; see GetStreamInfo for its full lifecycle record
 	GetStreamStatus(ctx context.Context, streamID string) (string, error)
+	// TransitionStream moves a stream through its lifecycle, returning ErrInvalidTransition for transitions
+	// the state machine does not allow (see StreamState), and ErrLeaseLost if ctx carries a stale fencing token
+	TransitionStream(ctx context.Context, streamID string, to StreamState, reason string) error
+	// ResetStream moves a cancelled stream back to detected; it is the only way out of cancelled
+	ResetStream(ctx context.Context, streamID string) error
+	GetStreamInfo(ctx context.Context, streamID string) (StreamInfo, error)
+	// SetStreamChunkSize records the chunk size the stream's checkpoints are written with (see StreamInfo.ChunkSize)
+	SetStreamChunkSize(ctx context.Context, streamID string, size int) error
+	// SetStreamKeyTime records the modification time the stream's object keys are rendered with (see StreamInfo.KeyTime)
+	SetStreamKeyTime(ctx context.Context, streamID string, t time.Time) error
 	SetStreamTTL(ctx context.Context, streamID string, ttl time.Duration) error
 	ScanIncompleteStreams(ctx context.Context) ([]string, error)
+	// Atomic checkpoint updates: a crash never leaves the bitmap, progress and status out of step
+	CommitChunk(ctx context.Context, streamID string, chunkIdx int) error
+	CompleteStream(ctx context.Context, streamID string, ttl time.Duration) error
+	// Per-destination checkpoints and backfill queues used by the replicating uploader
+	SetReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) error
+	IsReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) (bool, error)
+	PushBackfill(ctx context.Context, dest, entry string) error
+	PopBackfill(ctx context.Context, dest string) (string, error)
+	// Leases give one instance at a time ownership of a stream; see WithFenceToken for fencing checkpoint writes
+	AcquireLease(ctx context.Context, streamID, owner string, ttl time.Duration) (int64, error)
+	RenewLease(ctx context.Context, streamID string, token int64, ttl time.Duration) error
+	ReleaseLease(ctx context.Context, streamID string, token int64) error
+	// UploadedChunks returns the indexes of all uploaded chunks of a stream in one round trip
+	UploadedChunks(ctx context.Context, streamID string) ([]int, error)
+	// ClearChunks clears the checkpoints of chunks fromIdx and up, on the primary and every replica; 0 clears them all
+	ClearChunks(ctx context.Context, streamID string, fromIdx int) error
+	// MigrateChunkKeys converts per-chunk checkpoint keys of older versions into bitmaps
+	MigrateChunkKeys(ctx context.Context) (int, error)
+	// MigrateStatusKeys converts the plain string statuses of older versions into status hashes
+	MigrateStatusKeys(ctx context.Context) (int, error)
 	// Generic key-value helpers for file hash/status logic
 	GetValue(ctx context.Context, key string) (string, error)
 	SetValue(ctx context.Context, key, value string, ttl time.Duration) error
+	// SetValueNX sets key only if it does not exist and reports whether it was set
+	SetValueNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
 	DeleteKey(ctx context.Context, key string) error
 }
 
 type RedisClient interface {
 	Set(ctx context.Context, key string, value any, expiration time.Duration) *redis.StatusCmd
+	SetNX(ctx context.Context, key string, value any, expiration time.Duration) *redis.BoolCmd
 	Get(ctx context.Context, key string) *redis.StringCmd
 	Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
 	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
 	Del(ctx context.Context, keys ...string) *redis.IntCmd
+	RPush(ctx context.Context, key string, values ...any) *redis.IntCmd
+	LPop(ctx context.Context, key string) *redis.StringCmd
+	SetBit(ctx context.Context, key string, offset int64, value int) *redis.IntCmd
+	GetBit(ctx context.Context, key string, offset int64) *redis.IntCmd
+	TTL(ctx context.Context, key string) *redis.DurationCmd
+	PTTL(ctx context.Context, key string) *redis.DurationCmd
+	PExpire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd
+	HGet(ctx context.Context, key, field string) *redis.StringCmd
+	HGetAll(ctx context.Context, key string) *redis.StringStringMapCmd
+	HSet(ctx context.Context, key string, values ...any) *redis.IntCmd
+	redis.Scripter
 }
 
+// replicaChunkTTL bounds the lifetime of replica bitmaps, which have no stream status to share a TTL with.
+// A destination that is down for longer simply receives the missing chunks again.
+const replicaChunkTTL = 7 * 24 * time.Hour
+
+// completedStreamTTL is how long a completed stream's status and chunk bitmap are kept.
+const completedStreamTTL = 7 * 24 * time.Hour
+
 type redisStore struct {
 	client RedisClient
+	keys   Keys
 	log    *zap.Logger
 }
 
 func New(cfg *config.Config, log *zap.Logger) Store {
-	client := redis.NewClient(&redis.Options{
-		Addr:     cfg.RedisAddr,
-		Password: cfg.RedisPassword,
-		DB:       cfg.RedisDB,
-	})
-	return &redisStore{client: client, log: log}
+	client, err := NewClient(cfg)
+	if err != nil {
+		log.Fatal("Failed to create Redis client", zap.Error(err))
+	}
+	return &redisStore{client: client, keys: NewKeys(cfg), log: log}
 }
 
 func (r *redisStore) SetChunkUploaded(ctx context.Context, streamID string, chunkIdx int) error {
-	key := "chunk_uploaded:" + streamID + ":" + itoa(chunkIdx)
-	return r.client.Set(ctx, key, true, 0).Err()
+	return r.client.SetBit(ctx, r.keys.Stream("chunk_bitmap:", streamID), int64(chunkIdx), 1).Err()
 }
 
 func (r *redisStore) IsChunkUploaded(ctx context.Context, streamID string, chunkIdx int) (bool, error) {
-	key := "chunk_uploaded:" + streamID + ":" + itoa(chunkIdx)
-	res, err := r.client.Get(ctx, key).Result()
+	bit, err := r.client.GetBit(ctx, r.keys.Stream("chunk_bitmap:", streamID), int64(chunkIdx)).Result()
+	return bit == 1, err
+}
+
+func (r *redisStore) UploadedChunks(ctx context.Context, streamID string) ([]int, error) {
+	bitmap, err := r.client.Get(ctx, r.keys.Stream("chunk_bitmap:", streamID)).Bytes()
 	if err == redis.Nil {
-		return false, nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return setBits(bitmap), nil
+}
+
+func (r *redisStore) ClearChunks(ctx context.Context, streamID string, fromIdx int) error {
+	keys := []string{r.keys.Stream("chunk_bitmap:", streamID)}
+	pattern := r.keys.Pattern("replica_bitmap:") + ":" + escapePattern(strings.TrimPrefix(keys[0], r.keys.Name("chunk_bitmap:")))
+	err := scanKeys(ctx, r.client, pattern, func(key string) error {
+		// The wildcard may match a destination name followed by a longer stream ID
+		if strings.Count(key, ":") == strings.Count(keys[0], ":")+1 {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if fromIdx <= 0 {
+		return r.client.Del(ctx, keys...).Err()
+	}
+	for _, key := range keys {
+		bitmap, err := r.client.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, idx := range setBits(bitmap) {
+			if idx < fromIdx {
+				continue
+			}
+			if err := r.client.SetBit(ctx, key, int64(idx), 0).Err(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MigrateChunkKeys moves "chunk_uploaded:<stream>:<idx>" and "replica_chunk:<dest>:<stream>:<idx>"
+// keys into the matching bitmaps and deletes them. It returns the number of keys migrated.
+// The old keys never had a TTL, so a chunk bitmap takes the TTL of its stream's status (see bitmapTTL);
+// replica bitmaps expire after replicaChunkTTL, as when they are written. Bitmaps already expiring later
+// keep their expiry.
+func (r *redisStore) MigrateChunkKeys(ctx context.Context) (int, error) {
+	migrated := 0
+	for _, prefix := range []string{"chunk_uploaded:", "replica_chunk:"} {
+		bitmaps := map[string]string{} // Bitmap key -> stream ID
+		err := scanKeys(ctx, r.client, r.keys.Pattern(prefix), func(key string) error {
+			i := strings.LastIndexByte(key, ':')
+			start := len(r.keys.Name(prefix))
+			idx, err := strconv.Atoi(key[i+1:])
+			if err != nil || i < start {
+				return nil
+			}
+			streamID := key[start:i]
+			bitmapKey := r.keys.Stream("chunk_bitmap:", streamID)
+			if prefix == "replica_chunk:" {
+				var dest string
+				dest, streamID, _ = strings.Cut(streamID, ":")
+				bitmapKey = r.keys.Replica(dest, streamID)
+			}
+			bitmaps[bitmapKey] = streamID
+			if err := r.client.SetBit(ctx, bitmapKey, int64(idx), 1).Err(); err != nil {
+				return err
+			}
+			if err := r.client.Del(ctx, key).Err(); err != nil {
+				return err
+			}
+			migrated++
+			return nil
+		})
+		// Expire the bitmaps written so far even if the scan failed, so none of them is left without a TTL
+		for bitmapKey, streamID := range bitmaps {
+			ttl := replicaChunkTTL
+			if prefix == "chunk_uploaded:" {
+				var ttlErr error
+				if ttl, ttlErr = r.bitmapTTL(ctx, streamID); ttlErr != nil {
+					if err == nil {
+						err = ttlErr
+					}
+					continue
+				}
+			}
+			if expErr := r.expireBitmap(ctx, bitmapKey, ttl); expErr != nil && err == nil {
+				err = expErr
+			}
+		}
+		if err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// bitmapTTL returns the TTL a migrated chunk bitmap shares with its stream: the remaining TTL of the
+// stream status, or completedStreamTTL if the stream is completed or gone without one. Streams still in
+// progress have no TTL yet; CompleteStream expires status and bitmap together. 0 means no TTL.
+func (r *redisStore) bitmapTTL(ctx context.Context, streamID string) (time.Duration, error) {
+	key := r.keys.Stream("stream_status:", streamID)
+	ttl, err := r.client.PTTL(ctx, key).Result()
+	if err != nil || ttl > 0 {
+		return ttl, err
+	}
+	state, err := r.client.HGet(ctx, key, fieldState).Result()
+	if err == redis.Nil || (err == nil && StreamState(state) == StateCompleted) {
+		return completedStreamTTL, nil
 	}
-	return res == "1" || res == "true", err
+	return 0, err
+}
+
+// expireBitmap makes a migrated bitmap expire after ttl unless it already expires later.
+func (r *redisStore) expireBitmap(ctx context.Context, key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return nil // The stream does not expire yet
+	}
+	current, err := r.client.PTTL(ctx, key).Result()
+	if err != nil || current >= ttl {
+		return err
+	}
+	return r.client.PExpire(ctx, key, ttl).Err()
 }
 
 func (r *redisStore) SetStreamProgress(ctx context.Context, streamID string, chunkIdx int) error {
-	key := "stream_progress:" + streamID
+	key := r.keys.Stream("stream_progress:", streamID)
 	return r.client.Set(ctx, key, chunkIdx, 0).Err()
 }
 
 func (r *redisStore) GetStreamProgress(ctx context.Context, streamID string) (int, error) {
-	key := "stream_progress:" + streamID
+	key := r.keys.Stream("stream_progress:", streamID)
 	return r.client.Get(ctx, key).Int()
 }
 
-func (r *redisStore) SetStreamStatus(ctx context.Context, streamID, status string) error {
-	key := "stream_status:" + streamID
-	return r.client.Set(ctx, key, status, 0).Err()
-}
-
 func (r *redisStore) GetStreamStatus(ctx context.Context, streamID string) (string, error) {
-	key := "stream_status:" + streamID
-	return r.client.Get(ctx, key).Result()
+	key := r.keys.Stream("stream_status:", streamID)
+	return r.client.HGet(ctx, key, fieldState).Result()
 }
 
+// SetStreamTTL expires the stream status together with the stream's chunk bitmap.
 func (r *redisStore) SetStreamTTL(ctx context.Context, streamID string, ttl time.Duration) error {
-	key := "stream_status:" + streamID
+	if err := r.client.Expire(ctx, r.keys.Stream("chunk_bitmap:", streamID), ttl).Err(); err != nil {
+		return err
+	}
+	key := r.keys.Stream("stream_status:", streamID)
 	return r.client.Expire(ctx, key, ttl).Err()
 }
 
+// ScanIncompleteStreams returns the streams whose state is not terminal: not completed, cancelled or orphaned.
 func (r *redisStore) ScanIncompleteStreams(ctx context.Context) ([]string, error) {
 	var streams []string
-	iter := r.client.Scan(ctx, 0, "stream_status:*", 0).Iterator()
-	for iter.Next(ctx) {
-		key := iter.Val()
-		status, err := r.client.Get(ctx, key).Result()
-		if err == nil && status != "completed" {
-			streams = append(streams, key[len("stream_status:"):])
+	err := scanKeys(ctx, r.client, r.keys.Pattern("stream_status:"), func(key string) error {
+		state, err := r.client.HGet(ctx, key, fieldState).Result()
+		if err == nil && !StreamState(state).Terminal() {
+			streams = append(streams, r.keys.StreamID("stream_status:", key))
 		}
+		return nil
+	})
+	return streams, err
+}
+
+func (r *redisStore) SetReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) error {
+	key := r.keys.Replica(dest, streamID)
+	if err := r.client.SetBit(ctx, key, int64(chunkIdx), 1).Err(); err != nil {
+		return err
 	}
-	return streams, iter.Err()
+	return r.client.Expire(ctx, key, replicaChunkTTL).Err()
+}
+
+func (r *redisStore) IsReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) (bool, error) {
+	bit, err := r.client.GetBit(ctx, r.keys.Replica(dest, streamID), int64(chunkIdx)).Result()
+	return bit == 1, err
+}
+
+// PushBackfill queues an entry for a destination that missed an upload.
+func (r *redisStore) PushBackfill(ctx context.Context, dest, entry string) error {
+	return r.client.RPush(ctx, r.keys.Name("replica_backfill:"+dest), entry).Err()
+}
+
+// PopBackfill returns the oldest queued entry for dest, or "" if the queue is empty.
+func (r *redisStore) PopBackfill(ctx context.Context, dest string) (string, error) {
+	entry, err := r.client.LPop(ctx, r.keys.Name("replica_backfill:"+dest)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return entry, err
 }
 
 func (r *redisStore) GetValue(ctx context.Context, key string) (string, error) {
@@ -109,10 +324,37 @@ func (r *redisStore) SetValue(ctx context.Context, key, value string, ttl time.D
 	return r.client.Set(ctx, key, value, ttl).Err()
 }
 
+func (r *redisStore) SetValueNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return r.client.SetNX(ctx, key, value, ttl).Result()
+}
+
 func (r *redisStore) DeleteKey(ctx context.Context, key string) error {
 	return r.client.Del(ctx, key).Err()
 }
 
-func itoa(i int) string {
-	return fmt.Sprintf("%05d", i)
+// escapePattern escapes the glob characters SCAN MATCH interprets.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// setBits returns the offsets of the set bits of a Redis bitmap. Redis numbers bits from the
+// most significant bit of the first byte.
+func setBits(bitmap []byte) []int {
+	var idx []int
+	for i, b := range bitmap {
+		for j := 0; j < 8; j++ {
+			if b&(0x80>>j) != 0 {
+				idx = append(idx, i*8+j)
+			}
+		}
+	}
+	return idx
 }
@@ -2,9 +2,18 @@ package redisstore
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+	"video-stream-processor/internal/breaker"
+	"video-stream-processor/internal/config"
 
 	"github.com/go-redis/redis/v8"
 	"go.uber.org/zap"
@@ -22,6 +31,11 @@ type mockRedisClient struct {
 	expireKeys []string
 	delKeys    []string
 	scanKeys   []string
+	lists      map[string][]string
+	bitmaps    map[string][]byte
+	hashes     map[string]map[string]string
+	ttls       map[string]time.Duration
+	evals      int
 }
 
 func (m *mockRedisClient) Set(ctx context.Context, key string, value any, expiration time.Duration) *redis.StatusCmd {
@@ -31,27 +45,280 @@ func (m *mockRedisClient) Set(ctx context.Context, key string, value any, expira
 	}{key, value})
 	return &redis.StatusCmd{}
 }
+func (m *mockRedisClient) SetNX(ctx context.Context, key string, value any, expiration time.Duration) *redis.BoolCmd {
+	if _, ok := m.getMap[key]; ok {
+		return redis.NewBoolResult(false, nil)
+	}
+	if m.getMap == nil {
+		m.getMap = map[string]struct {
+			val string
+			err error
+		}{}
+	}
+	m.getMap[key] = struct {
+		val string
+		err error
+	}{val: value.(string)}
+	return redis.NewBoolResult(true, nil)
+}
 func (m *mockRedisClient) Get(ctx context.Context, key string) *redis.StringCmd {
+	if b, ok := m.bitmaps[key]; ok {
+		return redis.NewStringResult(string(b), nil)
+	}
 	if v, ok := m.getMap[key]; ok {
 		return redis.NewStringResult(v.val, v.err)
 	}
 	return redis.NewStringResult("", nil)
 }
+func (m *mockRedisClient) HGet(ctx context.Context, key, field string) *redis.StringCmd {
+	if v, ok := m.hashes[key][field]; ok {
+		return redis.NewStringResult(v, nil)
+	}
+	return redis.NewStringResult("", redis.Nil)
+}
+func (m *mockRedisClient) HGetAll(ctx context.Context, key string) *redis.StringStringMapCmd {
+	return redis.NewStringStringMapResult(m.hashes[key], nil)
+}
+func (m *mockRedisClient) HSet(ctx context.Context, key string, values ...any) *redis.IntCmd {
+	if m.hashes == nil {
+		m.hashes = map[string]map[string]string{}
+	}
+	if m.hashes[key] == nil {
+		m.hashes[key] = map[string]string{}
+	}
+	for i := 0; i+1 < len(values); i += 2 {
+		m.hashes[key][fmt.Sprint(values[i])] = fmt.Sprint(values[i+1])
+	}
+	return redis.NewIntResult(int64(len(values)/2), nil)
+}
 func (m *mockRedisClient) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
 	m.expireKeys = append(m.expireKeys, key)
+	if m.ttls == nil {
+		m.ttls = map[string]time.Duration{}
+	}
+	m.ttls[key] = expiration
+	return redis.NewBoolResult(true, nil)
+}
+func (m *mockRedisClient) RenameNX(ctx context.Context, key, newkey string) *redis.BoolCmd {
+	for _, k := range m.scanKeys {
+		if k == newkey {
+			return redis.NewBoolResult(false, nil)
+		}
+	}
+	for i, k := range m.scanKeys {
+		if k == key {
+			m.scanKeys[i] = newkey
+		}
+	}
 	return redis.NewBoolResult(true, nil)
 }
 func (m *mockRedisClient) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
 	cmd := redis.NewScanCmd(ctx, nil)
-	cmd.SetVal(m.scanKeys, 0)
+	var keys []string
+	for _, k := range m.scanKeys {
+		if ok, _ := path.Match(match, k); ok {
+			keys = append(keys, k)
+		}
+	}
+	cmd.SetVal(keys, 0)
 	cmd.SetErr(nil)
 	return cmd
 }
 func (m *mockRedisClient) Del(ctx context.Context, keys ...string) *redis.IntCmd {
 	m.delKeys = append(m.delKeys, keys...)
+	for _, k := range keys {
+		delete(m.bitmaps, k)
+	}
 	return redis.NewIntResult(int64(len(keys)), nil)
 }
 
+func (m *mockRedisClient) RPush(ctx context.Context, key string, values ...any) *redis.IntCmd {
+	if m.lists == nil {
+		m.lists = map[string][]string{}
+	}
+	for _, v := range values {
+		m.lists[key] = append(m.lists[key], v.(string))
+	}
+	return redis.NewIntResult(int64(len(m.lists[key])), nil)
+}
+func (m *mockRedisClient) LPop(ctx context.Context, key string) *redis.StringCmd {
+	if len(m.lists[key]) == 0 {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	v := m.lists[key][0]
+	m.lists[key] = m.lists[key][1:]
+	return redis.NewStringResult(v, nil)
+}
+
+func (m *mockRedisClient) SetBit(ctx context.Context, key string, offset int64, value int) *redis.IntCmd {
+	if m.bitmaps == nil {
+		m.bitmaps = map[string][]byte{}
+	}
+	b := m.bitmaps[key]
+	for int64(len(b)) <= offset/8 {
+		b = append(b, 0)
+	}
+	mask := byte(0x80 >> (offset % 8))
+	old := b[offset/8] & mask
+	if value == 1 {
+		b[offset/8] |= mask
+	} else {
+		b[offset/8] &^= mask
+	}
+	m.bitmaps[key] = b
+	if old != 0 {
+		return redis.NewIntResult(1, nil)
+	}
+	return redis.NewIntResult(0, nil)
+}
+func (m *mockRedisClient) GetBit(ctx context.Context, key string, offset int64) *redis.IntCmd {
+	b := m.bitmaps[key]
+	if int64(len(b)) <= offset/8 || b[offset/8]&(0x80>>(offset%8)) == 0 {
+		return redis.NewIntResult(0, nil)
+	}
+	return redis.NewIntResult(1, nil)
+}
+
+func (m *mockRedisClient) TTL(ctx context.Context, key string) *redis.DurationCmd {
+	if ttl, ok := m.ttls[key]; ok {
+		return redis.NewDurationResult(ttl, nil)
+	}
+	if _, ok := m.bitmaps[key]; ok {
+		return redis.NewDurationResult(-1, nil)
+	}
+	if _, ok := m.hashes[key]; ok {
+		return redis.NewDurationResult(-1, nil)
+	}
+	if v, ok := m.getMap[key]; ok && v.err == nil {
+		return redis.NewDurationResult(-1, nil)
+	}
+	return redis.NewDurationResult(-2, nil)
+}
+
+func (m *mockRedisClient) PTTL(ctx context.Context, key string) *redis.DurationCmd {
+	return m.TTL(ctx, key)
+}
+func (m *mockRedisClient) PExpire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	return m.Expire(ctx, key, expiration)
+}
+
+// Eval emulates the package's Lua scripts on top of the mock's maps.
+func (m *mockRedisClient) Eval(ctx context.Context, script string, keys []string, args ...any) *redis.Cmd {
+	m.evals++
+	if m.getMap == nil {
+		m.getMap = map[string]struct {
+			val string
+			err error
+		}{}
+	}
+	set := func(key, val string) {
+		m.getMap[key] = struct {
+			val string
+			err error
+		}{val: val}
+	}
+	if m.hashes == nil {
+		m.hashes = map[string]map[string]string{}
+	}
+	// transition emulates transitionCheckLua
+	transition := func(key string, args []any) error {
+		from, ok := m.hashes[key]["state"]
+		if !ok {
+			from = "-"
+		}
+		to := args[0].(string)
+		if !strings.Contains(" "+args[1].(string)+" ", " "+from+" ") {
+			return errors.New("INVALID " + from + " -> " + to)
+		}
+		h := m.hashes[key]
+		if h == nil {
+			h = map[string]string{}
+			m.hashes[key] = h
+		}
+		now := strconv.FormatInt(args[2].(int64), 10)
+		h["state"], h["updated_at"], h[to+"_at"] = to, now, now
+		if reason := args[3].(string); reason != "" {
+			h["last_error"] = reason
+		}
+		if to == "uploading" {
+			n, _ := strconv.Atoi(h["attempts"])
+			h["attempts"] = strconv.Itoa(n + 1)
+		}
+		return nil
+	}
+	leaseToken := func(key string) string {
+		v := m.getMap[key].val
+		return v[strings.LastIndexByte(v, ':')+1:]
+	}
+	if script == commitChunkLua || script == completeStreamLua || script == transitionLua {
+		fence, _ := strconv.Atoi(m.getMap[keys[len(keys)-1]].val)
+		if token := args[len(args)-1].(int64); token > 0 && int64(fence) > token {
+			return redis.NewCmdResult(nil, errors.New("FENCED stale lease token"))
+		}
+	}
+	switch script {
+	case commitChunkLua:
+		idx := args[0].(int)
+		m.SetBit(ctx, keys[0], int64(idx), 1)
+		if cur, err := strconv.Atoi(m.getMap[keys[1]].val); err != nil || cur < idx {
+			set(keys[1], strconv.Itoa(idx))
+		}
+	case transitionLua:
+		if err := transition(keys[0], args); err != nil {
+			return redis.NewCmdResult(nil, err)
+		}
+		delete(m.ttls, keys[0])
+	case completeStreamLua:
+		if err := transition(keys[0], args); err != nil {
+			return redis.NewCmdResult(nil, err)
+		}
+		for _, k := range keys[:3] {
+			m.Expire(ctx, k, time.Duration(args[4].(int64))*time.Second)
+		}
+	case migrateStatusLua:
+		v, ok := m.getMap[keys[0]]
+		if !ok {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		delete(m.getMap, keys[0])
+		if v.val == "in_progress" {
+			v.val = "uploading"
+		}
+		m.hashes[keys[0]] = map[string]string{"state": v.val, "updated_at": strconv.FormatInt(args[0].(int64), 10)}
+	case acquireLeaseLua:
+		if _, held := m.getMap[keys[0]]; held {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		token, _ := strconv.Atoi(m.getMap[keys[1]].val)
+		token++
+		set(keys[1], strconv.Itoa(token))
+		set(keys[0], args[0].(string)+":"+strconv.Itoa(token))
+		return redis.NewCmdResult(int64(token), nil)
+	case renewLeaseLua:
+		if _, held := m.getMap[keys[0]]; !held || leaseToken(keys[0]) != strconv.FormatInt(args[0].(int64), 10) {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		m.Expire(ctx, keys[0], time.Duration(args[1].(int64))*time.Millisecond)
+	case releaseLeaseLua:
+		if _, held := m.getMap[keys[0]]; !held || leaseToken(keys[0]) != strconv.FormatInt(args[0].(int64), 10) {
+			return redis.NewCmdResult(int64(0), nil)
+		}
+		delete(m.getMap, keys[0])
+	default:
+		return redis.NewCmdResult(nil, errors.New("unknown script"))
+	}
+	return redis.NewCmdResult(int64(1), nil)
+}
+func (m *mockRedisClient) EvalSha(ctx context.Context, sha1 string, keys []string, args ...any) *redis.Cmd {
+	return redis.NewCmdResult(nil, errors.New("NOSCRIPT No matching script"))
+}
+func (m *mockRedisClient) ScriptExists(ctx context.Context, hashes ...string) *redis.BoolSliceCmd {
+	return redis.NewBoolSliceResult(make([]bool, len(hashes)), nil)
+}
+func (m *mockRedisClient) ScriptLoad(ctx context.Context, script string) *redis.StringCmd {
+	return redis.NewStringResult("", nil)
+}
+
 func TestSetAndGetChunkUploaded(t *testing.T) {
 	client := &mockRedisClient{getMap: map[string]struct {
 		val string
@@ -62,21 +329,16 @@ func TestSetAndGetChunkUploaded(t *testing.T) {
 	if err != nil {
 		t.Errorf("SetChunkUploaded failed: %v", err)
 	}
-	client.getMap["chunk_uploaded:stream1:00001"] = struct {
-		val string
-		err error
-	}{val: "1", err: nil}
+	if got := client.bitmaps["chunk_bitmap:stream1"]; len(got) != 1 || got[0] != 0x40 {
+		t.Errorf("unexpected bitmap %08b", got)
+	}
 	ok, err := rs.IsChunkUploaded(context.Background(), "stream1", 1)
 	if err != nil || !ok {
 		t.Errorf("IsChunkUploaded should return true, got %v, %v", ok, err)
 	}
-	client.getMap["chunk_uploaded:stream1:00001"] = struct {
-		val string
-		err error
-	}{val: "0", err: nil}
-	ok, _ = rs.IsChunkUploaded(context.Background(), "stream1", 1)
+	ok, _ = rs.IsChunkUploaded(context.Background(), "stream1", 2)
 	if ok {
-		t.Error("IsChunkUploaded should return false for 0")
+		t.Error("IsChunkUploaded should return false for an unset bit")
 	}
 }
 
@@ -100,23 +362,114 @@ func TestSetAndGetStreamProgress(t *testing.T) {
 	}
 }
 
-func TestSetAndGetStreamStatus(t *testing.T) {
-	client := &mockRedisClient{getMap: map[string]struct {
-		val string
-		err error
-	}{}}
+func TestCancelledStreamOnlyLeftByReset(t *testing.T) {
+	client := &mockRedisClient{}
 	rs := &redisStore{client: client, log: zap.NewNop()}
-	err := rs.SetStreamStatus(context.Background(), "stream1", "completed")
+	ctx := context.Background()
+	if err := rs.ResetStream(ctx, "s1"); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("a stream that is not cancelled should not be reset, got %v", err)
+	}
+	rs.TransitionStream(ctx, "s1", StateUploading, "")
+	if err := rs.TransitionStream(ctx, "s1", StateCancelled, "operator"); err != nil {
+		t.Fatalf("cancel failed: %v", err)
+	}
+	for _, to := range []StreamState{StateDetected, StateQueued, StateUploading} {
+		if err := rs.TransitionStream(ctx, "s1", to, ""); !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("a cancelled stream should not move to %s, got %v", to, err)
+		}
+	}
+	if err := rs.ResetStream(ctx, "s1"); err != nil {
+		t.Fatalf("ResetStream failed: %v", err)
+	}
+	if st, _ := rs.GetStreamStatus(ctx, "s1"); st != string(StateDetected) {
+		t.Errorf("reset stream should be detected, got %q", st)
+	}
+}
+
+func TestStreamTransitions(t *testing.T) {
+	client := &mockRedisClient{}
+	rs := &redisStore{client: client, log: zap.NewNop()}
+	ctx := context.Background()
+	if _, err := rs.GetStreamInfo(ctx, "s1"); err != ErrNotFound {
+		t.Errorf("stream without status should return ErrNotFound, got %v", err)
+	}
+	for _, step := range []struct {
+		to     StreamState
+		reason string
+		ok     bool
+	}{
+		{StateDetected, "", true},
+		{StateQueued, "", true},
+		{StateCompleted, "", false},
+		{StateUploading, "", true},
+		{StatePartial, "chunk 3 failed", true},
+		{StateFinalizing, "", false},
+		{StateUploading, "", true},
+		{StateFinalizing, "", true},
+		{"bogus", "", false},
+	} {
+		err := rs.TransitionStream(ctx, "s1", step.to, step.reason)
+		if step.ok && err != nil {
+			t.Fatalf("transition to %s failed: %v", step.to, err)
+		}
+		if !step.ok && !errors.Is(err, ErrInvalidTransition) {
+			t.Fatalf("transition to %s should be rejected, got %v", step.to, err)
+		}
+	}
+	if err := rs.CompleteStream(ctx, "s1", time.Hour); err != nil {
+		t.Fatalf("CompleteStream failed: %v", err)
+	}
+	if err := rs.TransitionStream(ctx, "s1", StateOrphaned, ""); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("completed stream should not become orphaned, got %v", err)
+	}
+	if st, _ := rs.GetStreamStatus(ctx, "s1"); st != "completed" {
+		t.Errorf("status should be completed, got %q", st)
+	}
+	info, err := rs.GetStreamInfo(ctx, "s1")
 	if err != nil {
-		t.Errorf("SetStreamStatus failed: %v", err)
+		t.Fatal(err)
 	}
-	client.getMap["stream_status:stream1"] = struct {
-		val string
-		err error
-	}{val: "completed", err: nil}
-	val, err := rs.GetStreamStatus(context.Background(), "stream1")
-	if err != nil || val != "completed" {
-		t.Errorf("GetStreamStatus should return completed, got %v, %v", val, err)
+	if info.State != StateCompleted || info.Attempts != 2 || info.LastError != "chunk 3 failed" || info.UpdatedAt.IsZero() {
+		t.Errorf("unexpected stream info %+v", info)
+	}
+	for _, st := range []StreamState{StateDetected, StateQueued, StateUploading, StatePartial, StateFinalizing, StateCompleted} {
+		if info.Transitions[st].IsZero() {
+			t.Errorf("missing transition time of %s", st)
+		}
+	}
+	if client.ttls["stream_status:s1"] != time.Hour {
+		t.Errorf("completed status should expire, got %v", client.ttls["stream_status:s1"])
+	}
+
+	// A new run clears the TTL again
+	rs.TransitionStream(ctx, "s1", StateUploading, "")
+	if _, ok := client.ttls["stream_status:s1"]; ok {
+		t.Error("status of a running stream should not expire")
+	}
+}
+
+func TestMigrateStatusKeys(t *testing.T) {
+	client := &mockRedisClient{
+		getMap: map[string]struct {
+			val string
+			err error
+		}{
+			"stream_status:a": {val: "in_progress"},
+			"stream_status:b": {val: "completed"},
+		},
+		hashes:   map[string]map[string]string{"stream_status:c": {"state": "queued"}},
+		scanKeys: []string{"stream_status:a", "stream_status:b", "stream_status:c"},
+	}
+	rs := &redisStore{client: client, log: zap.NewNop()}
+	ctx := context.Background()
+	n, err := rs.MigrateStatusKeys(ctx)
+	if err != nil || n != 2 {
+		t.Fatalf("MigrateStatusKeys = %d, %v", n, err)
+	}
+	for id, want := range map[string]string{"a": "uploading", "b": "completed", "c": "queued"} {
+		if st, _ := rs.GetStreamStatus(ctx, id); st != want {
+			t.Errorf("%s: expected %s, got %q", id, want, st)
+		}
 	}
 }
 
@@ -130,16 +483,18 @@ func TestSetStreamTTL(t *testing.T) {
 	if err != nil {
 		t.Errorf("SetStreamTTL failed: %v", err)
 	}
+	if len(client.expireKeys) != 2 || client.expireKeys[0] != "chunk_bitmap:stream1" {
+		t.Errorf("chunk bitmap should share the stream TTL, expired %v", client.expireKeys)
+	}
 }
 
 func TestScanIncompleteStreams(t *testing.T) {
-	client := &mockRedisClient{getMap: map[string]struct {
-		val string
-		err error
-	}{
-		"stream_status:foo": {val: "in_progress", err: nil},
-		"stream_status:bar": {val: "completed", err: nil},
-	}, scanKeys: []string{"stream_status:foo", "stream_status:bar"}}
+	client := &mockRedisClient{hashes: map[string]map[string]string{
+		"stream_status:foo": {"state": "uploading"},
+		"stream_status:bar": {"state": "completed"},
+		"stream_status:baz": {"state": "orphaned"},
+		"stream_status:qux": {"state": "cancelled"},
+	}, scanKeys: []string{"stream_status:foo", "stream_status:bar", "stream_status:baz", "stream_status:qux"}}
 	rs := &redisStore{client: client, log: zap.NewNop()}
 	streams, err := rs.ScanIncompleteStreams(context.Background())
 	if err != nil {
@@ -179,12 +534,16 @@ func TestIsChunkUploadedNil(t *testing.T) {
 		val string
 		err error
 	}{
-		"chunk_uploaded:stream1:00001": {val: "", err: redis.Nil},
+		"chunk_bitmap:stream1": {val: "", err: redis.Nil},
 	}}
 	rs := &redisStore{client: client, log: zap.NewNop()}
 	ok, err := rs.IsChunkUploaded(context.Background(), "stream1", 1)
 	if err != nil || ok {
-		t.Errorf("IsChunkUploaded should return false for redis.Nil, got %v, %v", ok, err)
+		t.Errorf("IsChunkUploaded should return false for a missing bitmap, got %v, %v", ok, err)
+	}
+	idx, err := rs.UploadedChunks(context.Background(), "stream1")
+	if err != nil || len(idx) != 0 {
+		t.Errorf("UploadedChunks should be empty for a missing bitmap, got %v, %v", idx, err)
 	}
 }
 
@@ -201,3 +560,426 @@ func TestGetStreamProgressError(t *testing.T) {
 		t.Error("GetStreamProgress should return error")
 	}
 }
+
+func TestReplicaChunkUploaded(t *testing.T) {
+	client := &mockRedisClient{getMap: map[string]struct {
+		val string
+		err error
+	}{}}
+	rs := &redisStore{client: client, log: zap.NewNop()}
+	if err := rs.SetReplicaChunkUploaded(context.Background(), "dr", "stream1", 3); err != nil {
+		t.Errorf("SetReplicaChunkUploaded failed: %v", err)
+	}
+	if _, ok := client.bitmaps["replica_bitmap:dr:stream1"]; !ok || len(client.expireKeys) != 1 {
+		t.Errorf("replica bitmap should be set with a TTL: %v %v", client.bitmaps, client.expireKeys)
+	}
+	if ok, err := rs.IsReplicaChunkUploaded(context.Background(), "dr", "stream1", 3); err != nil || !ok {
+		t.Errorf("IsReplicaChunkUploaded should return true, got %v, %v", ok, err)
+	}
+	if ok, err := rs.IsReplicaChunkUploaded(context.Background(), "primary", "stream1", 3); err != nil || ok {
+		t.Errorf("IsReplicaChunkUploaded should be false for another destination, got %v, %v", ok, err)
+	}
+}
+
+func TestBackfillQueue(t *testing.T) {
+	client := &mockRedisClient{}
+	rs := &redisStore{client: client, log: zap.NewNop()}
+	rs.PushBackfill(context.Background(), "dr", "a")
+	rs.PushBackfill(context.Background(), "dr", "b")
+	for _, want := range []string{"a", "b", ""} {
+		got, err := rs.PopBackfill(context.Background(), "dr")
+		if err != nil || got != want {
+			t.Errorf("PopBackfill = %q, %v; want %q", got, err, want)
+		}
+	}
+}
+
+func TestBreakerHook(t *testing.T) {
+	b := breaker.New("redis", 2, time.Hour, nil, zap.NewNop())
+	h := breakerHook{b: b}
+	ctx := context.Background()
+	miss := redis.NewStringCmd(ctx, "get", "k")
+	miss.SetErr(redis.Nil)
+	h.AfterProcess(ctx, miss)
+	h.AfterProcess(ctx, miss)
+	if b.State() != breaker.Closed {
+		t.Fatal("redis.Nil should not count as a failure")
+	}
+	for i := 0; i < 2; i++ {
+		failed := redis.NewStringCmd(ctx, "get", "k")
+		failed.SetErr(errors.New("connection refused"))
+		h.AfterProcess(ctx, failed)
+	}
+	if b.State() != breaker.Open {
+		t.Fatal("breaker should open after consecutive command failures")
+	}
+	if _, err := h.BeforeProcess(ctx, redis.NewStringCmd(ctx, "get", "k")); !errors.Is(err, breaker.ErrOpen) {
+		t.Errorf("commands should be rejected while open, got %v", err)
+	}
+	if _, err := h.BeforeProcess(ctx, redis.NewStatusCmd(ctx, "ping")); err != nil {
+		t.Errorf("PING should pass through for probing, got %v", err)
+	}
+}
+
+func TestUploadedChunks(t *testing.T) {
+	client := &mockRedisClient{}
+	rs := &redisStore{client: client, log: zap.NewNop()}
+	for _, idx := range []int{0, 3, 9} {
+		rs.SetChunkUploaded(context.Background(), "s1", idx)
+	}
+	idx, err := rs.UploadedChunks(context.Background(), "s1")
+	if err != nil || len(idx) != 3 || idx[0] != 0 || idx[1] != 3 || idx[2] != 9 {
+		t.Errorf("UploadedChunks = %v, %v", idx, err)
+	}
+}
+
+func TestClearChunks(t *testing.T) {
+	client := &mockRedisClient{scanKeys: []string{"replica_bitmap:dr:s1", "replica_bitmap:dr:x:s1", "replica_bitmap:dr:s10"}}
+	rs := &redisStore{client: client, log: zap.NewNop()}
+	ctx := context.Background()
+	for _, idx := range []int{0, 1, 2} {
+		rs.SetChunkUploaded(ctx, "s1", idx)
+		rs.SetReplicaChunkUploaded(ctx, "dr", "s1", idx)
+	}
+	if err := rs.ClearChunks(ctx, "s1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if idx, _ := rs.UploadedChunks(ctx, "s1"); len(idx) != 1 || idx[0] != 0 {
+		t.Errorf("chunks 1 and up should be cleared, got %v", idx)
+	}
+	if ok, _ := rs.IsReplicaChunkUploaded(ctx, "dr", "s1", 2); ok {
+		t.Error("replica checkpoints should be cleared too")
+	}
+	if err := rs.ClearChunks(ctx, "s1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.delKeys) != 2 || client.delKeys[0] != "chunk_bitmap:s1" || client.delKeys[1] != "replica_bitmap:dr:s1" {
+		t.Errorf("unexpected deleted keys: %v", client.delKeys)
+	}
+	if got := escapePattern("a*b[1]"); got != `a\*b\[1\]` {
+		t.Errorf("unexpected escaped pattern %q", got)
+	}
+}
+
+func TestMigrateChunkKeys(t *testing.T) {
+	// The old per-chunk keys never had a TTL
+	client := &mockRedisClient{scanKeys: []string{
+		"chunk_uploaded:s1:00000",
+		"chunk_uploaded:s1:00002",
+		"chunk_uploaded:a:b:00001",
+		"chunk_uploaded:s2:00000",
+		"chunk_uploaded:gone:00000",
+		"replica_chunk:dr:s1:00002",
+		"stream_status:s1",
+	}}
+	client.hashes = map[string]map[string]string{
+		"stream_status:s1":  {fieldState: string(StateCompleted)},
+		"stream_status:a:b": {fieldState: string(StateUploading)},
+		"stream_status:s2":  {fieldState: string(StateCompleted)},
+	}
+	client.ttls = map[string]time.Duration{"stream_status:s2": 3 * time.Hour}
+	rs := &redisStore{client: client, log: zap.NewNop()}
+	ctx := context.Background()
+	n, err := rs.MigrateChunkKeys(ctx)
+	if err != nil || n != 6 {
+		t.Fatalf("MigrateChunkKeys = %d, %v", n, err)
+	}
+	if idx, _ := rs.UploadedChunks(ctx, "s1"); len(idx) != 2 || idx[1] != 2 {
+		t.Errorf("unexpected migrated chunks: %v", idx)
+	}
+	if ok, _ := rs.IsChunkUploaded(ctx, "a:b", 1); !ok {
+		t.Error("stream IDs containing ':' should be migrated")
+	}
+	if ok, _ := rs.IsReplicaChunkUploaded(ctx, "dr", "s1", 2); !ok {
+		t.Error("replica checkpoints should be migrated")
+	}
+	if len(client.delKeys) != 6 {
+		t.Errorf("migrated keys should be deleted, got %v", client.delKeys)
+	}
+	if ttl := client.ttls["chunk_bitmap:s1"]; ttl != completedStreamTTL {
+		t.Errorf("bitmap of a completed stream without a TTL should expire after %v, got %v", completedStreamTTL, ttl)
+	}
+	if ttl := client.ttls["chunk_bitmap:s2"]; ttl != 3*time.Hour {
+		t.Errorf("chunk bitmap should share its stream status TTL, got %v", ttl)
+	}
+	if ttl := client.ttls["chunk_bitmap:gone"]; ttl != completedStreamTTL {
+		t.Errorf("bitmap of a stream without status should expire after %v, got %v", completedStreamTTL, ttl)
+	}
+	if ttl, ok := client.ttls["chunk_bitmap:a:b"]; ok {
+		t.Errorf("bitmap of a stream in progress should not get a TTL before its status, got %v", ttl)
+	}
+	if ttl := client.ttls["replica_bitmap:dr:s1"]; ttl != replicaChunkTTL {
+		t.Errorf("replica bitmap should expire after %v, got %v", replicaChunkTTL, ttl)
+	}
+}
+
+func TestCommitChunkAndCompleteStream(t *testing.T) {
+	client := &mockRedisClient{}
+	rs := &redisStore{client: client, log: zap.NewNop()}
+	ctx := context.Background()
+	for _, idx := range []int{0, 2, 1} {
+		if err := rs.CommitChunk(ctx, "s1", idx); err != nil {
+			t.Fatalf("CommitChunk failed: %v", err)
+		}
+	}
+	if idx, _ := rs.UploadedChunks(ctx, "s1"); len(idx) != 3 {
+		t.Errorf("all chunks should be marked uploaded, got %v", idx)
+	}
+	if p, _ := rs.GetStreamProgress(ctx, "s1"); p != 2 {
+		t.Errorf("progress should only move forward, got %d", p)
+	}
+	if err := rs.CompleteStream(ctx, "s1", time.Hour); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("only a finalizing stream can be completed, got %v", err)
+	}
+	rs.TransitionStream(ctx, "s1", StateUploading, "")
+	rs.TransitionStream(ctx, "s1", StateFinalizing, "")
+	if err := rs.CompleteStream(ctx, "s1", time.Hour); err != nil {
+		t.Fatalf("CompleteStream failed: %v", err)
+	}
+	if st, _ := rs.GetStreamStatus(ctx, "s1"); st != "completed" {
+		t.Errorf("status should be completed, got %q", st)
+	}
+	for _, key := range []string{"stream_status:s1", "chunk_bitmap:s1", "stream_progress:s1"} {
+		if client.ttls[key] != time.Hour {
+			t.Errorf("%s should expire with the stream, got %v", key, client.ttls[key])
+		}
+	}
+	if client.evals != 7 {
+		t.Errorf("each update should be a single script call, got %d", client.evals)
+	}
+}
+
+func TestChecker(t *testing.T) {
+	client := &mockRedisClient{
+		getMap: map[string]struct {
+			val string
+			err error
+		}{
+			"stream_progress:done":   {val: "1"},
+			"stream_progress:behind": {val: "0"},
+			"stream_progress:ahead":  {val: "7"},
+		},
+		hashes:   map[string]map[string]string{"stream_status:done": {"state": "completed"}},
+		scanKeys: []string{"stream_status:done", "chunk_bitmap:done", "chunk_bitmap:behind", "stream_progress:behind", "chunk_bitmap:ahead", "stream_progress:ahead"},
+	}
+	client.SetBit(context.Background(), "chunk_bitmap:done", 0, 1)
+	client.SetBit(context.Background(), "chunk_bitmap:done", 1, 1)
+	client.SetBit(context.Background(), "chunk_bitmap:behind", 3, 1)
+	client.SetBit(context.Background(), "chunk_bitmap:ahead", 2, 1)
+	c := &Checker{client: client, ttl: 24 * time.Hour}
+
+	issues, err := c.Check(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, i := range issues {
+		got = append(got, i.StreamID+":"+i.Problem)
+	}
+	want := "ahead:progress_ahead,behind:progress_behind,done:completed_without_ttl,done:bitmap_without_ttl"
+	if strings.Join(got, ",") != want {
+		t.Errorf("unexpected issues:\n got %s\nwant %s", strings.Join(got, ","), want)
+	}
+	if len(client.setCalls) != 0 || len(client.expireKeys) != 0 {
+		t.Error("check without repair should not modify anything")
+	}
+
+	issues, err = c.Check(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range issues {
+		if !i.Repaired {
+			t.Errorf("issue not repaired: %s", i)
+		}
+	}
+	if client.ttls["stream_status:done"] != 24*time.Hour || len(client.setCalls) != 2 {
+		t.Errorf("unexpected repairs: ttls %v, sets %v", client.ttls, client.setCalls)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	client := &mockRedisClient{}
+	rs := &redisStore{client: client, log: zap.NewNop()}
+	ctx := context.Background()
+	token, err := rs.AcquireLease(ctx, "s1", "a", time.Minute)
+	if err != nil || token != 1 {
+		t.Fatalf("AcquireLease = %d, %v", token, err)
+	}
+	if _, err := rs.AcquireLease(ctx, "s1", "b", time.Minute); !errors.Is(err, ErrLeaseHeld) {
+		t.Errorf("second owner should get ErrLeaseHeld, got %v", err)
+	}
+	if err := rs.RenewLease(ctx, "s1", token, time.Minute); err != nil {
+		t.Errorf("owner should be able to renew, got %v", err)
+	}
+	if err := rs.RenewLease(ctx, "s1", token+1, time.Minute); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("renewing with a foreign token should fail, got %v", err)
+	}
+
+	// The lease expires without a release and another owner takes over
+	delete(client.getMap, "stream_lease:s1")
+	newToken, err := rs.AcquireLease(ctx, "s1", "b", time.Minute)
+	if err != nil || newToken != 2 {
+		t.Fatalf("takeover AcquireLease = %d, %v", newToken, err)
+	}
+	if err := rs.CommitChunk(WithFenceToken(ctx, token), "s1", 0); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("stale owner's commit should be fenced, got %v", err)
+	}
+	if err := rs.CompleteStream(WithFenceToken(ctx, token), "s1", time.Hour); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("stale owner's completion should be fenced, got %v", err)
+	}
+	if err := rs.TransitionStream(WithFenceToken(ctx, token), "s1", StatePartial, "stale"); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("stale owner's transition should be fenced, got %v", err)
+	}
+	if err := rs.TransitionStream(WithFenceToken(ctx, newToken), "s1", StateUploading, ""); err != nil {
+		t.Errorf("current owner's transition should succeed, got %v", err)
+	}
+	if err := rs.CommitChunk(WithFenceToken(ctx, newToken), "s1", 0); err != nil {
+		t.Errorf("current owner's commit should succeed, got %v", err)
+	}
+	if err := rs.RenewLease(ctx, "s1", token, time.Minute); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("stale owner should see the lease as lost, got %v", err)
+	}
+	rs.ReleaseLease(ctx, "s1", token)
+	if _, held := client.getMap["stream_lease:s1"]; !held {
+		t.Error("stale owner must not release the new owner's lease")
+	}
+	rs.ReleaseLease(ctx, "s1", newToken)
+	if _, held := client.getMap["stream_lease:s1"]; held {
+		t.Error("owner should be able to release its lease")
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     config.Config
+		client  any
+		wantErr bool
+	}{
+		{"standalone", config.Config{RedisAddr: "localhost:6379"}, &redis.Client{}, false},
+		{"sentinel", config.Config{RedisMode: ModeSentinel, RedisSentinelMaster: "mymaster", RedisSentinelAddrs: []string{"s1:26379"}}, &redis.Client{}, false},
+		{"sentinel without master", config.Config{RedisMode: ModeSentinel}, nil, true},
+		{"cluster", config.Config{RedisMode: ModeCluster, RedisAddr: "n1:6379,n2:6379"}, &redis.ClusterClient{}, false},
+		{"cluster with db", config.Config{RedisMode: ModeCluster, RedisAddr: "n1:6379", RedisDB: 1}, nil, true},
+		{"unknown mode", config.Config{RedisMode: "ring"}, nil, true},
+		{"missing CA file", config.Config{RedisAddr: "localhost:6379", RedisTLS: true, RedisTLSCAFile: "/nonexistent/ca.pem"}, nil, true},
+	}
+	for _, c := range cases {
+		client, err := NewClient(&c.cfg)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if gotType, wantType := fmt.Sprintf("%T", client), fmt.Sprintf("%T", c.client); gotType != wantType {
+			t.Errorf("%s: expected %s, got %s", c.name, wantType, gotType)
+		}
+		client.Close()
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	if tlsConfig, _ := newTLSConfig(&config.Config{}); tlsConfig != nil {
+		t.Error("TLS should be disabled by default")
+	}
+	tlsConfig, err := newTLSConfig(&config.Config{RedisTLS: true, RedisTLSServerName: "redis.internal"})
+	if err != nil || tlsConfig.ServerName != "redis.internal" || tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Errorf("unexpected TLS config %+v (%v)", tlsConfig, err)
+	}
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(ca, []byte("not a certificate"), 0600)
+	if _, err := newTLSConfig(&config.Config{RedisTLS: true, RedisTLSCAFile: ca}); err == nil {
+		t.Error("a CA file without certificates should be rejected")
+	}
+}
+
+func TestKeys_HashTag(t *testing.T) {
+	keys := NewKeys(&config.Config{RedisMode: ModeCluster})
+	if k := keys.Stream("stream_status:", "cam1.mp4"); k != "stream_status:{cam1.mp4}" {
+		t.Errorf("unexpected key %s", k)
+	}
+	if k := keys.Replica("dr", "cam1.mp4"); k != "replica_bitmap:dr:{cam1.mp4}" {
+		t.Errorf("unexpected replica key %s", k)
+	}
+	if id := keys.StreamID("stream_status:", "stream_status:{cam1.mp4}"); id != "cam1.mp4" {
+		t.Errorf("unexpected stream ID %s", id)
+	}
+	plain := NewKeys(&config.Config{})
+	if k := plain.Stream("stream_status:", "cam1.mp4"); k != "stream_status:cam1.mp4" {
+		t.Errorf("keys should not be tagged outside cluster mode, got %s", k)
+	}
+
+	// All keys a script touches share the tag, so they map to one cluster slot
+	client := &mockRedisClient{}
+	rs := &redisStore{client: client, keys: keys, log: zap.NewNop()}
+	ctx := context.Background()
+	rs.TransitionStream(ctx, "cam1.mp4", StateUploading, "")
+	rs.CommitChunk(ctx, "cam1.mp4", 0)
+	rs.TransitionStream(ctx, "cam1.mp4", StateFinalizing, "")
+	rs.CompleteStream(ctx, "cam1.mp4", time.Hour)
+	for _, key := range []string{"stream_status:{cam1.mp4}", "chunk_bitmap:{cam1.mp4}", "stream_progress:{cam1.mp4}"} {
+		if client.ttls[key] != time.Hour {
+			t.Errorf("%s should expire with the stream, got %v", key, client.ttls[key])
+		}
+	}
+	client.scanKeys = []string{"stream_status:{cam2.mp4}"}
+	client.hashes = map[string]map[string]string{"stream_status:{cam2.mp4}": {"state": "uploading"}}
+	if streams, _ := rs.ScanIncompleteStreams(ctx); len(streams) != 1 || streams[0] != "cam2.mp4" {
+		t.Errorf("expected cam2.mp4 as incomplete, got %v", streams)
+	}
+}
+
+func TestKeys_Namespace(t *testing.T) {
+	keys := NewKeys(&config.Config{RedisKeyPrefix: "tenant-a:"})
+	if k := keys.Stream("file_hash:", "cam1.mp4"); k != "tenant-a:file_hash:cam1.mp4" {
+		t.Errorf("unexpected key %s", k)
+	}
+	if id := keys.StreamID("stream_status:", "tenant-a:stream_status:cam1.mp4"); id != "cam1.mp4" {
+		t.Errorf("unexpected stream ID %s", id)
+	}
+
+	client := &mockRedisClient{scanKeys: []string{"tenant-a:stream_status:a", "tenant-b:stream_status:b", "stream_status:c"},
+		hashes: map[string]map[string]string{
+			"tenant-a:stream_status:a": {"state": "uploading"},
+			"tenant-b:stream_status:b": {"state": "uploading"},
+			"stream_status:c":          {"state": "uploading"},
+		}}
+	rs := &redisStore{client: client, keys: keys, log: zap.NewNop()}
+	if streams, _ := rs.ScanIncompleteStreams(context.Background()); len(streams) != 1 || streams[0] != "a" {
+		t.Errorf("only streams of the namespace should be returned, got %v", streams)
+	}
+}
+
+func TestRenamer(t *testing.T) {
+	client := &mockRedisClient{scanKeys: []string{
+		"stream_status:a", "chunk_bitmap:a", "file_hash:a", "vsp:files", "unrelated:key",
+		"file_hash:b", "tenant-a:file_hash:b", "tenant-b:stream_status:c",
+	}}
+	r := &Renamer{client: client, extra: []string{"vsp:files"}}
+	ctx := context.Background()
+
+	res, err := r.Rename(ctx, "", "tenant-a:", true)
+	if err != nil || len(res.Renamed) != 5 || client.scanKeys[0] != "stream_status:a" {
+		t.Fatalf("dry run should only list keys, got %+v (%v), keys %v", res, err, client.scanKeys)
+	}
+
+	res, err = r.Rename(ctx, "", "tenant-a:", false)
+	if err != nil {
+		t.Fatalf("Rename failed: %v", err)
+	}
+	if len(res.Renamed) != 4 || len(res.Conflicts) != 1 || res.Conflicts[0] != "file_hash:b" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	want := []string{
+		"tenant-a:stream_status:a", "tenant-a:chunk_bitmap:a", "tenant-a:file_hash:a", "tenant-a:vsp:files", "unrelated:key",
+		"file_hash:b", "tenant-a:file_hash:b", "tenant-b:stream_status:c",
+	}
+	for i, k := range want {
+		if client.scanKeys[i] != k {
+			t.Errorf("key %d: expected %s, got %s", i, k, client.scanKeys[i])
+		}
+	}
+}
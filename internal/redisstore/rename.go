@@ -0,0 +1,89 @@
+package redisstore
+
+import (
+	"context"
+	"strings"
+	"video-stream-processor/internal/config"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// keyPrefixes lists the prefixes of every key the processor writes, including the per-chunk keys of older versions.
+var keyPrefixes = []string{
+	"stream_status:", "stream_progress:", "chunk_bitmap:", "replica_bitmap:", "replica_backfill:",
+	"file_hash:", "stream_source:", "stream_version:", "stream_manifest:", "stream_lease:", "stream_fence:",
+	"stream_id:",
+	"chunk_uploaded:", "replica_chunk:",
+}
+
+// renameClient is the subset of the Redis client used by Renamer.
+type renameClient interface {
+	scanner
+	RenameNX(ctx context.Context, key, newkey string) *redis.BoolCmd
+}
+
+// Renamer moves the processor's keys from one namespace to another, e.g. from the unprefixed
+// keys of a deployment that predates REDIS_KEY_PREFIX into its new namespace. Processors using
+// either namespace should be stopped while it runs. Keys that already exist in the target
+// namespace are never overwritten; they are reported as conflicts and the old key is left in place.
+type Renamer struct {
+	client renameClient
+	extra  []string // Keys outside the known prefixes, e.g. the work queue stream
+}
+
+// RenameResult lists the keys handled by Rename, by their old name.
+type RenameResult struct {
+	Renamed   []string
+	Conflicts []string
+}
+
+// NewRenamer returns a Renamer for the configured Redis. The work queue stream cfg.QueueStream is renamed as well.
+func NewRenamer(cfg *config.Config) (*Renamer, error) {
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Renamer{client: client, extra: []string{cfg.QueueStream}}, nil
+}
+
+// Rename moves every key in namespace from to namespace to. With dryRun set, keys are only listed.
+// On a cluster, keys that are not tied to a stream (backfill queues, the queue stream) can only be
+// renamed if the old and new name hash to the same slot; Rename stops at the first one that does not.
+func (r *Renamer) Rename(ctx context.Context, from, to string, dryRun bool) (RenameResult, error) {
+	var res RenameResult
+	if from == to {
+		return res, nil
+	}
+	// Patterns are anchored at the start of the key, so renamed keys are never matched again
+	rename := func(key string) error {
+		newKey := to + strings.TrimPrefix(key, from)
+		if dryRun {
+			res.Renamed = append(res.Renamed, key)
+			return nil
+		}
+		ok, err := r.client.RenameNX(ctx, key, newKey).Result()
+		if err != nil {
+			return err
+		}
+		if ok {
+			res.Renamed = append(res.Renamed, key)
+		} else {
+			res.Conflicts = append(res.Conflicts, key)
+		}
+		return nil
+	}
+	for _, prefix := range keyPrefixes {
+		if err := scanKeys(ctx, r.client, escapePattern(from+prefix)+"*", rename); err != nil {
+			return res, err
+		}
+	}
+	for _, key := range r.extra {
+		if key == "" {
+			continue
+		}
+		if err := scanKeys(ctx, r.client, escapePattern(from+key), rename); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
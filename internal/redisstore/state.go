@@ -0,0 +1,285 @@
+package redisstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// StreamState is a stage of a stream's lifecycle.
+type StreamState string
+
+const (
+	StateDetected   StreamState = "detected"   // the watcher found a new or changed file
+	StateQueued     StreamState = "queued"     // the file is waiting for a worker
+	StateUploading  StreamState = "uploading"  // a worker is uploading chunks
+	StateFinalizing StreamState = "finalizing" // all chunks are uploaded, metadata is being written
+	StateCompleted  StreamState = "completed"
+	StateFailed     StreamState = "failed"    // the attempt failed before all chunks could be tried, or while finalizing
+	StatePartial    StreamState = "partial"   // some chunks failed to upload; the checkpoints allow resuming
+	StateCancelled  StreamState = "cancelled" // set by operators; the stream is not resumed
+	StateOrphaned   StreamState = "orphaned"  // the source file of an incomplete stream is gone
+)
+
+// ErrInvalidTransition is returned when a stream cannot move from its current state to the requested one.
+var ErrInvalidTransition = errors.New("invalid stream state transition")
+
+// transitions lists the states each state may be entered from. "" is a stream without a status.
+// Every state except completed and cancelled may be retried by uploading again, and a stream that is
+// not cancelled can always be queued again, e.g. when it is resumed at startup. A cancelled stream
+// is only left through ResetStream.
+var transitions = map[StreamState][]StreamState{
+	StateDetected:   {"", StateDetected, StateQueued, StatePartial, StateFailed, StateCompleted, StateOrphaned},
+	StateQueued:     {"", StateDetected, StateQueued, StateUploading, StateFinalizing, StatePartial, StateFailed, StateCompleted, StateOrphaned},
+	StateUploading:  {"", StateDetected, StateQueued, StateUploading, StateFinalizing, StatePartial, StateFailed, StateCompleted, StateOrphaned},
+	StateFinalizing: {StateUploading},
+	StateCompleted:  {StateFinalizing},
+	StateFailed:     {StateUploading, StateFinalizing},
+	StatePartial:    {StateUploading, StateFinalizing},
+	StateCancelled:  {StateDetected, StateQueued, StateUploading, StateFinalizing, StatePartial, StateFailed},
+	StateOrphaned:   {StateDetected, StateQueued, StateUploading, StateFinalizing, StatePartial, StateFailed},
+}
+
+// CanTransition reports whether a stream in state from may move to state to.
+func CanTransition(from, to StreamState) bool {
+	for _, s := range transitions[to] {
+		if s == from {
+			return true
+		}
+	}
+	return false
+}
+
+// Terminal reports whether a stream in state s is not resumed at startup.
+func (s StreamState) Terminal() bool {
+	return s == StateCompleted || s == StateCancelled || s == StateOrphaned
+}
+
+// StreamInfo is the lifecycle record of a stream.
+type StreamInfo struct {
+	State       StreamState
+	Attempts    int                       // Number of times the stream entered uploading
+	LastError   string                    // Reason given for the last failed or partial attempt
+	UpdatedAt   time.Time                 // Time of the last transition
+	Transitions map[StreamState]time.Time // Time each state was last entered
+	ChunkSize   int                       // Chunk size the stream's checkpoints were written with, 0 if not recorded
+	KeyTime     time.Time                 // Modification time the stream's object keys are rendered with, zero if not recorded
+}
+
+// Fields of the stream status hash. Transition times are stored as "<state>_at", in Unix milliseconds.
+const (
+	fieldState     = "state"
+	fieldAttempts  = "attempts"
+	fieldLastError = "last_error"
+	fieldUpdatedAt = "updated_at"
+	fieldChunkSize = "chunk_size"
+	fieldKeyTime   = "key_time"
+)
+
+// ParseStreamInfo builds a StreamInfo from the fields of a stream status hash.
+func ParseStreamInfo(fields map[string]string) StreamInfo {
+	info := StreamInfo{
+		State:       StreamState(fields[fieldState]),
+		LastError:   fields[fieldLastError],
+		Transitions: map[StreamState]time.Time{},
+	}
+	info.Attempts, _ = strconv.Atoi(fields[fieldAttempts])
+	info.ChunkSize, _ = strconv.Atoi(fields[fieldChunkSize])
+	if ms, err := strconv.ParseInt(fields[fieldKeyTime], 10, 64); err == nil {
+		info.KeyTime = time.UnixMilli(ms)
+	}
+	for field, v := range fields {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		if field == fieldUpdatedAt {
+			info.UpdatedAt = time.UnixMilli(ms)
+		} else if state, ok := strings.CutSuffix(field, "_at"); ok {
+			info.Transitions[StreamState(state)] = time.UnixMilli(ms)
+		}
+	}
+	return info
+}
+
+// ApplyTransition moves the fields of a stream status hash to state `to` the way the Redis scripts do,
+// for stores that keep the hash elsewhere. It returns ErrInvalidTransition if the transition is not allowed.
+func ApplyTransition(fields map[string]string, to StreamState, reason string, now time.Time) error {
+	from := StreamState(fields[fieldState])
+	if !CanTransition(from, to) {
+		if from == "" {
+			from = "-"
+		}
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+	applyState(fields, to, reason, now)
+	return nil
+}
+
+// ApplyReset moves the fields of a cancelled stream's status hash back to detected, like ResetStream.
+// It returns ErrInvalidTransition if the stream is not cancelled.
+func ApplyReset(fields map[string]string, now time.Time) error {
+	if from := StreamState(fields[fieldState]); from != StateCancelled {
+		if from == "" {
+			from = "-"
+		}
+		return fmt.Errorf("%w: %s is not cancelled", ErrInvalidTransition, from)
+	}
+	applyState(fields, StateDetected, "", now)
+	return nil
+}
+
+// applyState records that the stream entered state `to` at now.
+func applyState(fields map[string]string, to StreamState, reason string, now time.Time) {
+	at := strconv.FormatInt(now.UnixMilli(), 10)
+	fields[fieldState], fields[fieldUpdatedAt], fields[string(to)+"_at"] = string(to), at, at
+	if reason != "" {
+		fields[fieldLastError] = reason
+	}
+	if to == StateUploading {
+		n, _ := strconv.Atoi(fields[fieldAttempts])
+		fields[fieldAttempts] = strconv.Itoa(n + 1)
+	}
+}
+
+// ApplyChunkSize records the chunk size in the fields of a stream status hash, for stores that keep the hash elsewhere.
+func ApplyChunkSize(fields map[string]string, size int) {
+	fields[fieldChunkSize] = strconv.Itoa(size)
+}
+
+// ApplyKeyTime records the key time in the fields of a stream status hash, for stores that keep the hash elsewhere.
+func ApplyKeyTime(fields map[string]string, t time.Time) {
+	fields[fieldKeyTime] = strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// transitionCheckLua rejects the transition unless the state in KEYS[1] is one of the space-separated
+// states in ARGV[2] ("-" stands for a stream without a status), then records it: state, transition
+// time (ARGV[3], Unix milliseconds), last error (ARGV[4], only if not empty) and attempt count.
+// ARGV[1] is the target state.
+const transitionCheckLua = `
+local from = redis.call('HGET', KEYS[1], 'state') or '-'
+if not string.find(' ' .. ARGV[2] .. ' ', ' ' .. from .. ' ', 1, true) then
+	return redis.error_reply('INVALID ' .. from .. ' -> ' .. ARGV[1])
+end
+redis.call('HSET', KEYS[1], 'state', ARGV[1], 'updated_at', ARGV[3], ARGV[1] .. '_at', ARGV[3])
+if ARGV[4] ~= '' then
+	redis.call('HSET', KEYS[1], 'last_error', ARGV[4])
+end
+if ARGV[1] == 'uploading' then
+	redis.call('HINCRBY', KEYS[1], 'attempts', 1)
+end
+`
+
+// transitionLua moves a stream to another state. It is fenced like the checkpoint writes (see
+// fenceCheckLua). KEYS: status, fence counter. ARGV: see transitionCheckLua, then the fencing token.
+// The status loses its TTL; it is applied again once the stream is completed or orphaned.
+const transitionLua = fenceCheckLua + transitionCheckLua + `
+redis.call('PERSIST', KEYS[1])
+return 1
+`
+
+// migrateStatusLua converts a status written as a plain string by older versions into a status hash,
+// keeping its TTL. KEYS: status. ARGV: current time in Unix milliseconds.
+const migrateStatusLua = `
+if redis.call('TYPE', KEYS[1]).ok ~= 'string' then
+	return 0
+end
+local state = redis.call('GET', KEYS[1])
+if state == 'in_progress' then
+	state = 'uploading'
+end
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], 'state', state, 'updated_at', ARGV[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`
+
+var (
+	transitionScript    = redis.NewScript(transitionLua)
+	migrateStatusScript = redis.NewScript(migrateStatusLua)
+)
+
+// allowedFrom returns the states `to` may be entered from in the form transitionCheckLua expects.
+func allowedFrom(to StreamState) string {
+	from := make([]string, 0, len(transitions[to]))
+	for _, s := range transitions[to] {
+		if s == "" {
+			s = "-"
+		}
+		from = append(from, string(s))
+	}
+	return strings.Join(from, " ")
+}
+
+// transitionErr maps the INVALID error raised by transitionCheckLua to ErrInvalidTransition.
+func transitionErr(err error) error {
+	if err != nil && strings.HasPrefix(err.Error(), "INVALID ") {
+		return fmt.Errorf("%w: %s", ErrInvalidTransition, strings.TrimPrefix(err.Error(), "INVALID "))
+	}
+	return err
+}
+
+// TransitionStream atomically moves a stream to state `to` and records when it happened. reason is
+// stored as the stream's last error if not empty. Entering uploading counts as a new attempt.
+// It returns ErrInvalidTransition if `to` cannot be entered from the stream's current state, and is
+// fenced like CommitChunk: if ctx carries a fencing token that is no longer current, it returns ErrLeaseLost.
+func (r *redisStore) TransitionStream(ctx context.Context, streamID string, to StreamState, reason string) error {
+	if _, ok := transitions[to]; !ok {
+		return fmt.Errorf("%w: unknown state %q", ErrInvalidTransition, to)
+	}
+	keys := []string{r.keys.Stream("stream_status:", streamID), r.keys.Stream("stream_fence:", streamID)}
+	err := transitionScript.Run(ctx, r.client, keys, string(to), allowedFrom(to), time.Now().UnixMilli(), reason, FenceToken(ctx)).Err()
+	return transitionErr(fencedErr(err))
+}
+
+// ResetStream moves a cancelled stream back to detected, so the watcher and resume pick it up again.
+// Operators use it to undo a cancel; no other transition leaves cancelled. It returns
+// ErrInvalidTransition if the stream is not cancelled.
+func (r *redisStore) ResetStream(ctx context.Context, streamID string) error {
+	// An operator's reset is not fenced: token 0 disables the check
+	keys := []string{r.keys.Stream("stream_status:", streamID), r.keys.Stream("stream_fence:", streamID)}
+	err := transitionScript.Run(ctx, r.client, keys, string(StateDetected), string(StateCancelled), time.Now().UnixMilli(), "", int64(0)).Err()
+	return transitionErr(err)
+}
+
+// GetStreamInfo returns the lifecycle record of a stream, or ErrNotFound if it has none.
+func (r *redisStore) GetStreamInfo(ctx context.Context, streamID string) (StreamInfo, error) {
+	fields, err := r.client.HGetAll(ctx, r.keys.Stream("stream_status:", streamID)).Result()
+	if err != nil {
+		return StreamInfo{}, err
+	}
+	if len(fields) == 0 {
+		return StreamInfo{}, ErrNotFound
+	}
+	return ParseStreamInfo(fields), nil
+}
+
+// SetStreamChunkSize records the chunk size the stream's checkpoints are written with in its status hash.
+func (r *redisStore) SetStreamChunkSize(ctx context.Context, streamID string, size int) error {
+	return r.client.HSet(ctx, r.keys.Stream("stream_status:", streamID), fieldChunkSize, size).Err()
+}
+
+// SetStreamKeyTime records the modification time the stream's object keys are rendered with in its status hash.
+func (r *redisStore) SetStreamKeyTime(ctx context.Context, streamID string, t time.Time) error {
+	return r.client.HSet(ctx, r.keys.Stream("stream_status:", streamID), fieldKeyTime, t.UnixMilli()).Err()
+}
+
+// MigrateStatusKeys converts the plain string statuses of older versions into status hashes.
+// "in_progress" becomes uploading. It returns the number of statuses converted.
+func (r *redisStore) MigrateStatusKeys(ctx context.Context) (int, error) {
+	migrated := 0
+	err := scanKeys(ctx, r.client, r.keys.Pattern("stream_status:"), func(key string) error {
+		n, err := migrateStatusScript.Run(ctx, r.client, []string{key}, time.Now().UnixMilli()).Int()
+		migrated += n
+		return err
+	})
+	return migrated, err
+}
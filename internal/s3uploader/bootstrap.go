@@ -0,0 +1,115 @@
+package s3uploader
+
+import (
+	"context"
+	"fmt"
+	"video-stream-processor/internal/config"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"go.uber.org/zap"
+)
+
+// objectTypeTag is set on every uploaded object so lifecycle rules can target chunks only,
+// whatever the key layout looks like.
+const objectTypeTag = "vsp-object-type"
+
+// bucketManager defines the bucket administration calls used by Bootstrap (for mocking in tests)
+type bucketManager interface {
+	BucketExists(ctx context.Context, bucketName string) (bool, error)
+	MakeBucket(ctx context.Context, bucketName string, opts minio.MakeBucketOptions) error
+	EnableVersioning(ctx context.Context, bucketName string) error
+	SetObjectLockConfig(ctx context.Context, bucketName string, mode *minio.RetentionMode, validity *uint, unit *minio.ValidityUnit) error
+	SetBucketLifecycle(ctx context.Context, bucketName string, config *lifecycle.Configuration) error
+}
+
+// Bootstrap prepares the configured bucket before any upload happens: it creates the bucket
+// if missing, enables versioning and object lock if requested, and applies the lifecycle rules
+// from config. Existing lifecycle rules are only replaced when at least one rule is configured.
+// Errors are returned with enough context to tell a missing permission from a connectivity problem.
+// Every replica destination is bootstrapped the same way as the primary.
+func Bootstrap(ctx context.Context, cfg *config.Config, log *zap.Logger) error {
+	for _, dc := range destinationConfigs(cfg) {
+		client, err := newMinioClient(dc.cfg)
+		if err != nil {
+			return fmt.Errorf("%s: create minio client: %w", dc.name, err)
+		}
+		if err := bootstrap(ctx, client, dc.cfg, log.With(zap.String("destination", dc.name))); err != nil {
+			return fmt.Errorf("%s: %w", dc.name, err)
+		}
+	}
+	return nil
+}
+
+func bootstrap(ctx context.Context, client bucketManager, cfg *config.Config, log *zap.Logger) error {
+	bucket := cfg.MinioBucket
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return bootstrapError("check bucket", bucket, "s3:ListBucket", err)
+	}
+	if !exists {
+		if !cfg.BucketCreate {
+			return fmt.Errorf("bucket %q does not exist and BUCKET_CREATE is disabled", bucket)
+		}
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{ObjectLocking: cfg.BucketObjectLock}); err != nil {
+			return bootstrapError("create bucket", bucket, "s3:CreateBucket", err)
+		}
+		log.Info("Created bucket", zap.String("bucket", bucket), zap.Bool("object_lock", cfg.BucketObjectLock))
+	}
+	if cfg.BucketVersioning {
+		if err := client.EnableVersioning(ctx, bucket); err != nil {
+			return bootstrapError("enable versioning", bucket, "s3:PutBucketVersioning", err)
+		}
+		log.Info("Bucket versioning enabled", zap.String("bucket", bucket))
+	}
+	if cfg.BucketObjectLock && cfg.ObjectLockDays > 0 {
+		mode := minio.RetentionMode(cfg.ObjectLockMode)
+		if !mode.IsValid() {
+			return fmt.Errorf("invalid OBJECT_LOCK_MODE %q", cfg.ObjectLockMode)
+		}
+		days := uint(cfg.ObjectLockDays)
+		unit := minio.Days
+		if err := client.SetObjectLockConfig(ctx, bucket, &mode, &days, &unit); err != nil {
+			return bootstrapError("configure object lock (it can only be enabled when the bucket is created)", bucket, "s3:PutBucketObjectLockConfiguration", err)
+		}
+		log.Info("Bucket default retention set", zap.String("bucket", bucket), zap.String("mode", string(mode)), zap.Int("days", cfg.ObjectLockDays))
+	}
+	if rules := lifecycleConfig(cfg); !rules.Empty() {
+		if err := client.SetBucketLifecycle(ctx, bucket, rules); err != nil {
+			return bootstrapError("apply lifecycle rules", bucket, "s3:PutLifecycleConfiguration", err)
+		}
+		log.Info("Bucket lifecycle rules applied", zap.String("bucket", bucket), zap.Int("rules", len(rules.Rules)))
+	}
+	return nil
+}
+
+// lifecycleConfig builds the lifecycle rules requested in cfg.
+func lifecycleConfig(cfg *config.Config) *lifecycle.Configuration {
+	rules := lifecycle.NewConfiguration()
+	if cfg.ChunkExpiryDays > 0 {
+		rules.Rules = append(rules.Rules, lifecycle.Rule{
+			ID:         "vsp-expire-chunks",
+			Status:     "Enabled",
+			RuleFilter: lifecycle.Filter{Tag: lifecycle.Tag{Key: objectTypeTag, Value: objectTypeChunk}},
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(cfg.ChunkExpiryDays)},
+		})
+	}
+	if cfg.AbortUploadDays > 0 {
+		rules.Rules = append(rules.Rules, lifecycle.Rule{
+			ID:     "vsp-abort-incomplete-uploads",
+			Status: "Enabled",
+			AbortIncompleteMultipartUpload: lifecycle.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: lifecycle.ExpirationDays(cfg.AbortUploadDays),
+			},
+		})
+	}
+	return rules
+}
+
+// bootstrapError wraps err, spelling out the missing permission when the server denied access.
+func bootstrapError(action, bucket, permission string, err error) error {
+	if minio.ToErrorResponse(err).Code == "AccessDenied" {
+		return fmt.Errorf("%s %q: access denied, the credentials need %s: %w", action, bucket, permission, err)
+	}
+	return fmt.Errorf("%s %q: %w", action, bucket, err)
+}
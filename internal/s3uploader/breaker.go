@@ -0,0 +1,47 @@
+package s3uploader
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"video-stream-processor/internal/breaker"
+	"video-stream-processor/internal/chunker"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/objectkey"
+
+	"go.uber.org/zap"
+)
+
+// guarded wraps an Uploader with a circuit breaker.
+type guarded struct {
+	Uploader
+	b *breaker.Breaker
+}
+
+// NewWithBreaker wraps up with a circuit breaker that opens after cfg.BreakerThreshold
+// consecutive upload failures and probes the primary bucket every cfg.BreakerProbeInterval seconds.
+// name identifies the breaker in logs and metrics, so each uploader needs its own.
+// The caller is expected to run the breaker.
+func NewWithBreaker(up Uploader, name string, cfg *config.Config, log *zap.Logger) (Uploader, *breaker.Breaker) {
+	client, err := newMinioClient(cfg)
+	if err != nil {
+		log.Fatal("Failed to create minio client", zap.Error(err))
+	}
+	probe := func(ctx context.Context) error {
+		ok, err := client.BucketExists(ctx, cfg.MinioBucket)
+		if err == nil && !ok {
+			err = fmt.Errorf("bucket %q does not exist", cfg.MinioBucket)
+		}
+		return err
+	}
+	b := breaker.New(name, cfg.BreakerThreshold, time.Duration(cfg.BreakerProbeInterval)*time.Second, probe, log)
+	return &guarded{Uploader: up, b: b}, b
+}
+
+func (g *guarded) UploadChunk(ctx context.Context, stream objectkey.Stream, chunk chunker.Chunk) error {
+	return g.b.Do(ctx, func() error { return g.Uploader.UploadChunk(ctx, stream, chunk) })
+}
+
+func (g *guarded) UploadMetadata(ctx context.Context, stream objectkey.Stream, metadata []byte) error {
+	return g.b.Do(ctx, func() error { return g.Uploader.UploadMetadata(ctx, stream, metadata) })
+}
@@ -0,0 +1,64 @@
+package s3uploader
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"video-stream-processor/internal/config"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Server-side encryption modes accepted in SSE_MODE.
+const (
+	SSENone = "none"
+	SSES3   = "sse-s3"
+	SSEKMS  = "sse-kms"
+	SSEC    = "sse-c"
+)
+
+// newServerSide builds the server-side encryption settings described by cfg.
+// It returns nil when encryption is disabled.
+func newServerSide(cfg *config.Config) (encrypt.ServerSide, error) {
+	switch cfg.SSEMode {
+	case "", SSENone:
+		return nil, nil
+	case SSES3:
+		return encrypt.NewSSE(), nil
+	case SSEKMS:
+		if cfg.SSEKMSKeyID == "" {
+			return nil, fmt.Errorf("%s requires SSE_KMS_KEY_ID", SSEKMS)
+		}
+		return encrypt.NewSSEKMS(cfg.SSEKMSKeyID, nil)
+	case SSEC:
+		if !cfg.MinioUseSSL {
+			return nil, fmt.Errorf("%s requires MINIO_USE_SSL=true", SSEC)
+		}
+		key, err := loadCustomerKey(cfg.SSECKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return encrypt.NewSSEC(key)
+	}
+	return nil, fmt.Errorf("unknown SSE_MODE %q", cfg.SSEMode)
+}
+
+// loadCustomerKey reads a 32-byte SSE-C key, stored either raw or base64 encoded.
+func loadCustomerKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%s requires SSE_C_KEY_FILE", SSEC)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read SSE-C key: %w", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("SSE-C key in %s must be 32 bytes, raw or base64 encoded", path)
+	}
+	return key, nil
+}
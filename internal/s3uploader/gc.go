@@ -0,0 +1,84 @@
+package s3uploader
+
+import (
+	"context"
+	"fmt"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/objectkey"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// Garbage collection modes accepted in GC_MODE.
+const (
+	GCOff    = "off"
+	GCDryRun = "dry-run" // log what would be deleted
+	GCDelete = "delete"
+)
+
+// Collector lists and removes chunk objects so that objects no longer referenced by a
+// stream's metadata can be garbage collected. It covers every configured destination.
+type Collector interface {
+	// ListChunks returns the chunk object keys stored for stream under its chunk prefix,
+	// on any destination. Keys are only returned if the layout recognises them as chunks of stream.
+	ListChunks(ctx context.Context, stream objectkey.Stream) ([]string, error)
+	// RemoveObject deletes objectName from every destination. Missing objects are not an error.
+	RemoveObject(ctx context.Context, objectName string) error
+	// ReadObject downloads an object from the primary destination.
+	ReadObject(ctx context.Context, objectName string) ([]byte, error)
+}
+
+type collector struct {
+	dests []collectorDest
+}
+
+type collectorDest struct {
+	name string
+	up   *s3Uploader
+}
+
+// NewCollector returns a Collector for the primary destination and every configured replica.
+func NewCollector(cfg *config.Config, log *zap.Logger) Collector {
+	c := &collector{}
+	for _, dc := range destinationConfigs(cfg) {
+		up, err := newS3Uploader(dc.cfg, log.With(zap.String("destination", dc.name)))
+		if err != nil {
+			log.Fatal("Failed to create collector", zap.String("destination", dc.name), zap.Error(err))
+		}
+		c.dests = append(c.dests, collectorDest{name: dc.name, up: up})
+	}
+	return c
+}
+
+func (c *collector) ListChunks(ctx context.Context, stream objectkey.Stream) ([]string, error) {
+	seen := map[string]bool{}
+	var keys []string
+	for _, d := range c.dests {
+		prefix := d.up.keys.ChunkPrefix(stream)
+		for obj := range d.up.client.ListObjects(ctx, d.up.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+			if obj.Err != nil {
+				return nil, fmt.Errorf("list %s on %s: %w", prefix, d.name, obj.Err)
+			}
+			if _, ok := d.up.keys.ChunkIndex(stream, obj.Key); !ok || seen[obj.Key] {
+				continue
+			}
+			seen[obj.Key] = true
+			keys = append(keys, obj.Key)
+		}
+	}
+	return keys, nil
+}
+
+func (c *collector) RemoveObject(ctx context.Context, objectName string) error {
+	for _, d := range c.dests {
+		if err := d.up.client.RemoveObject(ctx, d.up.bucket, objectName, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("remove %s on %s: %w", objectName, d.name, err)
+		}
+	}
+	return nil
+}
+
+func (c *collector) ReadObject(ctx context.Context, objectName string) ([]byte, error) {
+	return c.dests[0].up.readObject(ctx, objectName)
+}
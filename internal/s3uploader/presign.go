@@ -0,0 +1,85 @@
+package s3uploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/objectkey"
+
+	"go.uber.org/zap"
+)
+
+// Presigned URL modes accepted in PRESIGN_MODE.
+const (
+	PresignOff    = "off"
+	PresignObject = "object" // write a signed-manifest object next to metadata.json
+	PresignHTTP   = "http"   // sign on request from the processor's HTTP endpoint
+	PresignBoth   = "both"
+)
+
+// Presigner issues presigned GET URLs for objects in the primary bucket, so consumers
+// can fetch chunks without holding bucket credentials.
+type Presigner interface {
+	// PresignGet returns a GET URL for objectName valid for Expiry.
+	PresignGet(ctx context.Context, objectName string) (string, error)
+	// Expiry returns how long issued URLs stay valid.
+	Expiry() time.Duration
+	// ReadObject downloads an object, e.g. a stream's metadata.json.
+	ReadObject(ctx context.Context, objectName string) ([]byte, error)
+	// PutManifest writes a signed manifest document.
+	PutManifest(ctx context.Context, stream objectkey.Stream, objectName string, manifest []byte) error
+}
+
+type presigner struct {
+	up     *s3Uploader
+	expiry time.Duration
+}
+
+// NewPresigner returns a Presigner for the primary destination. SSE-C objects cannot be fetched
+// with a plain presigned URL, so that combination is rejected.
+func NewPresigner(cfg *config.Config, log *zap.Logger) Presigner {
+	if cfg.SSEMode == SSEC {
+		log.Fatal("Presigned URLs cannot be used with SSE-C encrypted objects")
+	}
+	up, err := newS3Uploader(cfg, log)
+	if err != nil {
+		log.Fatal("Failed to create presigner", zap.Error(err))
+	}
+	return &presigner{up: up, expiry: time.Duration(cfg.PresignExpiry) * time.Second}
+}
+
+// SignedManifestKey returns the key of the signed manifest object, stored next to metadata.json.
+func SignedManifestKey(metadataKey string) string {
+	if dir := path.Dir(metadataKey); dir != "." {
+		return dir + "/signed-manifest.json"
+	}
+	return "signed-manifest.json"
+}
+
+func (p *presigner) PresignGet(ctx context.Context, objectName string) (string, error) {
+	u, err := p.up.client.PresignedGetObject(ctx, p.up.bucket, objectName, p.expiry, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (p *presigner) Expiry() time.Duration {
+	return p.expiry
+}
+
+func (p *presigner) ReadObject(ctx context.Context, objectName string) ([]byte, error) {
+	return p.up.readObject(ctx, objectName)
+}
+
+func (p *presigner) PutManifest(ctx context.Context, stream objectkey.Stream, objectName string, manifest []byte) error {
+	_, err := p.up.client.PutObject(ctx, p.up.bucket, objectName, bytes.NewReader(manifest), int64(len(manifest)), p.up.metadataOptions(stream))
+	if err != nil {
+		return fmt.Errorf("put signed manifest %s: %w", objectName, err)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package s3uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"video-stream-processor/internal/chunker"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/metrics"
+	"video-stream-processor/internal/objectkey"
+	"video-stream-processor/internal/ratelimit"
+	"video-stream-processor/internal/redisstore"
+
+	"go.uber.org/zap"
+)
+
+// Replication modes accepted in REPLICATION_MODE.
+const (
+	ReplicateAll    = "all"
+	ReplicateQuorum = "quorum"
+)
+
+// PrimaryDestination is the name of the destination configured with the MINIO_* settings.
+const PrimaryDestination = "primary"
+
+// replica is a single destination of the Replicator.
+type replica interface {
+	Uploader
+	readObject(ctx context.Context, objectName string) ([]byte, error)
+}
+
+type destination struct {
+	name string
+	up   replica
+}
+
+// limitedReplica charges the chunks sent to a destination, backfilled ones included, to a shared limiter.
+type limitedReplica struct {
+	replica
+	limiter *ratelimit.Limiter
+}
+
+func (l *limitedReplica) UploadChunk(ctx context.Context, stream objectkey.Stream, chunk chunker.Chunk) error {
+	return NewRateLimited(l.replica, l.limiter).UploadChunk(ctx, stream, chunk)
+}
+
+// limitDestinations wraps every destination with the limiter, so a replicated chunk is charged once per copy.
+func limitDestinations(dests []destination, limiter *ratelimit.Limiter) {
+	for i := range dests {
+		dests[i].up = &limitedReplica{replica: dests[i].up, limiter: limiter}
+	}
+}
+
+// Replicator is an Uploader that writes every object to several destinations in parallel.
+// Each destination keeps its own chunk checkpoints in Redis, so a retried chunk is only sent
+// to the destinations that do not have it yet. In "all" mode an upload fails unless every
+// destination succeeds; in "quorum" mode it succeeds once enough destinations have the object,
+// and the destinations that failed are queued for backfill from a healthy copy.
+type Replicator struct {
+	dests    []destination
+	required int
+	store    redisstore.Store
+	log      *zap.Logger
+}
+
+// backfillEntry describes an object a destination missed. It is queued in Redis as JSON.
+type backfillEntry struct {
+	Stream   objectkey.Stream `json:"stream"`
+	Index    int              `json:"index"` // Chunk index, or -1 for metadata.json
+	Checksum string           `json:"checksum,omitempty"`
+}
+
+// NewReplicator builds a Replicator writing to the primary destination and every configured replica.
+// If limiter is not nil, every chunk sent to a destination draws from it, including backfill.
+func NewReplicator(cfg *config.Config, store redisstore.Store, limiter *ratelimit.Limiter, log *zap.Logger) *Replicator {
+	var dests []destination
+	for _, dc := range destinationConfigs(cfg) {
+		up, err := newS3Uploader(dc.cfg, log.With(zap.String("destination", dc.name)))
+		if err != nil {
+			log.Fatal("Failed to create uploader", zap.String("destination", dc.name), zap.Error(err))
+		}
+		dests = append(dests, destination{name: dc.name, up: up})
+	}
+	if limiter != nil {
+		limitDestinations(dests, limiter)
+	}
+	required, err := requiredSuccesses(cfg.ReplicationMode, cfg.ReplicationQuorum, len(dests))
+	if err != nil {
+		log.Fatal("Invalid replication settings", zap.Error(err))
+	}
+	return &Replicator{dests: dests, required: required, store: store, log: log}
+}
+
+// requiredSuccesses returns how many destinations must accept an object for the upload to succeed.
+func requiredSuccesses(mode string, quorum, n int) (int, error) {
+	switch mode {
+	case "", ReplicateAll:
+		return n, nil
+	case ReplicateQuorum:
+		if quorum <= 0 {
+			return n/2 + 1, nil
+		}
+		if quorum > n {
+			return 0, fmt.Errorf("REPLICATION_QUORUM %d exceeds the %d configured destinations", quorum, n)
+		}
+		return quorum, nil
+	}
+	return 0, fmt.Errorf("unknown REPLICATION_MODE %q", mode)
+}
+
+func (r *Replicator) UploadChunk(ctx context.Context, stream objectkey.Stream, chunk chunker.Chunk) error {
+	results := make([]error, len(r.dests))
+	var wg sync.WaitGroup
+	for i, d := range r.dests {
+		if done, err := r.store.IsReplicaChunkUploaded(ctx, d.name, stream.ID, chunk.Index); err == nil && done {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, d destination) {
+			defer wg.Done()
+			if err := d.up.UploadChunk(ctx, stream, chunk); err != nil {
+				results[i] = err
+				return
+			}
+			if err := r.store.SetReplicaChunkUploaded(ctx, d.name, stream.ID, chunk.Index); err != nil {
+				r.log.Error("Redis set replica chunk uploaded failed", zap.String("destination", d.name), zap.Error(err))
+				metrics.RedisErrors.Inc()
+			}
+		}(i, d)
+	}
+	wg.Wait()
+	return r.settle(ctx, results, backfillEntry{Stream: stream, Index: chunk.Index, Checksum: chunk.Checksum})
+}
+
+func (r *Replicator) UploadMetadata(ctx context.Context, stream objectkey.Stream, metadata []byte) error {
+	results := make([]error, len(r.dests))
+	var wg sync.WaitGroup
+	for i, d := range r.dests {
+		wg.Add(1)
+		go func(i int, d destination) {
+			defer wg.Done()
+			results[i] = d.up.UploadMetadata(ctx, stream, metadata)
+		}(i, d)
+	}
+	wg.Wait()
+	return r.settle(ctx, results, backfillEntry{Stream: stream, Index: -1})
+}
+
+func (r *Replicator) Layout() *objectkey.Layout {
+	return r.dests[0].up.Layout()
+}
+
+// settle checks the per-destination results against the replication mode. When enough
+// destinations succeeded, the failed ones are queued for backfill and nil is returned.
+func (r *Replicator) settle(ctx context.Context, results []error, entry backfillEntry) error {
+	var errs []error
+	for i, err := range results {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.dests[i].name, err))
+			metrics.ReplicaUploadFailures.WithLabelValues(r.dests[i].name).Inc()
+		}
+	}
+	if len(r.dests)-len(errs) < r.required {
+		return errors.Join(errs...)
+	}
+	payload, _ := json.Marshal(entry)
+	for i, err := range results {
+		if err == nil {
+			continue
+		}
+		r.log.Warn("Destination missed upload, queued for backfill", zap.String("destination", r.dests[i].name),
+			zap.String("stream_id", entry.Stream.ID), zap.Int("chunk", entry.Index), zap.Error(err))
+		if err := r.store.PushBackfill(ctx, r.dests[i].name, string(payload)); err != nil {
+			r.log.Error("Redis push backfill failed", zap.String("destination", r.dests[i].name), zap.Error(err))
+			metrics.RedisErrors.Inc()
+		}
+	}
+	return nil
+}
+
+// RunBackfill periodically backfills every destination until ctx is cancelled.
+func (r *Replicator) RunBackfill(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, d := range r.dests {
+				if err := r.Backfill(ctx, d.name); err != nil {
+					r.log.Warn("Backfill incomplete", zap.String("destination", d.name), zap.Error(err))
+				}
+			}
+		}
+	}
+}
+
+// Backfill copies every object queued for dest from a destination that holds it.
+// It stops at the first failure and leaves the failed entry queued for the next run.
+func (r *Replicator) Backfill(ctx context.Context, dest string) error {
+	var target *destination
+	for i := range r.dests {
+		if r.dests[i].name == dest {
+			target = &r.dests[i]
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("unknown destination %q", dest)
+	}
+	for {
+		raw, err := r.store.PopBackfill(ctx, dest)
+		if err != nil {
+			metrics.RedisErrors.Inc()
+			return err
+		}
+		if raw == "" {
+			return nil
+		}
+		var entry backfillEntry
+		if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+			r.log.Error("Dropping malformed backfill entry", zap.String("destination", dest), zap.String("entry", raw), zap.Error(err))
+			continue
+		}
+		if err := r.backfill(ctx, *target, entry); err != nil {
+			if err := r.store.PushBackfill(ctx, dest, raw); err != nil {
+				metrics.RedisErrors.Inc()
+			}
+			return fmt.Errorf("stream %s chunk %d: %w", entry.Stream.ID, entry.Index, err)
+		}
+		metrics.ReplicaBackfilled.WithLabelValues(dest).Inc()
+		r.log.Info("Backfilled object", zap.String("destination", dest), zap.String("stream_id", entry.Stream.ID), zap.Int("chunk", entry.Index))
+	}
+}
+
+// backfill copies a single object to target from the first other destination that has a valid copy.
+func (r *Replicator) backfill(ctx context.Context, target destination, entry backfillEntry) error {
+	if entry.Index >= 0 {
+		if done, err := r.store.IsReplicaChunkUploaded(ctx, target.name, entry.Stream.ID, entry.Index); err == nil && done {
+			return nil
+		}
+	}
+	lastErr := errors.New("no other destination holds a copy")
+	for _, src := range r.dests {
+		if src.name == target.name {
+			continue
+		}
+		if entry.Index < 0 {
+			data, err := src.up.readObject(ctx, src.up.Layout().MetadataKey(entry.Stream))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return target.up.UploadMetadata(ctx, entry.Stream, data)
+		}
+		if done, err := r.store.IsReplicaChunkUploaded(ctx, src.name, entry.Stream.ID, entry.Index); err != nil || !done {
+			continue
+		}
+		data, err := src.up.readObject(ctx, src.up.Layout().ChunkKey(entry.Stream, entry.Index))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if entry.Checksum != "" && hex.EncodeToString(sum[:]) != entry.Checksum {
+			lastErr = fmt.Errorf("checksum mismatch on %s", src.name)
+			continue
+		}
+		chunk := chunker.Chunk{Index: entry.Index, Data: data, Checksum: entry.Checksum, Timestamp: time.Now()}
+		if err := target.up.UploadChunk(ctx, entry.Stream, chunk); err != nil {
+			return err
+		}
+		return r.store.SetReplicaChunkUploaded(ctx, target.name, entry.Stream.ID, entry.Index)
+	}
+	return lastErr
+}
+
+type destinationConfig struct {
+	name string
+	cfg  *config.Config
+}
+
+// destinationConfigs returns the primary configuration followed by one copy per replica,
+// with the endpoint, credentials and bucket replaced by the replica's settings.
+func destinationConfigs(cfg *config.Config) []destinationConfig {
+	dests := []destinationConfig{{name: PrimaryDestination, cfg: cfg}}
+	for _, rc := range cfg.Replicas {
+		c := *cfg
+		c.MinioEndpoint = rc.Endpoint
+		c.MinioAccessKey = rc.AccessKey
+		c.MinioSecretKey = rc.SecretKey
+		c.MinioBucket = rc.Bucket
+		c.MinioUseSSL = rc.UseSSL
+		dests = append(dests, destinationConfig{name: rc.Name, cfg: &c})
+	}
+	return dests
+}
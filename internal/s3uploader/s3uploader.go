@@ -1,5 +1,10 @@
 // Package s3uploader handles uploading video file chunks and metadata to S3/Minio-compatible object storage.
 // Used by the main processor to persist video data and metadata for further processing or playback.
+// Object names are rendered from the configured objectkey templates. Every object carries user metadata
+// describing its origin and the configured object tags, so lifecycle rules and audits do not need metadata.json.
+// Objects are optionally written with SSE-S3, SSE-KMS or SSE-C server-side encryption.
+// With versioned uploads, metadata.json is published by rewriting a small "current" pointer
+// object after it, and versions older than the retention window are deleted.
 package s3uploader
 
 import (
@@ -7,52 +12,204 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"video-stream-processor/internal/chunker"
 	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/objectkey"
+	"video-stream-processor/internal/version"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/tags"
 	"go.uber.org/zap"
 )
 
-// putObjecter defines the interface for PutObject used by s3Uploader (for mocking in tests)
-type putObjecter interface {
+// objectClient defines the object calls used by s3Uploader (for mocking in tests)
+type objectClient interface {
 	PutObject(ctx context.Context, bucket, objectName string, reader io.Reader, size int64, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+	GetObject(ctx context.Context, bucket, objectName string, opts minio.GetObjectOptions) (*minio.Object, error)
+	PresignedGetObject(ctx context.Context, bucket, objectName string, expires time.Duration, reqParams url.Values) (*url.URL, error)
+	ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo
+	RemoveObject(ctx context.Context, bucket, objectName string, opts minio.RemoveObjectOptions) error
 }
 
 type Uploader interface {
-	UploadChunk(ctx context.Context, streamID string, chunkIdx int, data []byte) error
-	UploadMetadata(ctx context.Context, streamID string, metadata []byte) error
+	UploadChunk(ctx context.Context, stream objectkey.Stream, chunk chunker.Chunk) error
+	UploadMetadata(ctx context.Context, stream objectkey.Stream, metadata []byte) error
+	// Layout returns the key layout used to name uploaded objects.
+	Layout() *objectkey.Layout
 }
 
 type s3Uploader struct {
-	client putObjecter
-	bucket string
-	log    *zap.Logger
+	client       objectClient
+	bucket       string
+	keys         *objectkey.Layout
+	opts         objectOptions
+	keepVersions int // Versions retained for versioned streams, 0 when uploads are not versioned
+	log          *zap.Logger
 }
 
+// objectOptions holds the settings applied to every PutObject call.
+type objectOptions struct {
+	host                 string
+	tags                 map[string]string
+	chunkStorageClass    string
+	metadataStorageClass string
+	sse                  encrypt.ServerSide // nil when server-side encryption is disabled
+}
+
+// Values of the objectTypeTag tag.
+const (
+	objectTypeChunk    = "chunk"
+	objectTypeMetadata = "metadata"
+)
+
 func New(cfg *config.Config, log *zap.Logger) Uploader {
-	client, err := minio.New(cfg.MinioEndpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(cfg.MinioAccessKey, cfg.MinioSecretKey, ""),
-		Secure: cfg.MinioUseSSL,
-	})
+	s, err := newS3Uploader(cfg, log)
 	if err != nil {
-		log.Fatal("Failed to create minio client", zap.Error(err))
+		log.Fatal("Failed to create uploader", zap.Error(err))
 	}
-	return &s3Uploader{client: client, bucket: cfg.MinioBucket, log: log}
+	return s
 }
 
-func (s *s3Uploader) UploadChunk(ctx context.Context, streamID string, chunkIdx int, data []byte) error {
-	objectName := streamID + "/chunk-" + itoa(chunkIdx)
-	_, err := s.client.PutObject(ctx, s.bucket, objectName, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
-	return err
+func newS3Uploader(cfg *config.Config, log *zap.Logger) (*s3Uploader, error) {
+	client, err := newMinioClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create minio client: %w", err)
+	}
+	keys, err := objectkey.Parse(cfg.ChunkKeyTemplate, cfg.MetadataKeyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object key template: %w", err)
+	}
+	if cfg.StreamVersions > 0 {
+		if !keys.Versioned() {
+			return nil, fmt.Errorf("chunk and metadata key templates must contain {version} when STREAM_VERSIONS is set")
+		}
+		if keys, err = keys.WithCurrent(cfg.CurrentKeyTemplate); err != nil {
+			return nil, fmt.Errorf("invalid object key template: %w", err)
+		}
+	}
+	if _, err := tags.NewTags(withObjectType(cfg.ObjectTags, objectTypeChunk), true); err != nil {
+		return nil, fmt.Errorf("invalid object tags: %w", err)
+	}
+	sse, err := newServerSide(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server-side encryption settings: %w", err)
+	}
+	host, _ := os.Hostname()
+	opts := objectOptions{
+		host:                 host,
+		tags:                 cfg.ObjectTags,
+		chunkStorageClass:    cfg.ChunkStorageClass,
+		metadataStorageClass: cfg.MetadataStorageClass,
+		sse:                  sse,
+	}
+	return &s3Uploader{client: client, bucket: cfg.MinioBucket, keys: keys, opts: opts, keepVersions: cfg.StreamVersions, log: log}, nil
 }
 
-func (s *s3Uploader) UploadMetadata(ctx context.Context, streamID string, metadata []byte) error {
-	objectName := streamID + "/metadata.json"
-	_, err := s.client.PutObject(ctx, s.bucket, objectName, bytes.NewReader(metadata), int64(len(metadata)), minio.PutObjectOptions{ContentType: "application/json"})
+func (s *s3Uploader) UploadChunk(ctx context.Context, stream objectkey.Stream, chunk chunker.Chunk) error {
+	objectName := s.keys.ChunkKey(stream, chunk.Index)
+	_, err := s.client.PutObject(ctx, s.bucket, objectName, bytes.NewReader(chunk.Data), int64(len(chunk.Data)), s.chunkOptions(stream, chunk))
 	return err
 }
 
-func itoa(i int) string {
-	return fmt.Sprintf("%05d", i)
+func (s *s3Uploader) UploadMetadata(ctx context.Context, stream objectkey.Stream, metadata []byte) error {
+	objectName := s.keys.MetadataKey(stream)
+	if _, err := s.client.PutObject(ctx, s.bucket, objectName, bytes.NewReader(metadata), int64(len(metadata)), s.metadataOptions(stream)); err != nil {
+		return err
+	}
+	if s.keepVersions > 0 {
+		return s.publishVersion(ctx, stream, objectName)
+	}
+	return nil
+}
+
+func (s *s3Uploader) Layout() *objectkey.Layout {
+	return s.keys
+}
+
+// readObject downloads an object written by this uploader.
+func (s *s3Uploader) readObject(ctx context.Context, objectName string) ([]byte, error) {
+	var opts minio.GetObjectOptions
+	if s.opts.sse != nil && s.opts.sse.Type() == encrypt.SSEC {
+		// SSE-C objects can only be read with the customer key
+		opts.ServerSideEncryption = s.opts.sse
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, objectName, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+// chunkOptions returns the PutObject options for a chunk object.
+func (s *s3Uploader) chunkOptions(stream objectkey.Stream, chunk chunker.Chunk) minio.PutObjectOptions {
+	meta := s.userMetadata(stream)
+	meta["Chunk-Index"] = strconv.Itoa(chunk.Index)
+	meta["Checksum-Sha256"] = chunk.Checksum
+	return minio.PutObjectOptions{
+		ContentType:          "application/octet-stream",
+		UserMetadata:         meta,
+		UserTags:             withObjectType(s.opts.tags, objectTypeChunk),
+		StorageClass:         s.opts.chunkStorageClass,
+		ServerSideEncryption: s.opts.sse,
+	}
+}
+
+// metadataOptions returns the PutObject options for a metadata.json object.
+func (s *s3Uploader) metadataOptions(stream objectkey.Stream) minio.PutObjectOptions {
+	return minio.PutObjectOptions{
+		ContentType:          "application/json",
+		UserMetadata:         s.userMetadata(stream),
+		UserTags:             withObjectType(s.opts.tags, objectTypeMetadata),
+		StorageClass:         s.opts.metadataStorageClass,
+		ServerSideEncryption: s.opts.sse,
+	}
+}
+
+// userMetadata returns the user metadata shared by all objects of a stream.
+// Minio sends each entry as an X-Amz-Meta-* header.
+func (s *s3Uploader) userMetadata(stream objectkey.Stream) map[string]string {
+	return map[string]string{
+		"Stream-Id":         metadataValue(stream.ID),
+		"Source-Host":       s.opts.host,
+		"Processor-Version": version.Version,
+	}
+}
+
+// metadataValue percent-encodes '%' and every byte outside printable ASCII, which S3 rejects in
+// user metadata headers. Plain ASCII values are unchanged; url.PathUnescape restores the original.
+func metadataValue(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if c := v[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// withObjectType returns a copy of tags with the objectTypeTag tag set.
+func withObjectType(tags map[string]string, objectType string) map[string]string {
+	out := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		out[k] = v
+	}
+	out[objectTypeTag] = objectType
+	return out
+}
+
+func newMinioClient(cfg *config.Config) (*minio.Client, error) {
+	return minio.New(cfg.MinioEndpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.MinioAccessKey, cfg.MinioSecretKey, ""),
+		Secure: cfg.MinioUseSSL,
+	})
 }
@@ -1,18 +1,40 @@
 package s3uploader
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"video-stream-processor/internal/breaker"
+	"video-stream-processor/internal/chunker"
 	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/objectkey"
+	"video-stream-processor/internal/ratelimit"
+	"video-stream-processor/internal/redisstore"
+	"video-stream-processor/internal/version"
 
 	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
 	"go.uber.org/zap"
 )
 
 type mockMinioClient struct {
 	putErr    error
+	objects   []string // keys returned by ListObjects
+	removed   []string
 	putCalled []struct {
 		bucket     string
 		objectName string
@@ -32,11 +54,31 @@ func (m *mockMinioClient) PutObject(ctx context.Context, bucket, objectName stri
 	}{bucket, objectName, buf, opts})
 	return minio.UploadInfo{}, m.putErr
 }
+func (m *mockMinioClient) GetObject(ctx context.Context, bucket, objectName string, opts minio.GetObjectOptions) (*minio.Object, error) {
+	return nil, errors.New("not implemented")
+}
+func (m *mockMinioClient) PresignedGetObject(ctx context.Context, bucket, objectName string, expires time.Duration, reqParams url.Values) (*url.URL, error) {
+	return url.Parse(fmt.Sprintf("https://minio.local/%s/%s?X-Amz-Expires=%d", bucket, objectName, int(expires.Seconds())))
+}
+func (m *mockMinioClient) ListObjects(ctx context.Context, bucket string, opts minio.ListObjectsOptions) <-chan minio.ObjectInfo {
+	ch := make(chan minio.ObjectInfo, len(m.objects))
+	for _, key := range m.objects {
+		if strings.HasPrefix(key, opts.Prefix) {
+			ch <- minio.ObjectInfo{Key: key}
+		}
+	}
+	close(ch)
+	return ch
+}
+func (m *mockMinioClient) RemoveObject(ctx context.Context, bucket, objectName string, opts minio.RemoveObjectOptions) error {
+	m.removed = append(m.removed, objectName)
+	return nil
+}
 
 func TestUploadChunk_Success(t *testing.T) {
 	mc := &mockMinioClient{}
-	s := &s3Uploader{client: mc, bucket: "testbucket", log: zap.NewNop()}
-	err := s.UploadChunk(context.Background(), "stream1", 2, []byte("chunkdata"))
+	s := &s3Uploader{client: mc, bucket: "testbucket", keys: objectkey.Default(), log: zap.NewNop()}
+	err := s.UploadChunk(context.Background(), objectkey.Stream{ID: "stream1"}, chunker.Chunk{Index: 2, Data: []byte("chunkdata")})
 	if err != nil {
 		t.Errorf("expected nil error, got %v", err)
 	}
@@ -54,8 +96,8 @@ func TestUploadChunk_Success(t *testing.T) {
 
 func TestUploadChunk_Error(t *testing.T) {
 	mc := &mockMinioClient{putErr: errors.New("fail")}
-	s := &s3Uploader{client: mc, bucket: "b", log: zap.NewNop()}
-	err := s.UploadChunk(context.Background(), "id", 1, []byte("d"))
+	s := &s3Uploader{client: mc, bucket: "b", keys: objectkey.Default(), log: zap.NewNop()}
+	err := s.UploadChunk(context.Background(), objectkey.Stream{ID: "id"}, chunker.Chunk{Index: 1, Data: []byte("d")})
 	if err == nil || err.Error() != "fail" {
 		t.Errorf("expected fail error, got %v", err)
 	}
@@ -63,9 +105,9 @@ func TestUploadChunk_Error(t *testing.T) {
 
 func TestUploadMetadata_Success(t *testing.T) {
 	mc := &mockMinioClient{}
-	s := &s3Uploader{client: mc, bucket: "b", log: zap.NewNop()}
+	s := &s3Uploader{client: mc, bucket: "b", keys: objectkey.Default(), log: zap.NewNop()}
 	meta := []byte(`{"foo":1}`)
-	err := s.UploadMetadata(context.Background(), "id", meta)
+	err := s.UploadMetadata(context.Background(), objectkey.Stream{ID: "id"}, meta)
 	if err != nil {
 		t.Errorf("expected nil error, got %v", err)
 	}
@@ -86,8 +128,8 @@ func TestUploadMetadata_Success(t *testing.T) {
 
 func TestUploadMetadata_Error(t *testing.T) {
 	mc := &mockMinioClient{putErr: errors.New("failmeta")}
-	s := &s3Uploader{client: mc, bucket: "b", log: zap.NewNop()}
-	err := s.UploadMetadata(context.Background(), "id", []byte("{}"))
+	s := &s3Uploader{client: mc, bucket: "b", keys: objectkey.Default(), log: zap.NewNop()}
+	err := s.UploadMetadata(context.Background(), objectkey.Stream{ID: "id"}, []byte("{}"))
 	if err == nil || err.Error() != "failmeta" {
 		t.Errorf("expected failmeta error, got %v", err)
 	}
@@ -95,11 +137,13 @@ func TestUploadMetadata_Error(t *testing.T) {
 
 func TestNew_Success(t *testing.T) {
 	cfg := &config.Config{
-		MinioEndpoint:  "localhost:9000",
-		MinioAccessKey: "key",
-		MinioSecretKey: "secret",
-		MinioUseSSL:    false,
-		MinioBucket:    "bucket",
+		MinioEndpoint:       "localhost:9000",
+		MinioAccessKey:      "key",
+		MinioSecretKey:      "secret",
+		MinioUseSSL:         false,
+		MinioBucket:         "bucket",
+		ChunkKeyTemplate:    objectkey.DefaultChunkTemplate,
+		MetadataKeyTemplate: objectkey.DefaultMetadataTemplate,
 	}
 	log := zap.NewNop()
 	u := New(cfg, log)
@@ -107,3 +151,546 @@ func TestNew_Success(t *testing.T) {
 		t.Error("New should not return nil")
 	}
 }
+
+func TestUploadChunk_KeyTemplate(t *testing.T) {
+	keys, err := objectkey.Parse("{date}/{camera}/{stream}/{index:08}", "{date}/{camera}/{stream}/metadata.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := &mockMinioClient{}
+	s := &s3Uploader{client: mc, bucket: "b", keys: keys, log: zap.NewNop()}
+	stream := objectkey.Stream{ID: "out.mp4", Path: "/input/cam1/out.mp4", ModTime: time.Date(2025, 5, 27, 18, 0, 0, 0, time.UTC)}
+	if err := s.UploadChunk(context.Background(), stream, chunker.Chunk{Index: 123456, Data: []byte("d")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UploadMetadata(context.Background(), stream, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if got := mc.putCalled[0].objectName; got != "2025-05-27/cam1/out.mp4/00123456" {
+		t.Errorf("unexpected chunk key: %s", got)
+	}
+	if got := mc.putCalled[1].objectName; got != "2025-05-27/cam1/out.mp4/metadata.json" {
+		t.Errorf("unexpected metadata key: %s", got)
+	}
+}
+
+func TestUploadChunk_MetadataTagsAndStorageClass(t *testing.T) {
+	mc := &mockMinioClient{}
+	s := &s3Uploader{client: mc, bucket: "b", keys: objectkey.Default(), log: zap.NewNop(), opts: objectOptions{
+		host:                 "edge-1",
+		tags:                 map[string]string{"team": "video"},
+		chunkStorageClass:    "STANDARD_IA",
+		metadataStorageClass: "STANDARD",
+	}}
+	stream := objectkey.Stream{ID: "s1"}
+	if err := s.UploadChunk(context.Background(), stream, chunker.Chunk{Index: 7, Data: []byte("d"), Checksum: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UploadMetadata(context.Background(), stream, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	chunkOpts := mc.putCalled[0].opts
+	want := map[string]string{"Stream-Id": "s1", "Chunk-Index": "7", "Checksum-Sha256": "abc", "Source-Host": "edge-1", "Processor-Version": version.Version}
+	for k, v := range want {
+		if chunkOpts.UserMetadata[k] != v {
+			t.Errorf("chunk metadata %s = %q, want %q", k, chunkOpts.UserMetadata[k], v)
+		}
+	}
+	if chunkOpts.UserTags["team"] != "video" || chunkOpts.UserTags[objectTypeTag] != objectTypeChunk {
+		t.Errorf("chunk tags not set: %v", chunkOpts.UserTags)
+	}
+	if chunkOpts.StorageClass != "STANDARD_IA" {
+		t.Errorf("unexpected chunk storage class: %s", chunkOpts.StorageClass)
+	}
+	metaOpts := mc.putCalled[1].opts
+	if metaOpts.StorageClass != "STANDARD" || metaOpts.UserMetadata["Stream-Id"] != "s1" {
+		t.Errorf("unexpected metadata options: %+v", metaOpts)
+	}
+	if _, ok := metaOpts.UserMetadata["Chunk-Index"]; ok {
+		t.Error("metadata object should not carry a chunk index")
+	}
+}
+
+func TestMetadataValue(t *testing.T) {
+	cases := map[string]string{
+		"cam1/out.mp4":   "cam1/out.mp4",
+		"caméra/out.mp4": "cam%C3%A9ra/out.mp4",
+		"100%/a b.mp4":   "100%25/a b.mp4",
+		"tab\tname.mp4":  "tab%09name.mp4",
+	}
+	for in, want := range cases {
+		got := metadataValue(in)
+		if got != want {
+			t.Errorf("metadataValue(%q) = %q, want %q", in, got, want)
+		}
+		if back, err := url.PathUnescape(got); err != nil || back != in {
+			t.Errorf("%q does not decode back to %q: %q, %v", got, in, back, err)
+		}
+	}
+}
+
+func TestNewServerSide(t *testing.T) {
+	dir := t.TempDir()
+	rawKey := filepath.Join(dir, "raw.key")
+	os.WriteFile(rawKey, bytes.Repeat([]byte{1}, 32), 0600)
+	b64Key := filepath.Join(dir, "b64.key")
+	os.WriteFile(b64Key, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))+"\n"), 0600)
+	shortKey := filepath.Join(dir, "short.key")
+	os.WriteFile(shortKey, []byte("short"), 0600)
+
+	cases := []struct {
+		name    string
+		cfg     config.Config
+		want    encrypt.Type
+		wantErr bool
+	}{
+		{"none", config.Config{SSEMode: "none"}, "", false},
+		{"sse-s3", config.Config{SSEMode: SSES3}, encrypt.S3, false},
+		{"sse-kms", config.Config{SSEMode: SSEKMS, SSEKMSKeyID: "key-1"}, encrypt.KMS, false},
+		{"sse-kms without key", config.Config{SSEMode: SSEKMS}, "", true},
+		{"sse-c raw key", config.Config{SSEMode: SSEC, MinioUseSSL: true, SSECKeyFile: rawKey}, encrypt.SSEC, false},
+		{"sse-c base64 key", config.Config{SSEMode: SSEC, MinioUseSSL: true, SSECKeyFile: b64Key}, encrypt.SSEC, false},
+		{"sse-c short key", config.Config{SSEMode: SSEC, MinioUseSSL: true, SSECKeyFile: shortKey}, "", true},
+		{"sse-c without tls", config.Config{SSEMode: SSEC, SSECKeyFile: rawKey}, "", true},
+		{"unknown", config.Config{SSEMode: "rot13"}, "", true},
+	}
+	for _, c := range cases {
+		sse, err := newServerSide(&c.cfg)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: unexpected error %v", c.name, err)
+			continue
+		}
+		if c.want == "" {
+			if sse != nil {
+				t.Errorf("%s: expected no encryption, got %v", c.name, sse.Type())
+			}
+			continue
+		}
+		if sse == nil || sse.Type() != c.want {
+			t.Errorf("%s: expected %v", c.name, c.want)
+		}
+	}
+}
+
+func TestUploadChunk_ServerSideEncryption(t *testing.T) {
+	mc := &mockMinioClient{}
+	s := &s3Uploader{client: mc, bucket: "b", keys: objectkey.Default(), log: zap.NewNop(), opts: objectOptions{sse: encrypt.NewSSE()}}
+	s.UploadChunk(context.Background(), objectkey.Stream{ID: "s1"}, chunker.Chunk{Data: []byte("d")})
+	s.UploadMetadata(context.Background(), objectkey.Stream{ID: "s1"}, []byte("{}"))
+	for _, call := range mc.putCalled {
+		if call.opts.ServerSideEncryption == nil || call.opts.ServerSideEncryption.Type() != encrypt.S3 {
+			t.Errorf("%s written without SSE-S3", call.objectName)
+		}
+	}
+}
+
+type mockBucketManager struct {
+	exists       bool
+	existsErr    error
+	makeErr      error
+	made         *minio.MakeBucketOptions
+	versioning   bool
+	lockDays     uint
+	lifecycle    *lifecycle.Configuration
+	lifecycleErr error
+}
+
+func (m *mockBucketManager) BucketExists(ctx context.Context, bucketName string) (bool, error) {
+	return m.exists, m.existsErr
+}
+func (m *mockBucketManager) MakeBucket(ctx context.Context, bucketName string, opts minio.MakeBucketOptions) error {
+	m.made = &opts
+	return m.makeErr
+}
+func (m *mockBucketManager) EnableVersioning(ctx context.Context, bucketName string) error {
+	m.versioning = true
+	return nil
+}
+func (m *mockBucketManager) SetObjectLockConfig(ctx context.Context, bucketName string, mode *minio.RetentionMode, validity *uint, unit *minio.ValidityUnit) error {
+	m.lockDays = *validity
+	return nil
+}
+func (m *mockBucketManager) SetBucketLifecycle(ctx context.Context, bucketName string, config *lifecycle.Configuration) error {
+	m.lifecycle = config
+	return m.lifecycleErr
+}
+
+func TestBootstrap_CreatesBucket(t *testing.T) {
+	bm := &mockBucketManager{}
+	cfg := &config.Config{MinioBucket: "b", BucketCreate: true, BucketVersioning: true, BucketObjectLock: true,
+		ObjectLockMode: "GOVERNANCE", ObjectLockDays: 30, ChunkExpiryDays: 7, AbortUploadDays: 1}
+	if err := bootstrap(context.Background(), bm, cfg, zap.NewNop()); err != nil {
+		t.Fatalf("bootstrap failed: %v", err)
+	}
+	if bm.made == nil || !bm.made.ObjectLocking {
+		t.Error("bucket should be created with object locking")
+	}
+	if !bm.versioning || bm.lockDays != 30 {
+		t.Errorf("versioning/object lock not configured: %v %d", bm.versioning, bm.lockDays)
+	}
+	if bm.lifecycle == nil || len(bm.lifecycle.Rules) != 2 {
+		t.Fatalf("expected 2 lifecycle rules, got %+v", bm.lifecycle)
+	}
+	if tag := bm.lifecycle.Rules[0].RuleFilter.Tag; tag.Key != objectTypeTag || tag.Value != objectTypeChunk {
+		t.Errorf("chunk expiry rule should filter on the object type tag, got %+v", tag)
+	}
+}
+
+func TestBootstrap_ExistingBucketUntouched(t *testing.T) {
+	bm := &mockBucketManager{exists: true}
+	if err := bootstrap(context.Background(), bm, &config.Config{MinioBucket: "b", BucketCreate: true}, zap.NewNop()); err != nil {
+		t.Fatalf("bootstrap failed: %v", err)
+	}
+	if bm.made != nil || bm.versioning || bm.lifecycle != nil {
+		t.Error("existing bucket should not be modified when nothing is configured")
+	}
+}
+
+func TestBootstrap_Errors(t *testing.T) {
+	denied := minio.ErrorResponse{Code: "AccessDenied", Message: "Access Denied."}
+	cases := []struct {
+		name string
+		bm   *mockBucketManager
+		cfg  *config.Config
+		want string
+	}{
+		{"missing bucket", &mockBucketManager{}, &config.Config{MinioBucket: "b"}, "BUCKET_CREATE is disabled"},
+		{"create denied", &mockBucketManager{makeErr: denied}, &config.Config{MinioBucket: "b", BucketCreate: true}, "s3:CreateBucket"},
+		{"lifecycle denied", &mockBucketManager{exists: true, lifecycleErr: denied}, &config.Config{MinioBucket: "b", ChunkExpiryDays: 1}, "s3:PutLifecycleConfiguration"},
+		{"unreachable", &mockBucketManager{existsErr: errors.New("connection refused")}, &config.Config{MinioBucket: "b"}, "connection refused"},
+		{"bad lock mode", &mockBucketManager{exists: true}, &config.Config{MinioBucket: "b", BucketObjectLock: true, ObjectLockDays: 1, ObjectLockMode: "FOREVER"}, "OBJECT_LOCK_MODE"},
+	}
+	for _, c := range cases {
+		err := bootstrap(context.Background(), c.bm, c.cfg, zap.NewNop())
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+// mockReplica is an in-memory destination for Replicator tests.
+type mockReplica struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	fail    bool
+}
+
+func (m *mockReplica) UploadChunk(ctx context.Context, stream objectkey.Stream, chunk chunker.Chunk) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail {
+		return errors.New("destination down")
+	}
+	m.objects[m.Layout().ChunkKey(stream, chunk.Index)] = chunk.Data
+	return nil
+}
+func (m *mockReplica) UploadMetadata(ctx context.Context, stream objectkey.Stream, metadata []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail {
+		return errors.New("destination down")
+	}
+	m.objects[m.Layout().MetadataKey(stream)] = metadata
+	return nil
+}
+func (m *mockReplica) Layout() *objectkey.Layout { return objectkey.Default() }
+func (m *mockReplica) readObject(ctx context.Context, objectName string) ([]byte, error) {
+	data, ok := m.objects[objectName]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+
+// mockReplicaStore implements the replica checkpoint and backfill parts of redisstore.Store.
+type mockReplicaStore struct {
+	redisstore.Store
+	mu       sync.Mutex
+	chunks   map[string]bool
+	backfill map[string][]string
+}
+
+func (m *mockReplicaStore) SetReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chunks[fmt.Sprintf("%s:%s:%d", dest, streamID, chunkIdx)] = true
+	return nil
+}
+func (m *mockReplicaStore) IsReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.chunks[fmt.Sprintf("%s:%s:%d", dest, streamID, chunkIdx)], nil
+}
+func (m *mockReplicaStore) PushBackfill(ctx context.Context, dest, entry string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backfill[dest] = append(m.backfill[dest], entry)
+	return nil
+}
+func (m *mockReplicaStore) PopBackfill(ctx context.Context, dest string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.backfill[dest]) == 0 {
+		return "", nil
+	}
+	entry := m.backfill[dest][0]
+	m.backfill[dest] = m.backfill[dest][1:]
+	return entry, nil
+}
+
+func newTestReplicator(required int) (*Replicator, *mockReplica, *mockReplica, *mockReplicaStore) {
+	primary := &mockReplica{objects: map[string][]byte{}}
+	dr := &mockReplica{objects: map[string][]byte{}}
+	store := &mockReplicaStore{chunks: map[string]bool{}, backfill: map[string][]string{}}
+	r := &Replicator{
+		dests:    []destination{{name: PrimaryDestination, up: primary}, {name: "dr", up: dr}},
+		required: required,
+		store:    store,
+		log:      zap.NewNop(),
+	}
+	return r, primary, dr, store
+}
+
+func testChunk(idx int, data string) chunker.Chunk {
+	sum := sha256.Sum256([]byte(data))
+	return chunker.Chunk{Index: idx, Data: []byte(data), Checksum: hex.EncodeToString(sum[:])}
+}
+
+func TestReplicator_AllMode(t *testing.T) {
+	r, primary, dr, store := newTestReplicator(2)
+	stream := objectkey.Stream{ID: "s1"}
+	if err := r.UploadChunk(context.Background(), stream, testChunk(0, "d0")); err != nil {
+		t.Fatalf("UploadChunk failed: %v", err)
+	}
+	if len(primary.objects) != 1 || len(dr.objects) != 1 {
+		t.Error("chunk should be written to every destination")
+	}
+	dr.fail = true
+	if err := r.UploadChunk(context.Background(), stream, testChunk(1, "d1")); err == nil {
+		t.Error("all mode should fail when a destination fails")
+	}
+	// The retry only goes to the destination that does not have the chunk yet
+	delete(primary.objects, "s1/chunk-00001")
+	dr.fail = false
+	if err := r.UploadChunk(context.Background(), stream, testChunk(1, "d1")); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if _, ok := primary.objects["s1/chunk-00001"]; ok {
+		t.Error("retry should skip destinations with a checkpoint")
+	}
+	if !store.chunks["dr:s1:1"] {
+		t.Error("dr checkpoint not recorded")
+	}
+}
+
+func TestReplicator_QuorumAndBackfill(t *testing.T) {
+	r, primary, dr, store := newTestReplicator(1)
+	stream := objectkey.Stream{ID: "s1"}
+	dr.fail = true
+	if err := r.UploadChunk(context.Background(), stream, testChunk(0, "d0")); err != nil {
+		t.Fatalf("quorum upload should succeed: %v", err)
+	}
+	if err := r.UploadMetadata(context.Background(), stream, []byte("{}")); err != nil {
+		t.Fatalf("quorum metadata upload should succeed: %v", err)
+	}
+	if len(store.backfill["dr"]) != 2 {
+		t.Fatalf("expected 2 backfill entries, got %v", store.backfill["dr"])
+	}
+	if err := r.Backfill(context.Background(), "dr"); err == nil {
+		t.Error("backfill to a down destination should fail")
+	}
+	if len(store.backfill["dr"]) != 2 {
+		t.Error("failed backfill entry should stay queued")
+	}
+	dr.fail = false
+	if err := r.Backfill(context.Background(), "dr"); err != nil {
+		t.Fatalf("backfill failed: %v", err)
+	}
+	if string(dr.objects["s1/chunk-00000"]) != "d0" || string(dr.objects["s1/metadata.json"]) != "{}" {
+		t.Errorf("dr not backfilled: %v", dr.objects)
+	}
+	if !store.chunks["dr:s1:0"] || len(store.backfill["dr"]) != 0 {
+		t.Error("backfill should record the checkpoint and drain the queue")
+	}
+	// A corrupted source copy is never propagated
+	primary.objects["s1/chunk-00001"] = []byte("corrupt")
+	store.chunks["primary:s1:1"] = true
+	entry, _ := json.Marshal(backfillEntry{Stream: stream, Index: 1, Checksum: testChunk(1, "d1").Checksum})
+	store.PushBackfill(context.Background(), "dr", string(entry))
+	if err := r.Backfill(context.Background(), "dr"); err == nil {
+		t.Error("backfill should refuse a copy with a mismatching checksum")
+	}
+}
+
+func TestRequiredSuccesses(t *testing.T) {
+	cases := []struct {
+		mode    string
+		quorum  int
+		n       int
+		want    int
+		wantErr bool
+	}{
+		{ReplicateAll, 0, 3, 3, false},
+		{ReplicateQuorum, 0, 3, 2, false},
+		{ReplicateQuorum, 1, 3, 1, false},
+		{ReplicateQuorum, 4, 3, 0, true},
+		{"some", 0, 3, 0, true},
+	}
+	for _, c := range cases {
+		got, err := requiredSuccesses(c.mode, c.quorum, c.n)
+		if got != c.want || (err != nil) != c.wantErr {
+			t.Errorf("requiredSuccesses(%q, %d, %d) = %d, %v", c.mode, c.quorum, c.n, got, err)
+		}
+	}
+}
+
+func TestRateLimited_UploadChunk(t *testing.T) {
+	mc := &mockMinioClient{}
+	inner := &s3Uploader{client: mc, bucket: "b", keys: objectkey.Default(), log: zap.NewNop()}
+	up := NewRateLimited(inner, ratelimit.New(0, nil))
+	if err := up.UploadChunk(context.Background(), objectkey.Stream{ID: "s1"}, chunker.Chunk{Data: []byte("data")}); err != nil {
+		t.Fatalf("UploadChunk failed: %v", err)
+	}
+	if err := up.UploadMetadata(context.Background(), objectkey.Stream{ID: "s1"}, []byte("{}")); err != nil {
+		t.Fatalf("UploadMetadata failed: %v", err)
+	}
+	if len(mc.putCalled) != 2 {
+		t.Errorf("expected 2 uploads, got %d", len(mc.putCalled))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := NewRateLimited(inner, ratelimit.New(1, nil))
+	slow.UploadChunk(ctx, objectkey.Stream{ID: "s1"}, chunker.Chunk{Data: []byte("x")})
+	if err := slow.UploadChunk(ctx, objectkey.Stream{ID: "s1"}, chunker.Chunk{Data: []byte("data")}); err == nil {
+		t.Error("throttled upload should fail once the context is cancelled")
+	}
+	if len(mc.putCalled) != 3 {
+		t.Errorf("throttled chunk should not be uploaded, got %d uploads", len(mc.putCalled))
+	}
+}
+
+func TestReplicator_RateLimitPerDestination(t *testing.T) {
+	r, _, dr, store := newTestReplicator(1)
+	// 1000 bytes/s with a full bucket of 1000 bytes; uploads below stay within it and never wait
+	limiter := ratelimit.New(1000, nil)
+	limitDestinations(r.dests, limiter)
+	stream := objectkey.Stream{ID: "s1"}
+	if err := r.UploadChunk(context.Background(), stream, testChunk(0, strings.Repeat("a", 300))); err != nil {
+		t.Fatalf("UploadChunk failed: %v", err)
+	}
+	dr.fail = true
+	if err := r.UploadChunk(context.Background(), stream, testChunk(1, strings.Repeat("b", 100))); err != nil {
+		t.Fatalf("quorum upload should succeed: %v", err)
+	}
+	dr.fail = false
+	if err := r.Backfill(context.Background(), "dr"); err != nil || !store.chunks["dr:s1:1"] {
+		t.Fatalf("backfill failed: %v", err)
+	}
+	// 2x300 for both copies of chunk 0, 2x100 for chunk 1 (the failed attempt is charged too) and 100 for its backfill
+	// leave 100 bytes, so a further 300 bytes must wait about 200ms
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if wait, _ := limiter.WaitN(cancelled, 300); wait < 150*time.Millisecond || wait > 200*time.Millisecond {
+		t.Errorf("every destination and the backfill should be charged, got a wait of %v", wait)
+	}
+}
+
+func TestGuarded_OpensAndRejects(t *testing.T) {
+	mc := &mockMinioClient{putErr: errors.New("minio down")}
+	b := breaker.New("object_storage", 2, time.Hour, nil, zap.NewNop())
+	up := &guarded{Uploader: &s3Uploader{client: mc, bucket: "b", keys: objectkey.Default(), log: zap.NewNop()}, b: b}
+	for i := 0; i < 2; i++ {
+		up.UploadChunk(context.Background(), objectkey.Stream{ID: "s1"}, chunker.Chunk{Index: i, Data: []byte("d")})
+	}
+	err := up.UploadMetadata(context.Background(), objectkey.Stream{ID: "s1"}, []byte("{}"))
+	if !errors.Is(err, breaker.ErrOpen) {
+		t.Errorf("expected ErrOpen after consecutive failures, got %v", err)
+	}
+	if len(mc.putCalled) != 2 {
+		t.Errorf("open breaker should not reach object storage, got %d calls", len(mc.putCalled))
+	}
+}
+
+func TestPresigner(t *testing.T) {
+	mc := &mockMinioClient{}
+	p := &presigner{up: &s3Uploader{client: mc, bucket: "b", keys: objectkey.Default(), log: zap.NewNop()}, expiry: time.Hour}
+	u, err := p.PresignGet(context.Background(), "s1/chunk-00000")
+	if err != nil || u != "https://minio.local/b/s1/chunk-00000?X-Amz-Expires=3600" {
+		t.Errorf("unexpected presigned URL %q, %v", u, err)
+	}
+	if err := p.PutManifest(context.Background(), objectkey.Stream{ID: "s1"}, "s1/signed-manifest.json", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if call := mc.putCalled[0]; call.objectName != "s1/signed-manifest.json" || call.opts.ContentType != "application/json" {
+		t.Errorf("unexpected manifest upload: %s %+v", call.objectName, call.opts)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	primary := &mockMinioClient{objects: []string{"s1/chunk-00000", "s1/chunk-00001", "s1/metadata.json", "s10/chunk-00000"}}
+	replica := &mockMinioClient{objects: []string{"s1/chunk-00001", "s1/chunk-00002"}}
+	c := &collector{dests: []collectorDest{
+		{name: PrimaryDestination, up: &s3Uploader{client: primary, bucket: "b", keys: objectkey.Default(), log: zap.NewNop()}},
+		{name: "dr", up: &s3Uploader{client: replica, bucket: "b", keys: objectkey.Default(), log: zap.NewNop()}},
+	}}
+	keys, err := c.ListChunks(context.Background(), objectkey.Stream{ID: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "s1/chunk-00000,s1/chunk-00001,s1/chunk-00002" {
+		t.Errorf("unexpected chunk keys: %v", keys)
+	}
+	if err := c.RemoveObject(context.Background(), "s1/chunk-00002"); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.removed) != 1 || len(replica.removed) != 1 {
+		t.Errorf("object should be removed from every destination: %v %v", primary.removed, replica.removed)
+	}
+}
+
+func TestSignedManifestKey(t *testing.T) {
+	if got := SignedManifestKey("2025-05-27/cam1/out.mp4/metadata.json"); got != "2025-05-27/cam1/out.mp4/signed-manifest.json" {
+		t.Errorf("unexpected key: %s", got)
+	}
+	if got := SignedManifestKey("out.mp4.json"); got != "signed-manifest.json" {
+		t.Errorf("unexpected key: %s", got)
+	}
+}
+
+func TestUploadMetadata_PublishesVersion(t *testing.T) {
+	keys, _ := objectkey.Parse(objectkey.VersionedChunkTemplate, objectkey.VersionedMetadataTemplate)
+	keys, _ = keys.WithCurrent(objectkey.DefaultCurrentTemplate)
+	mc := &mockMinioClient{objects: []string{"s1/v1/chunk-00000", "s1/v1/chunk-00001", "s1/v2/chunk-00000", "s1/v3/chunk-00000"}}
+	s := &s3Uploader{client: mc, bucket: "b", keys: keys, keepVersions: 2, log: zap.NewNop()}
+	if err := s.UploadMetadata(context.Background(), objectkey.Stream{ID: "s1", Version: 3}, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if len(mc.putCalled) != 3 || mc.putCalled[0].objectName != "s1/v3/metadata.json" || mc.putCalled[1].objectName != "s1/current.json" {
+		t.Fatalf("metadata should be written before the pointer, got %d puts", len(mc.putCalled))
+	}
+	var ptr currentPointer
+	json.Unmarshal(mc.putCalled[2].data, &ptr)
+	if ptr.Version != 3 || ptr.MetadataKey != "s1/v3/metadata.json" || ptr.OldestVersion != 2 {
+		t.Errorf("unexpected pointer: %+v", ptr)
+	}
+	want := "s1/v1/chunk-00000,s1/v1/chunk-00001,s1/v1/metadata.json,s1/v1/signed-manifest.json"
+	if got := strings.Join(mc.removed, ","); got != want {
+		t.Errorf("expected only version 1 to be deleted, got %s", got)
+	}
+}
+
+func TestNewS3Uploader_VersionedTemplates(t *testing.T) {
+	cfg := &config.Config{MinioEndpoint: "localhost:9000", ChunkKeyTemplate: objectkey.DefaultChunkTemplate, MetadataKeyTemplate: objectkey.DefaultMetadataTemplate, CurrentKeyTemplate: objectkey.DefaultCurrentTemplate, StreamVersions: 2}
+	if _, err := newS3Uploader(cfg, zap.NewNop()); err == nil {
+		t.Error("templates without {version} should be rejected when versioning is enabled")
+	}
+	cfg.ChunkKeyTemplate, cfg.MetadataKeyTemplate = objectkey.VersionedChunkTemplate, objectkey.VersionedMetadataTemplate
+	s, err := newS3Uploader(cfg, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.keys.CurrentKey(objectkey.Stream{ID: "s1"}); got != "s1/current.json" {
+		t.Errorf("unexpected current key: %s", got)
+	}
+}
@@ -0,0 +1,34 @@
+package s3uploader
+
+import (
+	"context"
+	"video-stream-processor/internal/chunker"
+	"video-stream-processor/internal/metrics"
+	"video-stream-processor/internal/objectkey"
+	"video-stream-processor/internal/ratelimit"
+)
+
+// rateLimited wraps an Uploader so chunk uploads draw from a shared byte budget.
+// Metadata documents are small and bypass the limiter.
+type rateLimited struct {
+	Uploader
+	limiter *ratelimit.Limiter
+}
+
+// NewRateLimited returns an Uploader that waits on limiter before each chunk upload.
+func NewRateLimited(up Uploader, limiter *ratelimit.Limiter) Uploader {
+	return &rateLimited{Uploader: up, limiter: limiter}
+}
+
+func (r *rateLimited) UploadChunk(ctx context.Context, stream objectkey.Stream, chunk chunker.Chunk) error {
+	wait, err := r.limiter.WaitN(ctx, len(chunk.Data))
+	metrics.UploadThrottleWait.Observe(wait.Seconds())
+	if err != nil {
+		return err
+	}
+	if err := r.Uploader.UploadChunk(ctx, stream, chunk); err != nil {
+		return err
+	}
+	metrics.UploadedBytes.Add(float64(len(chunk.Data)))
+	return nil
+}
@@ -0,0 +1,98 @@
+package s3uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+	"video-stream-processor/internal/objectkey"
+
+	"github.com/minio/minio-go/v7"
+	"go.uber.org/zap"
+)
+
+// currentPointer is the document stored at the current key of a versioned stream. Readers
+// resolve the stream through it, so a version only becomes visible once all of its chunks
+// and its metadata.json have been written.
+type currentPointer struct {
+	Version       int       `json:"version"`
+	MetadataKey   string    `json:"metadata_key"`
+	OldestVersion int       `json:"oldest_version"` // Oldest version whose objects may still exist
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// publishVersion points the stream's current key at metadataKey, then deletes the versions
+// that fall out of the retention window. A pointer to a newer version is never replaced,
+// so a late backfill of an old version cannot roll the stream back.
+func (s *s3Uploader) publishVersion(ctx context.Context, stream objectkey.Stream, metadataKey string) error {
+	currentKey := s.keys.CurrentKey(stream)
+	oldest := 1
+	if data, err := s.readObject(ctx, currentKey); err == nil {
+		var prev currentPointer
+		if err := json.Unmarshal(data, &prev); err == nil {
+			if prev.Version > stream.Version {
+				s.log.Info("Newer version already published, not updating pointer", zap.String("stream_id", stream.ID), zap.Int("version", stream.Version), zap.Int("current", prev.Version))
+				return nil
+			}
+			if prev.OldestVersion > 0 {
+				oldest = prev.OldestVersion
+			}
+		}
+	}
+	ptr := currentPointer{Version: stream.Version, MetadataKey: metadataKey, OldestVersion: oldest, UpdatedAt: time.Now().UTC()}
+	if err := s.putPointer(ctx, stream, currentKey, ptr); err != nil {
+		return err
+	}
+
+	keepFrom := stream.Version - s.keepVersions + 1
+	if keepFrom <= oldest {
+		return nil
+	}
+	for v := oldest; v < keepFrom; v++ {
+		old := stream
+		old.Version = v
+		if err := s.deleteVersion(ctx, old); err != nil {
+			// The pointer still names v as retained, so the next publish retries it
+			s.log.Error("Failed to delete old stream version", zap.String("stream_id", stream.ID), zap.Int("version", v), zap.Error(err))
+			return nil
+		}
+		ptr.OldestVersion = v + 1
+	}
+	if err := s.putPointer(ctx, stream, currentKey, ptr); err != nil {
+		s.log.Warn("Failed to record pruned versions", zap.String("stream_id", stream.ID), zap.Error(err))
+	}
+	return nil
+}
+
+func (s *s3Uploader) putPointer(ctx context.Context, stream objectkey.Stream, key string, ptr currentPointer) error {
+	data, _ := json.Marshal(ptr)
+	if _, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), s.metadataOptions(stream)); err != nil {
+		return fmt.Errorf("put current pointer %s: %w", key, err)
+	}
+	return nil
+}
+
+// deleteVersion removes the chunks, metadata.json and signed manifest of one stream version.
+func (s *s3Uploader) deleteVersion(ctx context.Context, stream objectkey.Stream) error {
+	prefix := s.keys.ChunkPrefix(stream)
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return fmt.Errorf("list %s: %w", prefix, obj.Err)
+		}
+		if _, ok := s.keys.ChunkIndex(stream, obj.Key); !ok {
+			continue
+		}
+		if err := s.client.RemoveObject(ctx, s.bucket, obj.Key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("remove %s: %w", obj.Key, err)
+		}
+	}
+	metadataKey := s.keys.MetadataKey(stream)
+	for _, key := range []string{metadataKey, SignedManifestKey(metadataKey)} {
+		if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+			return fmt.Errorf("remove %s: %w", key, err)
+		}
+	}
+	s.log.Info("Deleted old stream version", zap.String("stream_id", stream.ID), zap.Int("version", stream.Version))
+	return nil
+}
@@ -0,0 +1,138 @@
+// Package streamid maps source files to the stream IDs their chunks, checkpoints and metadata are stored under.
+// The watcher, the workers and the uploader all resolve IDs through a Resolver, so a file keeps one ID end to end.
+package streamid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/redisstore"
+
+	"github.com/google/uuid"
+)
+
+// Strategies for STREAM_ID_STRATEGY.
+const (
+	StrategyBasename = "basename" // file name, e.g. "out.mp4"; files with the same name in different directories collide
+	StrategyPath     = "path"     // path relative to WATCH_DIR, e.g. "cam1/out.mp4"
+	StrategyHash     = "hash"     // hash of the file contents; a changed file becomes a new stream
+	StrategyUUID     = "uuid"     // random ID assigned when the file is first seen, persisted per path
+)
+
+// keyPrefix prefixes the key holding the UUID assigned to a source path. IDs are kept without a TTL,
+// like stream versions, so a file never changes stream.
+const keyPrefix = "stream_id:"
+
+// hashBytes is how much of a file the hash strategy reads, the same amount the change detection hashes.
+const hashBytes = 10 * 1024 * 1024
+
+// Resolver returns the stream ID of a source file according to the configured strategy.
+type Resolver struct {
+	strategy  string
+	namespace string
+	watchDir  string
+	store     redisstore.Store
+	keys      redisstore.Keys
+}
+
+// New returns a Resolver for cfg.StreamIDStrategy. store is only used by the uuid strategy.
+// IDs are prefixed with cfg.StreamIDNamespace.
+func New(cfg *config.Config, store redisstore.Store) *Resolver {
+	return &Resolver{strategy: cfg.StreamIDStrategy, namespace: cfg.StreamIDNamespace, watchDir: cfg.WatchDir, store: store, keys: redisstore.NewKeys(cfg)}
+}
+
+// Resolve returns the stream ID of file.
+func (r *Resolver) Resolve(ctx context.Context, file string) (string, error) {
+	id, err := r.resolve(ctx, file)
+	if err != nil {
+		return "", err
+	}
+	return r.namespace + id, nil
+}
+
+func (r *Resolver) resolve(ctx context.Context, file string) (string, error) {
+	switch r.strategy {
+	case "", StrategyBasename:
+		return filepath.Base(file), nil
+	case StrategyPath:
+		return r.relPath(file)
+	case StrategyHash:
+		return contentHash(file)
+	case StrategyUUID:
+		return r.assignedID(ctx, file)
+	}
+	return "", fmt.Errorf("unknown stream ID strategy %q", r.strategy)
+}
+
+// relPath returns the slash-separated path of file relative to the watch directory.
+func (r *Resolver) relPath(file string) (string, error) {
+	dir, err := filepath.Abs(r.watchDir)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the watch directory %s", file, r.watchDir)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// assignedID returns the ID assigned to the file's absolute path, assigning a new one if it has none.
+// SET NX makes instances that see the same file at once agree on one ID.
+func (r *Resolver) assignedID(ctx context.Context, file string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	key := r.keys.Stream(keyPrefix, abs)
+	id, err := r.store.GetValue(ctx, key)
+	if err == nil && id != "" {
+		return id, nil
+	}
+	if err != nil && err != redisstore.ErrNotFound {
+		return "", err
+	}
+	id = uuid.NewString()
+	set, err := r.store.SetValueNX(ctx, key, id, 0)
+	if err != nil {
+		return "", err
+	}
+	if !set {
+		// Another instance assigned an ID first
+		return r.store.GetValue(ctx, key)
+	}
+	return id, nil
+}
+
+// contentHash returns the SHA256 (hex, first 32 chars) of the file's first 10MB and its size.
+func contentHash(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.CopyN(h, f, hashBytes); err != nil && err != io.EOF {
+		return "", err
+	}
+	binary.Write(h, binary.BigEndian, fi.Size())
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
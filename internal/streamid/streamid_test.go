@@ -0,0 +1,132 @@
+package streamid
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/redisstore"
+)
+
+// mockStore implements the key-value methods of redisstore.Store
+type mockStore struct {
+	redisstore.Store
+	values map[string]string
+	race   string // value another instance sets just before SetValueNX
+}
+
+func (m *mockStore) GetValue(ctx context.Context, key string) (string, error) {
+	v, ok := m.values[key]
+	if !ok {
+		return "", redisstore.ErrNotFound
+	}
+	return v, nil
+}
+func (m *mockStore) SetValueNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	if m.race != "" {
+		m.values[key] = m.race
+	}
+	if _, ok := m.values[key]; ok {
+		return false, nil
+	}
+	m.values[key] = value
+	return true, nil
+}
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "cam1"), 0755)
+	os.MkdirAll(filepath.Join(dir, "cam2"), 0755)
+	cam1 := filepath.Join(dir, "cam1", "out.mp4")
+	cam2 := filepath.Join(dir, "cam2", "out.mp4")
+	os.WriteFile(cam1, []byte("first"), 0644)
+	os.WriteFile(cam2, []byte("second"), 0644)
+	ctx := context.Background()
+	resolve := func(strategy, file string) string {
+		t.Helper()
+		id, err := New(&config.Config{StreamIDStrategy: strategy, WatchDir: dir}, &mockStore{values: map[string]string{}}).Resolve(ctx, file)
+		if err != nil {
+			t.Fatalf("%s: %v", strategy, err)
+		}
+		return id
+	}
+
+	if id := resolve(StrategyBasename, cam1); id != "out.mp4" {
+		t.Errorf("unexpected basename ID %q", id)
+	}
+	if id := resolve(StrategyPath, cam1); id != "cam1/out.mp4" {
+		t.Errorf("unexpected path ID %q", id)
+	}
+	if _, err := New(&config.Config{StreamIDStrategy: StrategyPath, WatchDir: filepath.Join(dir, "cam1")}, nil).Resolve(ctx, cam2); err == nil {
+		t.Error("files outside the watch directory should be rejected")
+	}
+	if resolve(StrategyHash, cam1) == resolve(StrategyHash, cam2) {
+		t.Error("files with different contents should get different hash IDs")
+	}
+	os.WriteFile(cam2, []byte("first"), 0644)
+	if resolve(StrategyHash, cam1) != resolve(StrategyHash, cam2) {
+		t.Error("hash ID should only depend on the contents")
+	}
+	if _, err := New(&config.Config{StreamIDStrategy: "bogus"}, nil).Resolve(ctx, cam1); err == nil {
+		t.Error("unknown strategy should fail")
+	}
+}
+
+func TestResolve_UUID(t *testing.T) {
+	store := &mockStore{values: map[string]string{}}
+	r := New(&config.Config{StreamIDStrategy: StrategyUUID}, store)
+	ctx := context.Background()
+	id, err := r.Resolve(ctx, "/videos/cam1/out.mp4")
+	if err != nil || len(id) != 36 {
+		t.Fatalf("expected a UUID, got %q (%v)", id, err)
+	}
+	if again, _ := r.Resolve(ctx, "/videos/cam1/out.mp4"); again != id {
+		t.Errorf("ID should be persisted, got %q then %q", id, again)
+	}
+	if other, _ := r.Resolve(ctx, "/videos/cam2/out.mp4"); other == id {
+		t.Error("files with the same name should get different IDs")
+	}
+
+	// Another instance assigns the ID between our read and write
+	store.race = "assigned-elsewhere"
+	if id, _ := r.Resolve(ctx, "/videos/cam3/out.mp4"); id != "assigned-elsewhere" {
+		t.Errorf("the first assigned ID should win, got %q", id)
+	}
+}
+
+func TestResolve_ProfilesDoNotCollide(t *testing.T) {
+	root := t.TempDir()
+	a := filepath.Join(root, "a", "cam1.mp4")
+	b := filepath.Join(root, "b", "cam1.mp4")
+	for _, f := range []string{a, b} {
+		os.MkdirAll(filepath.Dir(f), 0755)
+		os.WriteFile(f, []byte("same contents"), 0644)
+	}
+	ctx := context.Background()
+	for _, strategy := range []string{StrategyBasename, StrategyPath, StrategyHash} {
+		cfg := &config.Config{StreamIDStrategy: strategy, ProfilesFile: "profiles.yaml"}
+		idA, err := New(cfg.ForProfile(config.Profile{Name: "A", WatchDir: filepath.Join(root, "a")}), nil).Resolve(ctx, a)
+		if err != nil {
+			t.Fatalf("%s: %v", strategy, err)
+		}
+		idB, err := New(cfg.ForProfile(config.Profile{Name: "B", WatchDir: filepath.Join(root, "b")}), nil).Resolve(ctx, b)
+		if err != nil {
+			t.Fatalf("%s: %v", strategy, err)
+		}
+		if idA == idB {
+			t.Errorf("%s: files of different profiles share stream ID %q", strategy, idA)
+		}
+		if !strings.HasPrefix(idA, "A/") || !strings.HasPrefix(idB, "B/") {
+			t.Errorf("%s: IDs should be prefixed with the profile name, got %q and %q", strategy, idA, idB)
+		}
+	}
+
+	// Without a profiles file the single default profile keeps unprefixed IDs
+	cfg := &config.Config{StreamIDStrategy: StrategyBasename}
+	if id, _ := New(cfg.ForProfile(config.Profile{Name: config.DefaultProfile, WatchDir: root}), nil).Resolve(ctx, a); id != "cam1.mp4" {
+		t.Errorf("unexpected default profile ID %q", id)
+	}
+}
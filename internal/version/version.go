@@ -0,0 +1,8 @@
+// Package version holds the processor build version.
+// It is set at build time, e.g.:
+//
+//	go build -ldflags "-X video-stream-processor/internal/version.Version=1.2.3" ./cmd/main.go
+package version
+
+// Version is the processor version recorded on uploaded objects. Defaults to "dev" for local builds.
+var Version = "dev"
@@ -0,0 +1,188 @@
+package watcher
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/container"
+)
+
+// Modes for CONTAINER_CHECK.
+const (
+	ContainerCheckOff    = "off"    // trust the extension
+	ContainerCheckRoute  = "route"  // mislabeled files are processed according to their content, unrecognized content as plain bytes
+	ContainerCheckReject = "reject" // reject files whose content is unrecognized or does not match their extension
+)
+
+// candidate is a file the filter chain decides on.
+type candidate struct {
+	path string
+	rel  string      // Slash-separated path relative to the watch directory
+	info fs.FileInfo // nil while only the name is checked
+}
+
+// fileFilter is one rule of the filter chain. It returns why the file is rejected, or "" to let it through.
+// Rules on size and age let every file through while info is nil.
+type fileFilter func(c candidate) string
+
+// filterChain applies its rules in order; the first rejection wins.
+type filterChain []fileFilter
+
+// check returns why the file is rejected, or "" if every rule lets it through.
+func (fc filterChain) check(c candidate) string {
+	for _, f := range fc {
+		if reason := f(c); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// newFilterChain builds the filter chain configured in cfg: hidden files, extensions,
+// include and exclude globs, size and age limits, then the container check. The minimum age is not a rule of the chain:
+// files younger than it are kept waiting rather than rejected, see checkStableFiles.
+func newFilterChain(cfg *config.Config) (filterChain, error) {
+	for _, p := range append(append([]string{}, cfg.WatchInclude...), cfg.WatchExclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", p, err)
+		}
+	}
+	var fc filterChain
+	if cfg.WatchSkipHidden {
+		fc = append(fc, hiddenFilter)
+	}
+	fc = append(fc, extFilter(cfg.VideoFileFormats))
+	if len(cfg.WatchInclude) > 0 {
+		fc = append(fc, includeFilter(cfg.WatchInclude))
+	}
+	if len(cfg.WatchExclude) > 0 {
+		fc = append(fc, excludeFilter(cfg.WatchExclude))
+	}
+	if cfg.WatchMinSize > 0 || cfg.WatchMaxSize > 0 {
+		fc = append(fc, sizeFilter(cfg.WatchMinSize, cfg.WatchMaxSize))
+	}
+	if cfg.WatchMaxAge > 0 {
+		fc = append(fc, maxAgeFilter(time.Duration(cfg.WatchMaxAge)*time.Second, time.Now))
+	}
+	switch cfg.ContainerCheck {
+	case "", ContainerCheckOff:
+	case ContainerCheckRoute, ContainerCheckReject:
+		fc = append(fc, containerFilter(cfg.ContainerCheck == ContainerCheckReject))
+	default:
+		return nil, fmt.Errorf("unknown container check %q", cfg.ContainerCheck)
+	}
+	return fc, nil
+}
+
+// hiddenFilter rejects dot files and files in dot directories, such as ".~tmp" files recorders write before renaming.
+func hiddenFilter(c candidate) string {
+	for _, elem := range strings.Split(c.rel, "/") {
+		if strings.HasPrefix(elem, ".") && elem != "." && elem != ".." {
+			return "hidden"
+		}
+	}
+	return ""
+}
+
+func extFilter(exts []string) fileFilter {
+	return func(c candidate) string {
+		if !isAllowedExt(c.path, exts) {
+			return "extension not watched"
+		}
+		return ""
+	}
+}
+
+func includeFilter(patterns []string) fileFilter {
+	return func(c candidate) string {
+		if _, ok := matchGlob(patterns, c.rel); !ok {
+			return "matches no include pattern"
+		}
+		return ""
+	}
+}
+
+func excludeFilter(patterns []string) fileFilter {
+	return func(c candidate) string {
+		if p, ok := matchGlob(patterns, c.rel); ok {
+			return "matches exclude pattern " + p
+		}
+		return ""
+	}
+}
+
+// sizeFilter rejects files smaller than minSize or larger than maxSize bytes; 0 disables a limit.
+func sizeFilter(minSize, maxSize int64) fileFilter {
+	return func(c candidate) string {
+		if c.info == nil {
+			return ""
+		}
+		if size := c.info.Size(); size < minSize {
+			return fmt.Sprintf("smaller than %d bytes", minSize)
+		} else if maxSize > 0 && size > maxSize {
+			return fmt.Sprintf("larger than %d bytes", maxSize)
+		}
+		return ""
+	}
+}
+
+// maxAgeFilter rejects files last modified more than maxAge ago, e.g. an old backlog left in the directory.
+func maxAgeFilter(maxAge time.Duration, now func() time.Time) fileFilter {
+	return func(c candidate) string {
+		if c.info != nil && now().Sub(c.info.ModTime()) > maxAge {
+			return fmt.Sprintf("modified more than %s ago", maxAge)
+		}
+		return ""
+	}
+}
+
+// containerFilter sniffs the file's first bytes and rejects unreadable files. If strict it also rejects
+// content that is not a recognized video container or does not match the file's extension; otherwise
+// the worker chunks files by their content, and unrecognized content as plain bytes.
+func containerFilter(strict bool) fileFilter {
+	return func(c candidate) string {
+		if c.info == nil {
+			return ""
+		}
+		format, err := container.DetectFile(c.path)
+		switch {
+		case err != nil:
+			return "unreadable: " + err.Error()
+		case !strict:
+			return ""
+		case format == container.Unknown:
+			return "unrecognized container"
+		case !container.MatchesExt(format, c.path):
+			return fmt.Sprintf("content is %s, not %s", format, filepath.Ext(c.path))
+		}
+		return ""
+	}
+}
+
+// matchGlob returns the first pattern matching rel. Patterns containing a slash are matched against
+// the path relative to the watch directory, others against the file name.
+func matchGlob(patterns []string, rel string) (string, bool) {
+	for _, p := range patterns {
+		name := path.Base(rel)
+		if strings.Contains(p, "/") {
+			name = rel
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// relPath returns file's slash-separated path relative to dir, or its name if it is not inside dir.
+func relPath(dir, file string) string {
+	rel, err := filepath.Rel(dir, file)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return filepath.Base(file)
+	}
+	return filepath.ToSlash(rel)
+}
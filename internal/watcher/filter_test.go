@@ -0,0 +1,153 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/queue"
+
+	"go.uber.org/zap"
+)
+
+func TestFilterChain(t *testing.T) {
+	dir := t.TempDir()
+	write := func(rel string, size int, age time.Duration) string {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		os.WriteFile(p, make([]byte, size), 0644)
+		mtime := time.Now().Add(-age)
+		os.Chtimes(p, mtime, mtime)
+		return p
+	}
+	write("cam1/a.mp4", 100, 0)
+	write("cam1/a.mp4.part", 100, 0)
+	write("cam1/.~tmp.mp4", 100, 0)
+	write(".cache/b.mp4", 100, 0)
+	write("cam1/clip_preview.mp4", 100, 0)
+	write("cam1/small.mp4", 10, 0)
+	write("cam1/old.mp4", 100, 48*time.Hour)
+	write("misc/c.mp4", 100, 0)
+
+	cfg := &config.Config{
+		WatchDir: dir, WatchRecursive: true, VideoFileFormats: []string{".mp4"},
+		WatchInclude: []string{"cam*/*"}, WatchExclude: []string{"*_preview.mp4"},
+		WatchSkipHidden: true, WatchMinSize: 50, WatchMaxAge: 3600,
+	}
+	fc, err := newFilterChain(cfg)
+	if err != nil {
+		t.Fatalf("newFilterChain failed: %v", err)
+	}
+	w := &Watcher{cfg: cfg, log: zap.NewNop(), filters: fc}
+
+	// Names are filtered while listing; size and age once the file is stable
+	files, _ := w.listFiles(dir)
+	var listed []string
+	for _, f := range files {
+		listed = append(listed, relPath(dir, f))
+	}
+	sort.Strings(listed)
+	want := []string{"cam1/a.mp4", "cam1/old.mp4", "cam1/small.mp4"}
+	if len(listed) != len(want) {
+		t.Fatalf("expected %v listed, got %v", want, listed)
+	}
+	for i := range want {
+		if listed[i] != want[i] {
+			t.Fatalf("expected %v listed, got %v", want, listed)
+		}
+	}
+	for _, f := range files {
+		info, _ := os.Stat(f)
+		reason := fc.check(candidate{path: f, rel: relPath(dir, f), info: info})
+		if ok := relPath(dir, f) == "cam1/a.mp4"; ok != (reason == "") {
+			t.Errorf("%s: unexpected filter result %q", f, reason)
+		}
+	}
+
+	if _, err := newFilterChain(&config.Config{WatchExclude: []string{"[bad"}}); err == nil {
+		t.Error("invalid glob patterns should be rejected")
+	}
+}
+
+func TestCheckStableFiles_FilterAndMinAge(t *testing.T) {
+	dir := t.TempDir()
+	fresh := filepath.Join(dir, "fresh.mp4")
+	small := filepath.Join(dir, "small.mp4")
+	renamed := filepath.Join(dir, "gone.mp4")
+	os.WriteFile(fresh, make([]byte, 100), 0644)
+	os.WriteFile(small, make([]byte, 10), 0644)
+	cfg := &config.Config{WatchDir: dir, StabilityThreshold: 1, VideoFileFormats: []string{".mp4"}, WatchMinSize: 50, WatchMinAge: 3600}
+	q := queue.NewChannel(3)
+	store := &mockRedisStore{statusMap: map[string]string{}, hashMap: map[string]string{}}
+	w := New(cfg, config.Profile{}, zap.NewNop(), q, store).(*Watcher)
+	past := time.Now().Add(-time.Minute)
+	for _, f := range []string{fresh, small, renamed} {
+		w.seen[f] = past
+	}
+	w.checkStableFiles(time.Second)
+
+	if file, ok := dequeue(q, 100*time.Millisecond); ok {
+		t.Fatalf("nothing should be queued yet, got %s", file)
+	}
+	if _, ok := w.seen[fresh]; !ok {
+		t.Error("a file younger than the minimum age should keep waiting")
+	}
+	if _, ok := w.seen[small]; ok {
+		t.Error("a filtered file should be forgotten")
+	}
+	if _, ok := w.seen[renamed]; ok {
+		t.Error("a vanished file should be forgotten")
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(fresh, old, old)
+	w.checkStableFiles(time.Second)
+	if file, ok := dequeue(q, time.Second); !ok || file != fresh {
+		t.Errorf("expected %s once old enough, got %q", fresh, file)
+	}
+}
+
+func TestContainerFilter(t *testing.T) {
+	dir := t.TempDir()
+	mp4 := []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00")
+	files := map[string][]byte{
+		"real.mp4":     mp4,
+		"misnamed.mkv": mp4,
+		"text.mp4":     []byte("not a video"),
+	}
+	for name, data := range files {
+		os.WriteFile(filepath.Join(dir, name), data, 0644)
+	}
+	check := func(mode, name string) string {
+		fc, err := newFilterChain(&config.Config{VideoFileFormats: []string{".mp4", ".mkv"}, ContainerCheck: mode})
+		if err != nil {
+			t.Fatalf("newFilterChain failed: %v", err)
+		}
+		p := filepath.Join(dir, name)
+		info, _ := os.Stat(p)
+		return fc.check(candidate{path: p, rel: name, info: info})
+	}
+	if r := check(ContainerCheckRoute, "real.mp4"); r != "" {
+		t.Errorf("a valid mp4 should pass, got %q", r)
+	}
+	if r := check(ContainerCheckRoute, "misnamed.mkv"); r != "" {
+		t.Errorf("route mode should let mislabeled files through, got %q", r)
+	}
+	if r := check(ContainerCheckReject, "misnamed.mkv"); r != "content is mp4, not .mkv" {
+		t.Errorf("reject mode should reject mislabeled files, got %q", r)
+	}
+	if r := check(ContainerCheckRoute, "text.mp4"); r != "" {
+		t.Errorf("route mode should let unrecognized content through to the plain chunker, got %q", r)
+	}
+	if r := check(ContainerCheckReject, "text.mp4"); r != "unrecognized container" {
+		t.Errorf("reject mode should reject unrecognized content, got %q", r)
+	}
+	if r := check(ContainerCheckOff, "text.mp4"); r != "" {
+		t.Errorf("off mode should trust the extension, got %q", r)
+	}
+	if _, err := newFilterChain(&config.Config{ContainerCheck: "bogus"}); err == nil {
+		t.Error("unknown modes should be rejected")
+	}
+}
@@ -0,0 +1,73 @@
+package watcher
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Strategies for WATCH_READINESS, deciding when a file is complete and can be queued.
+const (
+	ReadinessStable = "stable" // the file has not changed for the stability threshold
+	ReadinessMarker = "marker" // a sidecar marker, e.g. "clip.mp4.done", has been created next to it
+	ReadinessRename = "rename" // it has been renamed into place from a temporary name the filters exclude
+)
+
+// fileEvent handles a change to a file in a watched directory according to the readiness strategy.
+// renamed reports whether the previous event was a rename. Under the marker strategy only the marker's
+// creation matters, and it queues the file at once instead of waiting for the stability threshold.
+// Under the rename strategy a rename into place queues the file at once; fsnotify reports a rename
+// within the watched directories as a Rename of the old name directly followed by a Create of the new
+// one. Any other create, e.g. a writer creating the file under its final name and then writing to it,
+// or a move from an unwatched directory, waits for the stability threshold like under the stable strategy.
+func (w *Watcher) fileEvent(event fsnotify.Event, renamed bool) {
+	switch w.cfg.WatchReadiness {
+	case ReadinessMarker:
+		if event.Op&fsnotify.Create != 0 && strings.HasSuffix(event.Name, w.cfg.WatchMarkerSuffix) {
+			w.trigger(strings.TrimSuffix(event.Name, w.cfg.WatchMarkerSuffix))
+		}
+	case ReadinessRename:
+		if event.Op&fsnotify.Create != 0 && renamed {
+			w.trigger(event.Name)
+			return
+		}
+		fallthrough
+	default:
+		w.mu.Lock()
+		w.seen[event.Name] = time.Now()
+		w.mu.Unlock()
+	}
+}
+
+// trigger queues file immediately if its name passes the filters.
+func (w *Watcher) trigger(file string) {
+	if w.filters.check(candidate{path: file, rel: relPath(w.cfg.WatchDir, file)}) != "" {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seen[file] = time.Time{}
+	w.checkFile(file, time.Now())
+}
+
+// track records a file found by a directory scan and reports whether it was recorded. Under the
+// stable strategy it becomes due once unchanged for the stability threshold after at; under the
+// marker strategy it is due at once if its marker exists, and is otherwise left for the marker's
+// event. Under the rename strategy a scan cannot tell a file renamed into place from one still being
+// written, so it becomes due once unchanged for the stability threshold from now.
+// The caller must hold w.mu.
+func (w *Watcher) track(file string, at time.Time) bool {
+	switch w.cfg.WatchReadiness {
+	case ReadinessMarker:
+		if _, err := os.Stat(file + w.cfg.WatchMarkerSuffix); err != nil {
+			return false
+		}
+		at = time.Time{}
+	case ReadinessRename:
+		at = time.Now()
+	}
+	w.seen[file] = at
+	return true
+}
@@ -0,0 +1,87 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/queue"
+
+	"go.uber.org/zap"
+)
+
+// startWatcher runs a watcher on dir with a stability threshold long enough that only triggers queue files
+func startWatcher(t *testing.T, dir string, readiness string) queue.Queue {
+	t.Helper()
+	cfg := &config.Config{WatchDir: dir, StabilityThreshold: 60, VideoFileFormats: []string{".mp4"}, WatchReadiness: readiness, WatchMarkerSuffix: ".done"}
+	q := queue.NewChannel(4)
+	store := &mockRedisStore{statusMap: map[string]string{}, hashMap: map[string]string{}}
+	w := New(cfg, config.Profile{}, zap.NewNop(), q, store)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go w.Start(ctx)
+	time.Sleep(200 * time.Millisecond)
+	return q
+}
+
+func TestReadiness_Marker(t *testing.T) {
+	dir := t.TempDir()
+	marked := filepath.Join(dir, "marked.mp4")
+	os.WriteFile(marked, []byte("data"), 0644)
+	os.WriteFile(marked+".done", nil, 0644)
+	os.WriteFile(filepath.Join(dir, "unmarked.mp4"), []byte("data"), 0644)
+	q := startWatcher(t, dir, ReadinessMarker)
+
+	if file, ok := dequeue(q, time.Second); !ok || file != marked {
+		t.Fatalf("a file with a marker at startup should be queued, got %q", file)
+	}
+	clip := filepath.Join(dir, "clip.mp4")
+	os.WriteFile(clip, []byte("data"), 0644)
+	if file, ok := dequeue(q, 300*time.Millisecond); ok {
+		t.Fatalf("files without a marker should wait, got %s", file)
+	}
+	os.WriteFile(clip+".done", nil, 0644)
+	if file, ok := dequeue(q, time.Second); !ok || file != clip {
+		t.Errorf("creating the marker should queue the file at once, got %q", file)
+	}
+}
+
+func TestReadiness_Rename(t *testing.T) {
+	dir := t.TempDir()
+	q := startWatcher(t, dir, ReadinessRename)
+
+	clip := filepath.Join(dir, "clip.mp4")
+	os.WriteFile(clip+".part", []byte("data"), 0644)
+	if file, ok := dequeue(q, 300*time.Millisecond); ok {
+		t.Fatalf("temporary files should not be queued, got %s", file)
+	}
+	os.Rename(clip+".part", clip)
+	if file, ok := dequeue(q, time.Second); !ok || file != clip {
+		t.Errorf("renaming into place should queue the file at once, got %q", file)
+	}
+}
+
+func TestReadiness_RenameCreateThenWrite(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.mp4")
+	os.WriteFile(existing, []byte("data"), 0644)
+	q := startWatcher(t, dir, ReadinessRename)
+	if file, ok := dequeue(q, 300*time.Millisecond); ok {
+		t.Fatalf("files found at startup should wait to be stable, got %s", file)
+	}
+
+	// A writer creating the file under its final name is not done when the file appears
+	clip := filepath.Join(dir, "clip.mp4")
+	f, err := os.Create(clip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	f.Write([]byte("data"))
+	f.Close()
+	if file, ok := dequeue(q, 300*time.Millisecond); ok {
+		t.Errorf("a file created in place should wait to be stable, got %s", file)
+	}
+}
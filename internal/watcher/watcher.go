@@ -3,6 +3,7 @@
 // Only files with extensions specified in the config are processed.
 //
 // The watcher is used by the main application to trigger chunked uploads and processing workflows.
+// Each watch profile has its own watcher; the files it queues carry the profile's name and priority.
 //
 // For details, see README.md and architecture diagrams.
 package watcher
@@ -11,7 +12,9 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -19,7 +22,9 @@ import (
 	"time"
 	"video-stream-processor/internal/config"
 	"video-stream-processor/internal/metrics"
+	"video-stream-processor/internal/queue"
 	"video-stream-processor/internal/redisstore"
+	"video-stream-processor/internal/streamid"
 
 	"github.com/fsnotify/fsnotify"
 	"go.uber.org/zap"
@@ -31,24 +36,36 @@ type WatcherInterface interface {
 }
 
 type Watcher struct {
-	cfg    *config.Config
-	log    *zap.Logger
-	fileCh chan<- string
-	seen   map[string]time.Time
-	hashes map[string]string // file path -> last known hash
-	mu     sync.Mutex
-	redis  redisstore.Store // Add redis client to watcher
+	cfg     *config.Config // Configuration with the profile's settings applied
+	profile config.Profile
+	log     *zap.Logger
+	queue   queue.Queue
+	seen    map[string]time.Time
+	hashes  map[string]string // file path -> last known hash
+	mu      sync.Mutex
+	redis   redisstore.Store // Add redis client to watcher
+	ids     *streamid.Resolver
+	filters filterChain // Decides which files are picked up
 }
 
-// New returns a new Watcher that implements WatcherInterface.
-func New(cfg *config.Config, log *zap.Logger, fileCh chan<- string, redis redisstore.Store) WatcherInterface {
+// New returns a new Watcher that implements WatcherInterface, watching the profile's directory.
+// A zero profile watches cfg.WatchDir with the global settings.
+func New(cfg *config.Config, profile config.Profile, log *zap.Logger, q queue.Queue, redis redisstore.Store) WatcherInterface {
+	cfg = cfg.ForProfile(profile)
+	filters, err := newFilterChain(cfg)
+	if err != nil {
+		log.Fatal("Invalid watch filters", zap.String("profile", profile.Name), zap.Error(err))
+	}
 	return &Watcher{
-		cfg:    cfg,
-		log:    log,
-		fileCh: fileCh,
-		seen:   make(map[string]time.Time),
-		hashes: make(map[string]string),
-		redis:  redis,
+		cfg:     cfg,
+		profile: profile,
+		log:     log.With(zap.String("profile", profile.Name)),
+		queue:   q,
+		seen:    make(map[string]time.Time),
+		hashes:  make(map[string]string),
+		redis:   redis,
+		ids:     streamid.New(cfg, redis),
+		filters: filters,
 	}
 }
 
@@ -62,6 +79,9 @@ func (w *Watcher) Start(ctx context.Context) {
 	if err := watcher.Add(w.cfg.WatchDir); err != nil {
 		w.log.Fatal("Failed to watch dir", zap.String("dir", w.cfg.WatchDir), zap.Error(err))
 	}
+	if w.cfg.WatchRecursive {
+		w.watchSubdirs(watcher, w.cfg.WatchDir)
+	}
 
 	// Scan for existing files on startup
 	w.scanExistingFiles()
@@ -85,15 +105,22 @@ func (w *Watcher) Start(ctx context.Context) {
 		}
 	}()
 
+	var lastOp fsnotify.Op // Op of the previous event, to pair a rename's Create with its Rename
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case event := <-watcher.Events:
+			renamed := lastOp&fsnotify.Rename != 0
+			lastOp = event.Op
+			if event.Op&fsnotify.Create != 0 && w.cfg.WatchRecursive {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					w.addDir(watcher, event.Name)
+					continue
+				}
+			}
 			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Chmod) != 0 {
-				w.mu.Lock()
-				w.seen[event.Name] = time.Now()
-				w.mu.Unlock()
+				w.fileEvent(event, renamed)
 			}
 		case err := <-watcher.Errors:
 			w.log.Error("Watcher error", zap.Error(err))
@@ -104,19 +131,102 @@ func (w *Watcher) Start(ctx context.Context) {
 
 // scanExistingFiles scans the watch directory for video files on startup and adds them to the seen map.
 func (w *Watcher) scanExistingFiles() {
-	files, err := filepath.Glob(filepath.Join(w.cfg.WatchDir, "*"))
+	files, err := w.listFiles(w.cfg.WatchDir)
 	if err != nil {
 		w.log.Error("Failed to scan watch dir", zap.Error(err))
 		return
 	}
 	now := time.Now()
 	for _, file := range files {
-		if isAllowedExt(file, w.cfg.VideoFileFormats) {
-			w.mu.Lock()
-			w.seen[file] = now.Add(-2 * time.Duration(w.cfg.StabilityThreshold) * time.Second) // Mark as old enough
-			w.mu.Unlock()
+		w.mu.Lock()
+		w.track(file, now.Add(-2*time.Duration(w.cfg.StabilityThreshold)*time.Second)) // Mark as old enough
+		w.mu.Unlock()
+	}
+}
+
+// listFiles returns the video files in dir and, when watching recursively, in its subdirectories
+// down to the configured maximum depth.
+func (w *Watcher) listFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			// A subdirectory removed or unreadable mid-scan does not stop the scan
+			w.log.Warn("Failed to scan directory", zap.String("dir", path), zap.Error(err))
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir && !w.watchable(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if w.filters.check(candidate{path: path, rel: relPath(w.cfg.WatchDir, path)}) == "" {
+			files = append(files, path)
 		}
+		return nil
+	})
+	return files, err
+}
+
+// watchable reports whether files in dir are watched: the watch directory itself and, when
+// recursive, its subdirectories down to the maximum depth.
+func (w *Watcher) watchable(dir string) bool {
+	rel, err := filepath.Rel(w.cfg.WatchDir, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
 	}
+	if rel == "." {
+		return true
+	}
+	if !w.cfg.WatchRecursive {
+		return false
+	}
+	depth := strings.Count(rel, string(filepath.Separator)) + 1
+	return w.cfg.WatchMaxDepth <= 0 || depth <= w.cfg.WatchMaxDepth
+}
+
+// watchSubdirs registers watches for the subdirectories of dir within the maximum depth.
+func (w *Watcher) watchSubdirs(fsw *fsnotify.Watcher, dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == dir {
+			return nil
+		}
+		if !w.watchable(path) {
+			return filepath.SkipDir
+		}
+		if err := fsw.Add(path); err != nil {
+			w.log.Error("Failed to watch dir", zap.String("dir", path), zap.Error(err))
+		}
+		return nil
+	})
+}
+
+// addDir starts watching a directory created (or moved) into the watched tree. Files may have been
+// written to it before its watch was registered, so its existing files are picked up as well.
+func (w *Watcher) addDir(fsw *fsnotify.Watcher, dir string) {
+	if !w.watchable(dir) {
+		return
+	}
+	if err := fsw.Add(dir); err != nil {
+		w.log.Error("Failed to watch dir", zap.String("dir", dir), zap.Error(err))
+		return
+	}
+	w.watchSubdirs(fsw, dir)
+	w.log.Info("Watching new directory", zap.String("dir", dir))
+	files, err := w.listFiles(dir)
+	if err != nil {
+		w.log.Error("Failed to scan new directory", zap.String("dir", dir), zap.Error(err))
+		return
+	}
+	now := time.Now()
+	w.mu.Lock()
+	for _, file := range files {
+		w.track(file, now)
+	}
+	w.mu.Unlock()
 }
 
 // isAllowedExt checks if the file extension is in the allowed list.
@@ -130,39 +240,84 @@ func isAllowedExt(file string, allowedExts []string) bool {
 	return false
 }
 
-// filterFile checks Redis for the file's hash and status. Returns true if the file is new or changed.
-func (w *Watcher) filterFile(file string) bool {
+// filterFile checks Redis for the file's hash and status. Returns the file's stream ID and true if the file is new or changed
+// and its stream is not cancelled.
+func (w *Watcher) filterFile(file string) (string, bool) {
+	streamID, err := w.ids.Resolve(context.Background(), file)
+	if err != nil {
+		w.log.Error("Watcher: failed to resolve stream ID, skipping", zap.String("file", file), zap.Error(err))
+		return "", false
+	}
 	hash := fileHash(file)
-	streamID := filepath.Base(file)
-	hashKey := "file_hash:" + streamID
+	hashKey := redisstore.NewKeys(w.cfg).Stream("file_hash:", streamID)
 	status, _ := w.redis.GetStreamStatus(context.Background(), streamID)
 	prevHash, _ := w.redis.GetValue(context.Background(), hashKey)
 	if prevHash == hash && status == "completed" {
 		w.log.Info("Watcher: file already processed and hash unchanged, skipping", zap.String("file", file), zap.String("stream_id", streamID))
-		return false
+		return streamID, false
+	}
+	if status == string(redisstore.StateCancelled) {
+		// Only an operator's reset brings a cancelled stream back
+		w.log.Info("Watcher: stream is cancelled, skipping", zap.String("file", file), zap.String("stream_id", streamID))
+		return streamID, false
+	}
+	return streamID, true
+}
+
+// setState records a lifecycle transition of a stream. A rejected transition, e.g. detecting a file
+// that is still being uploaded, is expected and only logged at debug level.
+func (w *Watcher) setState(streamID string, to redisstore.StreamState) {
+	err := w.redis.TransitionStream(context.Background(), streamID, to, "")
+	switch {
+	case errors.Is(err, redisstore.ErrInvalidTransition):
+		w.log.Debug("Watcher: stream state unchanged", zap.String("stream_id", streamID), zap.String("state", string(to)), zap.Error(err))
+	case err != nil:
+		w.log.Error("Watcher: failed to update stream state", zap.String("stream_id", streamID), zap.String("state", string(to)), zap.Error(err))
+		metrics.RedisErrors.Inc()
 	}
-	return true
 }
 
+// checkStableFiles queues the files that have not changed for debounce and pass the filter chain.
+// Files queued by a marker or rename trigger are recorded as due at once.
 func (w *Watcher) checkStableFiles(debounce time.Duration) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	now := time.Now()
 	for file, last := range w.seen {
 		if now.Sub(last) > debounce {
-			ext := strings.ToLower(filepath.Ext(file))
-			for _, allowed := range w.cfg.VideoFileFormats {
-				if ext == allowed {
-					if w.filterFile(file) {
-						w.fileCh <- file
-						metrics.FilesDetected.Inc()
-					}
-					break
-				}
-			}
-			delete(w.seen, file)
+			w.checkFile(file, now)
+		}
+	}
+}
+
+// checkFile queues a due file if it passes the filter chain and is new or changed, and forgets it
+// unless it has to be retried. Files that vanished, e.g. a ".part" file renamed to its final name,
+// are forgotten. The caller must hold w.mu.
+func (w *Watcher) checkFile(file string, now time.Time) {
+	info, err := os.Stat(file)
+	if err != nil || info.IsDir() {
+		delete(w.seen, file)
+		return
+	}
+	if reason := w.filters.check(candidate{path: file, rel: relPath(w.cfg.WatchDir, file), info: info}); reason != "" {
+		w.log.Info("Watcher: file filtered out", zap.String("file", file), zap.String("reason", reason))
+		delete(w.seen, file)
+		return
+	}
+	if now.Sub(info.ModTime()) < time.Duration(w.cfg.WatchMinAge)*time.Second {
+		return
+	}
+	if streamID, ok := w.filterFile(file); ok {
+		w.setState(streamID, redisstore.StateDetected)
+		if err := w.queue.Enqueue(context.Background(), queue.Job{File: file, Profile: w.profile.Name, Priority: w.profile.Priority}); err != nil {
+			// Keep the file so the next check retries it
+			w.log.Error("Watcher: failed to queue file", zap.String("file", file), zap.Error(err))
+			return
 		}
+		w.setState(streamID, redisstore.StateQueued)
+		metrics.FilesDetected.Inc()
 	}
+	delete(w.seen, file)
 }
 
 // periodicRescan periodically scans the directory for new or changed files.
@@ -181,23 +336,21 @@ func (w *Watcher) periodicRescan(ctx context.Context, debounce time.Duration) {
 
 // rescanFiles checks for new files and for file content changes (by hash).
 func (w *Watcher) rescanFiles() {
-	files, err := filepath.Glob(filepath.Join(w.cfg.WatchDir, "*"))
+	files, err := w.listFiles(w.cfg.WatchDir)
 	if err != nil {
 		w.log.Error("Failed to rescan watch dir", zap.Error(err))
 		return
 	}
 	now := time.Now()
 	for _, file := range files {
-		if isAllowedExt(file, w.cfg.VideoFileFormats) {
-			hash := fileHash(file)
-			w.mu.Lock()
-			prevHash, seen := w.hashes[file]
-			if !seen || prevHash != hash {
-				w.seen[file] = now.Add(-2 * time.Duration(w.cfg.StabilityThreshold) * time.Second)
-				w.hashes[file] = hash
-			}
-			w.mu.Unlock()
+		hash := fileHash(file)
+		w.mu.Lock()
+		prevHash, seen := w.hashes[file]
+		// A file waiting for its marker is not recorded, so a later rescan still finds it new
+		if (!seen || prevHash != hash) && w.track(file, now.Add(-2*time.Duration(w.cfg.StabilityThreshold)*time.Second)) {
+			w.hashes[file] = hash
 		}
+		w.mu.Unlock()
 	}
 }
 
@@ -8,6 +8,9 @@ import (
 	"testing"
 	"time"
 	"video-stream-processor/internal/config"
+	"video-stream-processor/internal/queue"
+	"video-stream-processor/internal/redisstore"
+	"video-stream-processor/internal/streamid"
 
 	"go.uber.org/zap"
 )
@@ -54,12 +57,12 @@ func TestWatcherInterface_Mock(t *testing.T) {
 
 func TestScanExistingFiles(t *testing.T) {
 	dir := t.TempDir()
-	fileCh := make(chan string, 1)
+	fileCh := queue.NewChannel(1)
 	cfg := &config.Config{WatchDir: dir, StabilityThreshold: 1, VideoFileFormats: []string{".mp4"}}
 	w := &Watcher{
 		cfg:    cfg,
 		log:    zap.NewNop(),
-		fileCh: fileCh,
+		queue:  fileCh,
 		seen:   make(map[string]time.Time),
 		hashes: make(map[string]string),
 		mu:     sync.Mutex{},
@@ -77,12 +80,12 @@ func TestScanExistingFiles(t *testing.T) {
 
 func TestRescanFiles(t *testing.T) {
 	dir := t.TempDir()
-	fileCh := make(chan string, 1)
+	fileCh := queue.NewChannel(1)
 	cfg := &config.Config{WatchDir: dir, StabilityThreshold: 1, VideoFileFormats: []string{".mp4"}}
 	w := &Watcher{
 		cfg:    cfg,
 		log:    zap.NewNop(),
-		fileCh: fileCh,
+		queue:  fileCh,
 		seen:   make(map[string]time.Time),
 		hashes: make(map[string]string),
 		mu:     sync.Mutex{},
@@ -98,6 +101,98 @@ func TestRescanFiles(t *testing.T) {
 	}
 }
 
+func TestListFiles_Recursive(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"top.mp4", "site/cam/a.mp4", "site/cam/2025-05-27/b.mp4", "site/notes.txt"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755)
+		os.WriteFile(filepath.Join(dir, f), []byte("data"), 0644)
+	}
+	cases := []struct {
+		recursive bool
+		maxDepth  int
+		want      int
+	}{
+		{false, 0, 1},
+		{true, 0, 3},
+		{true, 2, 2},
+	}
+	for _, c := range cases {
+		w := &Watcher{cfg: &config.Config{WatchDir: dir, WatchRecursive: c.recursive, WatchMaxDepth: c.maxDepth, VideoFileFormats: []string{".mp4"}}, log: zap.NewNop(), filters: filterChain{extFilter([]string{".mp4"})}}
+		files, err := w.listFiles(dir)
+		if err != nil || len(files) != c.want {
+			t.Errorf("recursive=%v depth=%d: expected %d files, got %v (%v)", c.recursive, c.maxDepth, c.want, files, err)
+		}
+	}
+}
+
+func TestStart_WatchesNewSubdirectories(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "site1", "cam1"), 0755)
+	cfg := &config.Config{WatchDir: dir, WatchRecursive: true, WatchMaxDepth: 3, StabilityThreshold: 60, VideoFileFormats: []string{".mp4"}}
+	w := New(cfg, config.Profile{}, zap.NewNop(), queue.NewChannel(1), &mockRedisStore{}).(*Watcher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Start(ctx)
+	time.Sleep(200 * time.Millisecond)
+
+	existing := filepath.Join(dir, "site1", "cam1", "a.mp4")
+	nested := filepath.Join(dir, "site1", "cam2", "2025-05-27", "b.mp4")
+	tooDeep := filepath.Join(dir, "site1", "cam2", "2025-05-27", "extra", "c.mp4")
+	os.WriteFile(existing, []byte("data"), 0644)
+	os.MkdirAll(filepath.Dir(tooDeep), 0755)
+	os.WriteFile(nested, []byte("data"), 0644)
+	os.WriteFile(tooDeep, []byte("data"), 0644)
+
+	seen := func(file string) bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		_, ok := w.seen[file]
+		return ok
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !(seen(existing) && seen(nested)) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !seen(existing) || !seen(nested) {
+		t.Fatal("files in subdirectories should be detected")
+	}
+	if seen(tooDeep) {
+		t.Error("files below the maximum depth should be ignored")
+	}
+}
+
+func TestCheckStableFiles_Profile(t *testing.T) {
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "seg.ts")
+	os.WriteFile(fpath, []byte("data"), 0644)
+	os.WriteFile(filepath.Join(dir, "other.mp4"), []byte("data"), 0644)
+	cfg := &config.Config{WatchDir: "/unused", StabilityThreshold: 60, VideoFileFormats: []string{".mp4"}}
+	profile := config.Profile{Name: "cameras", WatchDir: dir, Extensions: []string{".ts"}, StabilityThreshold: 1, Priority: 7}
+	q := queue.NewChannel(2)
+	store := &mockRedisStore{statusMap: map[string]string{}, hashMap: map[string]string{}}
+	w := New(cfg, profile, zap.NewNop(), q, store).(*Watcher)
+	w.scanExistingFiles()
+	w.checkStableFiles(time.Duration(w.cfg.StabilityThreshold) * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	job, err := q.Dequeue(ctx)
+	if err != nil || job.File != fpath || job.Profile != "cameras" || job.Priority != 7 {
+		t.Fatalf("Expected %s queued for profile cameras with priority 7, got %+v (%v)", fpath, job, err)
+	}
+	if file, ok := dequeue(q, 100*time.Millisecond); ok {
+		t.Errorf("Only the profile's extensions should be queued, got %s", file)
+	}
+}
+
+// dequeue returns the next queued file, or false if none arrives within timeout
+func dequeue(q queue.Queue, timeout time.Duration) (string, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	job, err := q.Dequeue(ctx)
+	return job.File, err == nil
+}
+
 // mockRedisStore implements redisstore.Store for testing filterFile logic
 // Only implements methods needed for filterFile
 
@@ -126,9 +221,30 @@ func (m *mockRedisStore) SetStreamProgress(ctx context.Context, streamID string,
 func (m *mockRedisStore) GetStreamProgress(ctx context.Context, streamID string) (int, error) {
 	return 0, nil
 }
-func (m *mockRedisStore) SetStreamStatus(ctx context.Context, streamID, status string) error {
+func (m *mockRedisStore) TransitionStream(ctx context.Context, streamID string, to redisstore.StreamState, reason string) error {
+	if !redisstore.CanTransition(redisstore.StreamState(m.statusMap[streamID]), to) {
+		return redisstore.ErrInvalidTransition
+	}
+	m.statusMap[streamID] = string(to)
+	return nil
+}
+func (m *mockRedisStore) ResetStream(ctx context.Context, streamID string) error {
+	if m.statusMap[streamID] != string(redisstore.StateCancelled) {
+		return redisstore.ErrInvalidTransition
+	}
+	m.statusMap[streamID] = string(redisstore.StateDetected)
+	return nil
+}
+func (m *mockRedisStore) GetStreamInfo(ctx context.Context, streamID string) (redisstore.StreamInfo, error) {
+	return redisstore.StreamInfo{State: redisstore.StreamState(m.statusMap[streamID])}, nil
+}
+func (m *mockRedisStore) SetStreamChunkSize(ctx context.Context, streamID string, size int) error {
+	return nil
+}
+func (m *mockRedisStore) SetStreamKeyTime(ctx context.Context, streamID string, t time.Time) error {
 	return nil
 }
+func (m *mockRedisStore) MigrateStatusKeys(ctx context.Context) (int, error) { return 0, nil }
 func (m *mockRedisStore) SetStreamTTL(ctx context.Context, streamID string, ttl time.Duration) error {
 	return nil
 }
@@ -138,7 +254,46 @@ func (m *mockRedisStore) ScanIncompleteStreams(ctx context.Context) ([]string, e
 func (m *mockRedisStore) SetValue(ctx context.Context, key, value string, ttl time.Duration) error {
 	return nil
 }
+func (m *mockRedisStore) SetValueNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	if _, ok := m.hashMap[key]; ok {
+		return false, nil
+	}
+	m.hashMap[key] = value
+	return true, nil
+}
 func (m *mockRedisStore) DeleteKey(ctx context.Context, key string) error { return nil }
+func (m *mockRedisStore) SetReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) error {
+	return nil
+}
+func (m *mockRedisStore) IsReplicaChunkUploaded(ctx context.Context, dest, streamID string, chunkIdx int) (bool, error) {
+	return false, nil
+}
+func (m *mockRedisStore) PushBackfill(ctx context.Context, dest, entry string) error { return nil }
+func (m *mockRedisStore) PopBackfill(ctx context.Context, dest string) (string, error) {
+	return "", nil
+}
+func (m *mockRedisStore) UploadedChunks(ctx context.Context, streamID string) ([]int, error) {
+	return nil, nil
+}
+func (m *mockRedisStore) ClearChunks(ctx context.Context, streamID string, fromIdx int) error {
+	return nil
+}
+func (m *mockRedisStore) CommitChunk(ctx context.Context, streamID string, chunkIdx int) error {
+	return nil
+}
+func (m *mockRedisStore) CompleteStream(ctx context.Context, streamID string, ttl time.Duration) error {
+	return nil
+}
+func (m *mockRedisStore) MigrateChunkKeys(ctx context.Context) (int, error) { return 0, nil }
+func (m *mockRedisStore) AcquireLease(ctx context.Context, streamID, owner string, ttl time.Duration) (int64, error) {
+	return 1, nil
+}
+func (m *mockRedisStore) RenewLease(ctx context.Context, streamID string, token int64, ttl time.Duration) error {
+	return nil
+}
+func (m *mockRedisStore) ReleaseLease(ctx context.Context, streamID string, token int64) error {
+	return nil
+}
 
 func TestFilterFile(t *testing.T) {
 	dir := t.TempDir()
@@ -168,13 +323,14 @@ func TestFilterFile(t *testing.T) {
 		w := &Watcher{
 			cfg:    &config.Config{VideoFileFormats: []string{".mp4"}},
 			log:    zap.NewNop(),
-			fileCh: nil,
+			queue:  nil,
 			seen:   make(map[string]time.Time),
 			hashes: make(map[string]string),
 			mu:     sync.Mutex{},
 			redis:  store,
+			ids:    streamid.New(&config.Config{}, store),
 		}
-		if got := w.filterFile(fpath); got != c.expect {
+		if _, got := w.filterFile(fpath); got != c.expect {
 			t.Errorf("%s: expected %v, got %v", c.name, c.expect, got)
 		}
 	}
@@ -183,7 +339,7 @@ func TestFilterFile(t *testing.T) {
 // Update TestCheckStableFiles to use mockRedisStore and verify filtering
 func TestCheckStableFiles_Filtered(t *testing.T) {
 	dir := t.TempDir()
-	fileCh := make(chan string, 1)
+	fileCh := queue.NewChannel(1)
 	fpath := filepath.Join(dir, "test.mp4")
 	os.WriteFile(fpath, []byte("somedata"), 0644)
 	hash := fileHash(fpath)
@@ -196,28 +352,26 @@ func TestCheckStableFiles_Filtered(t *testing.T) {
 	w := &Watcher{
 		cfg:    &config.Config{WatchDir: dir, StabilityThreshold: 1, VideoFileFormats: []string{".mp4"}},
 		log:    zap.NewNop(),
-		fileCh: fileCh,
+		queue:  fileCh,
 		seen:   make(map[string]time.Time),
 		hashes: make(map[string]string),
 		mu:     sync.Mutex{},
 		redis:  store,
+		ids:    streamid.New(&config.Config{}, store),
 	}
 	now := time.Now().Add(-2 * time.Second)
 	w.mu.Lock()
 	w.seen[fpath] = now
 	w.mu.Unlock()
 	w.checkStableFiles(1 * time.Second)
-	select {
-	case <-fileCh:
+	if _, ok := dequeue(fileCh, 300*time.Millisecond); ok {
 		t.Error("Should not send already processed file to channel")
-	case <-time.After(300 * time.Millisecond):
-		// pass
 	}
 }
 
 func TestCheckStableFiles_WithFilter(t *testing.T) {
 	dir := t.TempDir()
-	fileCh := make(chan string, 1)
+	fileCh := queue.NewChannel(1)
 	fpath := filepath.Join(dir, "test.mp4")
 	os.WriteFile(fpath, []byte("somedata"), 0644)
 	hash := fileHash(fpath)
@@ -226,30 +380,31 @@ func TestCheckStableFiles_WithFilter(t *testing.T) {
 
 	// Case 1: Not completed, should send
 	store1 := &mockRedisStore{
-		statusMap: map[string]string{streamID: "in_progress"},
+		statusMap: map[string]string{streamID: "uploading"},
 		hashMap:   map[string]string{hashKey: hash},
 	}
 	w1 := &Watcher{
 		cfg:    &config.Config{WatchDir: dir, StabilityThreshold: 1, VideoFileFormats: []string{".mp4"}},
 		log:    zap.NewNop(),
-		fileCh: fileCh,
+		queue:  fileCh,
 		seen:   make(map[string]time.Time),
 		hashes: make(map[string]string),
 		mu:     sync.Mutex{},
 		redis:  store1,
+		ids:    streamid.New(&config.Config{}, store1),
 	}
 	now := time.Now().Add(-2 * time.Second)
 	w1.mu.Lock()
 	w1.seen[fpath] = now
 	w1.mu.Unlock()
 	w1.checkStableFiles(1 * time.Second)
-	select {
-	case file := <-fileCh:
-		if file != fpath {
-			t.Errorf("Expected %s, got %s", fpath, file)
-		}
-	case <-time.After(1 * time.Second):
+	if file, ok := dequeue(fileCh, 1*time.Second); !ok {
 		t.Error("Timeout waiting for file from checkStableFiles (should send)")
+	} else if file != fpath {
+		t.Errorf("Expected %s, got %s", fpath, file)
+	}
+	if st := store1.statusMap[streamID]; st != "queued" {
+		t.Errorf("Queued file should be marked queued, got %q", st)
 	}
 
 	// Case 2: completed and hash matches, should NOT send
@@ -260,20 +415,18 @@ func TestCheckStableFiles_WithFilter(t *testing.T) {
 	w2 := &Watcher{
 		cfg:    &config.Config{WatchDir: dir, StabilityThreshold: 1, VideoFileFormats: []string{".mp4"}},
 		log:    zap.NewNop(),
-		fileCh: fileCh,
+		queue:  fileCh,
 		seen:   make(map[string]time.Time),
 		hashes: make(map[string]string),
 		mu:     sync.Mutex{},
 		redis:  store2,
+		ids:    streamid.New(&config.Config{}, store2),
 	}
 	w2.mu.Lock()
 	w2.seen[fpath] = now
 	w2.mu.Unlock()
 	w2.checkStableFiles(1 * time.Second)
-	select {
-	case <-fileCh:
+	if _, ok := dequeue(fileCh, 300*time.Millisecond); ok {
 		t.Error("Should not send already processed file to channel (completed+hash match)")
-	case <-time.After(300 * time.Millisecond):
-		// pass
 	}
 }